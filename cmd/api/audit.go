@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/mathiasb/greenlight/internal/data"
+	"github.com/mathiasb/greenlight/internal/validator"
+)
+
+// audit records that the current user performed action on resource. The write
+// happens in the background and failures are only logged, so auditing never
+// fails the request itself.
+func (app *application) audit(r *http.Request, action, resource string) {
+	entry := &data.AuditEntry{
+		Action:    action,
+		Resource:  resource,
+		RequestID: app.contextGetRequestID(r),
+	}
+
+	if user := app.contextGetUser(r); !user.IsAnonymous() {
+		entry.UserID = &user.ID
+	}
+
+	app.background(func() {
+		err := app.models.Audit.Insert(entry)
+		if err != nil {
+			app.logger.Error(err.Error(), "action", action, "resource", resource, "request_id", entry.RequestID)
+		}
+	})
+}
+
+func (app *application) listAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Action string
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+	input.Action = app.readString(qs, "action", "")
+	input.Page = app.readInt(qs, "page", 1, v)
+	input.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Sort = app.readString(qs, "sort", "-id")
+	input.SortSafeList = []string{"id", "created_at", "-id", "-created_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	entries, metadata, err := app.models.Audit.GetAll(input.Action, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"metadata": metadata, "audit_log": entries}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/mathiasb/greenlight/internal/data"
+)
+
+// movieCache is an LRU cache of movies by ID for showMovieHandler. A nil
+// *movieCache is a valid, always empty cache, which is what's used unless
+// -cache-movies is set.
+//
+// Writers invalidate an ID both before and after changing it in the database.
+// To stop a read that started before the write from caching the old row after
+// the second invalidation, add only stores a movie if nothing has been
+// invalidated since the reader called generation. addViews counts as an
+// invalidation for the same reason, though it updates the movies it has
+// rather than dropping them.
+type movieCache struct {
+	mu            sync.Mutex
+	movies        *lru.Cache[int64, data.Movie]
+	invalidations uint64
+}
+
+func newMovieCache(size int) (*movieCache, error) {
+	movies, err := lru.New[int64, data.Movie](size)
+	if err != nil {
+		return nil, err
+	}
+	return &movieCache{movies: movies}, nil
+}
+
+func (c *movieCache) get(id int64) (*data.Movie, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	movie, ok := c.movies.Get(id)
+	if !ok {
+		return nil, false
+	}
+	// The genres and summary are still shared with the cached entry, so
+	// callers must treat the movie as read-only.
+	return &movie, true
+}
+
+// generation must be called before reading a movie from the database that is
+// going to be passed to add.
+func (c *movieCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.invalidations
+}
+
+func (c *movieCache) add(movie *data.Movie, generation uint64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation == c.invalidations {
+		c.movies.Add(movie.ID, *movie)
+	}
+}
+
+func (c *movieCache) invalidate(ids ...int64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.invalidations++
+	for _, id := range ids {
+		c.movies.Remove(id)
+	}
+}
+
+// addViews adds views that have been written to the database to the cached
+// movies.
+func (c *movieCache) addViews(counts map[int64]int64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.invalidations++
+	for id, n := range counts {
+		if movie, ok := c.movies.Peek(id); ok {
+			movie.ViewCount += n
+			c.movies.Add(id, movie)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mathiasb/greenlight/internal/data"
+)
+
+func TestMovieCacheAddViews(t *testing.T) {
+	c, err := newMovieCache(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.add(&data.Movie{ID: 1, ViewCount: 5}, c.generation())
+	c.add(&data.Movie{ID: 2, ViewCount: 0}, c.generation())
+
+	// A read that started before the views were written mustn't cache its
+	// older count.
+	generation := c.generation()
+
+	c.addViews(map[int64]int64{1: 3, 3: 7})
+
+	tests := []struct {
+		id        int64
+		wantFound bool
+		wantViews int64
+	}{
+		{1, true, 8},
+		{2, true, 0},
+		// Views for movies that aren't cached don't add them.
+		{3, false, 0},
+	}
+
+	for _, tt := range tests {
+		movie, found := c.get(tt.id)
+		if found != tt.wantFound {
+			t.Fatalf("movie %d: got found %t; want %t", tt.id, found, tt.wantFound)
+		}
+		if found && movie.ViewCount != tt.wantViews {
+			t.Errorf("movie %d: got %d views; want %d", tt.id, movie.ViewCount, tt.wantViews)
+		}
+	}
+
+	c.add(&data.Movie{ID: 3, ViewCount: 0}, generation)
+	if _, found := c.get(3); found {
+		t.Error("got a movie added with a generation from before addViews")
+	}
+}
+
+func TestMovieETag(t *testing.T) {
+	app := newTestApplication(t)
+	r := httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil)
+
+	movie := &data.Movie{ID: 1, Version: 1}
+	etag := app.movieETag(r, movie)
+
+	viewed := *movie
+	viewed.ViewCount++
+	if got := app.movieETag(r, &viewed); got == etag {
+		t.Errorf("got the same ETag %s after a view", got)
+	}
+
+	edited := *movie
+	edited.Version++
+	if got := app.movieETag(r, &edited); got == etag {
+		t.Errorf("got the same ETag %s after an edit", got)
+	}
+
+	average := 4.0
+	rated := *movie
+	rated.RatingAverage, rated.RatingCount = &average, 1
+	ratedETag := app.movieETag(r, &rated)
+	if ratedETag == etag {
+		t.Errorf("got the same ETag %s after a rating", ratedETag)
+	}
+
+	// A user changing their rating changes the average but not the count.
+	changed := 3.5
+	rerated := rated
+	rerated.RatingAverage = &changed
+	if got := app.movieETag(r, &rerated); got == ratedETag {
+		t.Errorf("got the same ETag %s after a changed rating", got)
+	}
+
+	if got := app.movieETag(r, movie); got != etag {
+		t.Errorf("got ETag %s; want %s", got, etag)
+	}
+}
+
+// TestMovieETagRepresentation checks that the strong ETag differs between
+// bodies that differ only in their JSON naming or indentation.
+func TestMovieETagRepresentation(t *testing.T) {
+	app := newTestApplication(t)
+	movie := &data.Movie{ID: 1, Version: 1}
+
+	camel := func(r *http.Request) *http.Request { return app.contextSetJSONNaming(r, jsonNamingCamel) }
+	prettyHeader := httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil)
+	prettyHeader.Header.Set("X-Pretty", "true")
+
+	requests := []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil),
+		camel(httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil)),
+		httptest.NewRequest(http.MethodGet, "/v1/movies/1?pretty=true", nil),
+		camel(httptest.NewRequest(http.MethodGet, "/v1/movies/1?pretty=true", nil)),
+	}
+
+	seen := make(map[string]bool)
+	for _, r := range requests {
+		etag := app.movieETag(r, movie)
+		if strings.HasPrefix(etag, "W/") {
+			t.Errorf("%s: got weak ETag %s", r.URL, etag)
+		}
+		if seen[etag] {
+			t.Errorf("%s: got ETag %s for two representations", r.URL, etag)
+		}
+		seen[etag] = true
+	}
+
+	// The header and the query parameter produce the same body.
+	if got, want := app.movieETag(prettyHeader, movie), app.movieETag(requests[2], movie); got != want {
+		t.Errorf("got ETag %s with X-Pretty; want %s", got, want)
+	}
+}
@@ -10,7 +10,11 @@ import (
 type contextKey string
 
 const (
-	contextKeyUser = contextKey("user")
+	contextKeyUser       = contextKey("user")
+	contextKeyAPIVersion = contextKey("apiVersion")
+	contextKeyRequestID  = contextKey("requestID")
+	contextKeyJSONNaming = contextKey("jsonNaming")
+	contextKeyRetry      = contextKey("conflictRetry")
 )
 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
@@ -25,3 +29,56 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+func (app *application) contextSetAPIVersion(r *http.Request, version int) *http.Request {
+	ctx := context.WithValue(r.Context(), contextKeyAPIVersion, version)
+	return r.WithContext(ctx)
+}
+
+// contextGetAPIVersion returns the API version negotiated for the request,
+// defaulting to version 1.
+func (app *application) contextGetAPIVersion(r *http.Request) int {
+	version, ok := r.Context().Value(contextKeyAPIVersion).(int)
+	if !ok {
+		return 1
+	}
+	return version
+}
+
+func (app *application) contextSetRequestID(r *http.Request, requestID string) *http.Request {
+	ctx := context.WithValue(r.Context(), contextKeyRequestID, requestID)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetRequestID(r *http.Request) string {
+	requestID, _ := r.Context().Value(contextKeyRequestID).(string)
+	return requestID
+}
+
+func (app *application) contextSetJSONNaming(r *http.Request, naming string) *http.Request {
+	ctx := context.WithValue(r.Context(), contextKeyJSONNaming, naming)
+	return r.WithContext(ctx)
+}
+
+// contextGetJSONNaming returns the JSON naming negotiated for the request,
+// defaulting to -json-naming for requests that haven't been through
+// negotiation yet.
+func (app *application) contextGetJSONNaming(r *http.Request) string {
+	naming, ok := r.Context().Value(contextKeyJSONNaming).(string)
+	if !ok {
+		return app.config.jsonNaming
+	}
+	return naming
+}
+
+func (app *application) contextSetConflictRetry(r *http.Request, retry *conflictRetry) *http.Request {
+	ctx := context.WithValue(r.Context(), contextKeyRetry, retry)
+	return r.WithContext(ctx)
+}
+
+// contextGetConflictRetry returns nil unless the handler was wrapped in
+// withConflictRetry.
+func (app *application) contextGetConflictRetry(r *http.Request) *conflictRetry {
+	retry, _ := r.Context().Value(contextKeyRetry).(*conflictRetry)
+	return retry
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"embed"
+	"net/http"
+)
+
+// The OpenAPI document is maintained by hand alongside the handlers, so it
+// should be updated whenever a route or its request/response shape changes.
+//
+//go:embed "docs"
+var docsFS embed.FS
+
+const docsCSP = "default-src 'none'; script-src https://unpkg.com 'unsafe-inline'; style-src https://unpkg.com 'unsafe-inline'; " +
+	"img-src 'self' data: https://unpkg.com; connect-src 'self'; frame-ancestors 'none'"
+
+func (app *application) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	spec, err := docsFS.ReadFile("docs/openapi.json")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(spec)
+}
+
+func (app *application) docsHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := docsFS.ReadFile("docs/index.html")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The page loads Swagger UI from unpkg, which a policy meant for JSON
+	// responses would block.
+	if app.config.headers.csp != "" {
+		w.Header().Set("Content-Security-Policy", docsCSP)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
@@ -1,19 +1,115 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/mathiasb/greenlight/internal/data"
+	"github.com/mathiasb/greenlight/internal/i18n"
+	"github.com/mathiasb/greenlight/internal/validator"
+	"golang.org/x/text/language"
+)
 
 func (app *application) logError(r *http.Request, err error) {
 	var (
-		method = r.Method
-		uri    = r.URL.RequestURI()
+		method    = r.Method
+		uri       = r.URL.RequestURI()
+		requestID = app.contextGetRequestID(r)
 	)
-	app.logger.Error(err.Error(), "method", method, "uri", uri)
+	app.logger.Error(err.Error(), "method", method, "uri", uri, "request_id", requestID)
+}
+
+// panicHook is called with every recovered panic, along with the request that
+// caused it (nil for background tasks), e.g. to forward it to an error
+// reporting service.
+type panicHook func(value any, stack []byte, r *http.Request)
+
+// goroutinePanic is a panic recovered on a handler's own goroutine, re-raised
+// on the request's goroutine with the stack from where it happened.
+type goroutinePanic struct {
+	value any
+	stack []byte
+}
+
+// reportPanic logs a recovered panic with its stack trace. It must be called
+// from the deferred function that recovered, so that the stack still shows
+// where the panic happened.
+func (app *application) reportPanic(r *http.Request, value any) {
+	stack := debug.Stack()
+	if p, ok := value.(goroutinePanic); ok {
+		value, stack = p.value, p.stack
+	}
+
+	attrs := []any{"panic", fmt.Sprint(value), "stack", string(stack)}
+	if r != nil {
+		attrs = append(attrs, "method", r.Method, "path", r.URL.Path, "request_id", app.contextGetRequestID(r))
+	}
+	app.logger.Error("recovered from panic", attrs...)
+
+	if app.panicHook != nil {
+		app.panicHook(value, stack, r)
+	}
+}
+
+// language returns the language to write error messages in, picked from the
+// request's Accept-Language header, and sets the response headers to match.
+func (app *application) language(w http.ResponseWriter, r *http.Request) language.Tag {
+	tag := i18n.Negotiate(r.Header.Get("Accept-Language"))
+
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("Content-Language", tag.String())
+	return tag
+}
+
+// localizeFieldErrors translates the validator's errors, in the shape chosen
+// by -validation-error-format. The map format can't hold the codes alongside
+// the messages, so they're returned separately, keyed by field; the list
+// format includes them in each entry and returns nil codes.
+func (app *application) localizeFieldErrors(tag language.Tag, v *validator.Validator) (fieldErrors any, codes map[string]string) {
+	type fieldError struct {
+		Field   string `json:"field"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+
+	if app.config.validationErrorFormat == "list" {
+		list := make([]fieldError, len(v.Errors))
+		for i, e := range v.Errors {
+			list[i] = fieldError{Field: e.Field, Code: e.Code, Message: e.Message.Translate(tag)}
+		}
+		return list, nil
+	}
+
+	// Like v.FieldErrors, only the first error for each field.
+	messages := make(map[string]string, len(v.FieldErrors))
+	codes = make(map[string]string, len(v.FieldErrors))
+	for _, e := range v.Errors {
+		if _, exists := messages[e.Field]; !exists {
+			messages[e.Field] = e.Message.Translate(tag)
+			codes[e.Field] = e.Code
+		}
+	}
+	return messages, codes
 }
 
+// errorResponse writes message, translating it if it's a string or an
+// *i18n.Error.
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
+	tag := app.language(w, r)
+
+	switch m := message.(type) {
+	case string:
+		message = i18n.Translate(tag, m)
+	case *i18n.Error:
+		message = m.Translate(tag)
+	}
+
 	env := envelope{"error": message}
 
-	err := app.writeJSON(w, status, env, nil)
+	err := app.writeJSON(w, r, status, env, nil)
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -21,6 +117,32 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 }
 
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	// The driver doesn't always wrap the context's error when a query is
+	// cancelled, so check the request's context directly.
+	if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		app.timeoutResponse(w, r, err)
+		return
+	}
+	// Otherwise a deadline comes from -db-query-timeout. Reads can safely be
+	// retried, so they're told when to; a write may have been applied.
+	if errors.Is(err, context.DeadlineExceeded) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			app.databaseBusyResponse(w, r, err)
+		} else {
+			app.timeoutResponse(w, r, err)
+		}
+		return
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(r.Context().Err(), context.Canceled) {
+		app.clientGoneResponse(w, r, err)
+		return
+	}
+
+	if data.IsConnectionError(err) {
+		app.databaseUnavailableResponse(w, r, err)
+		return
+	}
+
 	app.logError(r, err)
 
 	message := "the server encountered a problem and could not process your request"
@@ -32,17 +154,56 @@ func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request)
 	app.errorResponse(w, r, http.StatusNotFound, message)
 }
 
+// methodNotAllowedResponse expects the Allow header to be set already; httprouter
+// sets it before calling its MethodNotAllowed handler.
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the method is not supported for this resource"
 	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
 }
 
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the requested representation is not supported by this resource"
+	app.errorResponse(w, r, http.StatusNotAcceptable, message)
+}
+
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+	var message any = err.Error()
+	var i18nErr *i18n.Error
+	if errors.As(err, &i18nErr) {
+		message = i18nErr
+	}
+
+	// readJSON's errors all end up here, including this one.
+	if errors.Is(err, errUnsupportedMediaType) {
+		app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+		return
+	}
+
+	app.errorResponse(w, r, http.StatusBadRequest, message)
 }
 
-func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, v *validator.Validator) {
+	tag := app.language(w, r)
+
+	fieldErrors, codes := app.localizeFieldErrors(tag, v)
+
+	env := envelope{"error": fieldErrors}
+	if codes != nil {
+		env["error_codes"] = codes
+	}
+	if len(v.NonFieldErrors) > 0 {
+		nonFieldErrors := make([]string, len(v.NonFieldErrors))
+		for i, message := range v.NonFieldErrors {
+			nonFieldErrors[i] = message.Translate(tag)
+		}
+		env["non_field_errors"] = nonFieldErrors
+	}
+
+	err := app.writeJSON(w, r, http.StatusUnprocessableEntity, env, nil)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
@@ -50,11 +211,64 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
+func (app *application) idempotencyKeyInUseResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a request with this idempotency key is still being processed"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) idempotencyKeyMismatchResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this idempotency key was already used for a different request"
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, message)
+}
+
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+func (app *application) timeoutResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.logger.Warn("request timed out", "method", r.Method, "uri", r.URL.RequestURI(), "request_id", app.contextGetRequestID(r), "error", err.Error())
+
+	message := "the server took too long to process your request, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+// databaseUnavailableResponse is used when the connection to the database is
+// lost. That's expected to be transient, so the client is asked to retry.
+func (app *application) databaseUnavailableResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.logger.Warn("database unavailable", "method", r.Method, "uri", r.URL.RequestURI(), "request_id", app.contextGetRequestID(r), "error", err.Error())
+
+	w.Header().Set("Retry-After", "5")
+	message := "the server is temporarily unable to reach its database, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+// databaseBusyResponse is used when a read runs past -db-query-timeout,
+// which usually means the connection pool is saturated and queries are
+// queueing for a connection.
+func (app *application) databaseBusyResponse(w http.ResponseWriter, r *http.Request, err error) {
+	stats := app.models.DB.Stats()
+	app.logger.Warn("database busy", "method", r.Method, "uri", r.URL.RequestURI(), "request_id", app.contextGetRequestID(r), "error", err.Error(),
+		"in_use", stats.InUse, "max_open", stats.MaxOpenConnections, "wait_count", stats.WaitCount)
+
+	w.Header().Set("Retry-After", "1")
+	message := "the server is too busy to process your request, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+// clientGoneResponse is used when the client disconnected before the request
+// was handled. There's no one left to send a response to, so the request is
+// only logged, at a lower level than errors.
+func (app *application) clientGoneResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.logger.Info("request aborted by client", "method", r.Method, "uri", r.URL.RequestURI(), "request_id", app.contextGetRequestID(r), "error", err.Error())
+}
+
+func (app *application) maintenanceResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "60")
+	message := "the server is temporarily unavailable for maintenance, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -80,3 +294,20 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) scopedTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed with a scoped token"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// notMovieOwnerResponse is used when -movie-ownership stops a user changing a
+// movie they didn't create.
+func (app *application) notMovieOwnerResponse(w http.ResponseWriter, r *http.Request) {
+	message := "only the user who created this movie, or a movie admin, can change it"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) registrationClosedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "registration of new users is closed"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
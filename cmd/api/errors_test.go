@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mathiasb/greenlight/internal/validator"
+)
+
+func TestFailedValidationResponseCodes(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		want   string
+	}{
+		{
+			"map",
+			"map",
+			`{"error":{"email":"must be provided","title":"must be provided"},"error_codes":{"email":"REQUIRED","title":"REQUIRED"}}`,
+		},
+		{
+			// Every error is listed, not only the first for each field.
+			"list",
+			"list",
+			`{"error":[{"field":"title","code":"REQUIRED","message":"must be provided"},{"field":"title","code":"TOO_SHORT","message":"must be at least 2 characters long"},{"field":"email","code":"REQUIRED","message":"must be provided"}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.validationErrorFormat = tt.format
+
+			v := validator.New()
+			v.Check(false, "title", validator.CodeRequired, "must be provided")
+			v.Check(false, "title", validator.CodeTooShort, "must be at least 2 characters long")
+			v.Check(false, "email", validator.CodeRequired, "must be provided")
+
+			rr := httptest.NewRecorder()
+			app.failedValidationResponse(rr, httptest.NewRequest(http.MethodPost, "/", nil), v)
+
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Errorf("got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+			}
+
+			var got, want any
+			if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("got %s; want %s", strings.TrimSpace(rr.Body.String()), tt.want)
+			}
+		})
+	}
+}
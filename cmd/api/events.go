@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mathiasb/greenlight/internal/data"
+)
+
+const (
+	movieCreated = "movie.created"
+	movieUpdated = "movie.updated"
+	movieDeleted = "movie.deleted"
+)
+
+// movieEvent is sent to event stream clients and the webhook. MovieID is the
+// movie's movieRef.
+type movieEvent struct {
+	Action    string    `json:"action"`
+	MovieID   any       `json:"movie_id"`
+	Version   int32     `json:"version,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// publishMovieEvent notifies event stream subscribers and the configured
+// webhook that a movie changed. The webhook request is made in the background
+// so it never delays the response.
+func (app *application) publishMovieEvent(action string, movie *data.Movie) {
+	event := movieEvent{
+		Action:    action,
+		MovieID:   app.movieRef(movie.ID, movie.UUID),
+		Version:   movie.Version,
+		Timestamp: time.Now().UTC(),
+	}
+
+	app.events.publish(event)
+
+	if app.webhook.Enabled() {
+		app.background(func() {
+			err := app.webhook.Send(event)
+			if err != nil {
+				app.logger.Error(err.Error(), "action", event.Action, "movie_id", event.MovieID)
+			}
+		})
+	}
+}
+
+// movieEventHub fans movie events out to the connected event stream clients.
+// Each subscriber has its own buffered channel; if a client falls behind,
+// events are dropped for that client rather than blocking everyone else.
+type movieEventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan movieEvent]struct{}
+	closed      bool
+}
+
+func newMovieEventHub() *movieEventHub {
+	return &movieEventHub{
+		subscribers: make(map[chan movieEvent]struct{}),
+	}
+}
+
+func (h *movieEventHub) subscribe() chan movieEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan movieEvent, 16)
+	if h.closed {
+		close(ch)
+		return ch
+	}
+	h.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (h *movieEventHub) unsubscribe(ch chan movieEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[ch]; ok {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (h *movieEventHub) publish(event movieEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// close disconnects all subscribers. It is called on shutdown, as the open
+// streams would otherwise keep the server from shutting down gracefully.
+func (h *movieEventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (app *application) movieEventsHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+
+	// The stream is held open indefinitely, so lift the server's write timeout
+	// for this connection.
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	events := app.events.subscribe()
+	defer app.events.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	err = rc.Flush()
+	if err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			js, err := json.Marshal(event)
+			if err != nil {
+				app.logError(r, err)
+				return
+			}
+
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Action, js)
+			if err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+		}
+
+		err = rc.Flush()
+		if err != nil {
+			return
+		}
+	}
+}
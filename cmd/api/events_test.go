@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mathiasb/greenlight/internal/data"
+)
+
+func TestMovieEventID(t *testing.T) {
+	movie := &data.Movie{ID: 42, UUID: "0b9c7f9e-4f2a-4c8e-9a53-3f1a9f0c1d2e", Version: 3}
+
+	tests := []struct {
+		movieIDs string
+		want     string
+	}{
+		{movieIDsInt, `{"action":"movie.updated","movie_id":42,"version":3,"timestamp":"2024-01-02T03:04:05Z"}`},
+		{movieIDsUUID, `{"action":"movie.updated","movie_id":"0b9c7f9e-4f2a-4c8e-9a53-3f1a9f0c1d2e","version":3,"timestamp":"2024-01-02T03:04:05Z"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.movieIDs, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.movieIDs = tt.movieIDs
+
+			ch := app.events.subscribe()
+			defer app.events.unsubscribe(ch)
+
+			app.publishMovieEvent(movieUpdated, movie)
+
+			event := <-ch
+			event.Timestamp = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+			got, err := json.Marshal(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s; want %s", got, tt.want)
+			}
+
+			if got := app.movieIDParam(movie); got != fmt.Sprint(app.movieRef(movie.ID, movie.UUID)) {
+				t.Errorf("movieIDParam %q doesn't match movieRef", got)
+			}
+		})
+	}
+}
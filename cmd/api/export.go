@@ -0,0 +1,118 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mathiasb/greenlight/internal/data"
+)
+
+const moviesExported = "movies.exported"
+
+// exportedMovie is one line of an export. Unlike the API representation it
+// includes the timestamps, so that an import can restore them. It leaves out
+// the rating aggregate, which is derived from ratings that aren't exported,
+// and the creator, who may not exist where the export is imported.
+type exportedMovie struct {
+	ID               int64        `json:"id"`
+	UUID             string       `json:"uuid"`
+	CreatedAt        time.Time    `json:"created_at"`
+	UpdatedAt        time.Time    `json:"updated_at"`
+	Title            string       `json:"title"`
+	Year             int32        `json:"year"`
+	Runtime          data.Runtime `json:"runtime"`
+	Genres           []string     `json:"genres"`
+	Summary          *string      `json:"summary,omitempty"`
+	IMDbID           *string      `json:"imdb_id,omitempty"`
+	DuplicateAllowed bool         `json:"duplicate_allowed,omitempty"`
+	ViewCount        int64        `json:"view_count"`
+	RatingAverage    *float64     `json:"-"`
+	RatingCount      int64        `json:"-"`
+	CreatedBy        *int64       `json:"-"`
+	Version          int32        `json:"version"`
+}
+
+// exportManifest is the last line of an export. It comes last because the
+// count isn't known until every movie has been written.
+type exportManifest struct {
+	ExportedAt time.Time `json:"exported_at"`
+	Count      int       `json:"count"`
+	Version    string    `json:"version"`
+}
+
+// exportMoviesHandler streams every movie as gzipped NDJSON, one movie per
+// line, followed by a {"manifest": ...} line.
+func (app *application) exportMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+
+	// Large catalogues can take longer to send than the server's write timeout.
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	manifest := exportManifest{ExportedAt: time.Now().UTC(), Version: version}
+
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+
+	// The headers are only sent once there's something to write, so that a
+	// failed query can still get a normal error response.
+	started := false
+	start := func() {
+		filename := fmt.Sprintf("movies-%s.ndjson.gz", manifest.ExportedAt.Format("20060102T150405Z"))
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		w.WriteHeader(http.StatusOK)
+		started = true
+	}
+
+	filters := data.Filters{Sort: "id", SortSafeList: []string{"id"}}
+
+	err = app.models.Movies.Each(r.Context(), "", []string{}, 0, 0, filters, func(movie *data.Movie) error {
+		if !started {
+			start()
+		}
+
+		err := enc.Encode(exportedMovie(*movie))
+		if err != nil {
+			return err
+		}
+
+		manifest.Count++
+		if manifest.Count%100 == 0 {
+			return gz.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		switch {
+		case !started:
+			app.serverErrorResponse(w, r, err)
+		case r.Context().Err() != nil:
+			app.clientGoneResponse(w, r, err)
+		default:
+			app.logError(r, err)
+		}
+		return
+	}
+
+	if !started {
+		start()
+	}
+
+	err = enc.Encode(envelope{"manifest": manifest})
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		app.logError(r, err)
+		return
+	}
+
+	app.audit(r, moviesExported, "movies")
+}
@@ -2,15 +2,76 @@ package main
 
 import (
 	"net/http"
+
+	"github.com/mathiasb/greenlight/internal/data"
+	"github.com/mathiasb/greenlight/migrations"
 )
 
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
-	err := app.writeJSON(w, http.StatusOK,
+	status, code := "available", http.StatusOK
+	switch app.maintenance.Load() {
+	case maintenanceReadOnly:
+		status = "read_only"
+	case maintenanceDown:
+		status, code = "maintenance", http.StatusServiceUnavailable
+	}
+
+	err := app.writeJSON(w, r, code,
 		envelope{
-			"status": "available",
+			"status": status,
 			"system_info": map[string]string{
-				"environment": app.config.env,
-				"version":     version,
+				"environment":      app.config.env,
+				"version":          version,
+				"maintenance_mode": app.maintenanceModeName(),
+			},
+		},
+		nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readyHandler reports whether the server can serve traffic: the database
+// must be reachable, in which case the schema version is checked too. A dirty
+// schema, or one older than -db-schema-version, gets a "warning" status, as
+// that usually means migrations weren't run before deploying.
+func (app *application) readyHandler(w http.ResponseWriter, r *http.Request) {
+	expected := app.config.db.schemaVersion
+	if expected == 0 {
+		expected = migrations.Latest()
+	}
+
+	version, dirty, err := app.models.Schema.Version(r.Context())
+	if err != nil {
+		app.logError(r, err)
+
+		// A lost connection usually means the database is restarting, and the
+		// pool will reconnect once it's back.
+		database := "error"
+		if data.IsConnectionError(err) {
+			database = "unreachable"
+		}
+
+		err = app.writeJSON(w, r, http.StatusServiceUnavailable, envelope{"status": "unavailable", "database": database}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	status := "ready"
+	if dirty || version < expected {
+		status = "warning"
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK,
+		envelope{
+			"status":   status,
+			"database": "reachable",
+			"schema": map[string]any{
+				"version":          version,
+				"dirty":            dirty,
+				"expected_version": expected,
 			},
 		},
 		nil)
@@ -1,59 +1,313 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/mathiasb/greenlight/internal/data"
+	"github.com/mathiasb/greenlight/internal/i18n"
 	"github.com/mathiasb/greenlight/internal/validator"
 )
 
 type envelope map[string]any
 
+var (
+	errInvalidIDParam = errors.New("invalid id parameter")
+
+	uuidRX = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+// readIDParam returns the movie ID from the URL. With -movie-ids=uuid the URL
+// holds the movie's UUID instead, which is looked up to find the ID, so the
+// error may also be data.ErrRecordNotFound or a database error.
 func (app *application) readIDParam(r *http.Request) (int64, error) {
 	params := httprouter.ParamsFromContext(r.Context())
+
+	if app.config.movieIDs == movieIDsUUID {
+		if !uuidRX.MatchString(params.ByName("id")) {
+			return 0, errInvalidIDParam
+		}
+		return app.models.Movies.GetIDForUUID(r.Context(), params.ByName("id"))
+	}
+
+	// ParseInt rejects values outside the int64 range as well as non-numeric
+	// ones, but it accepts zero and negative numbers, which are never IDs.
 	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
-	if err != nil && id < 1 {
-		return 0, errors.New("invalid id parameter")
+	if err != nil || id < 1 {
+		return 0, errInvalidIDParam
 	}
 
 	return id, nil
 }
 
-func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
-	js, err := json.MarshalIndent(data, "", "\t")
+// readUserIDParam returns the user ID from the URL.
+func (app *application) readUserIDParam(r *http.Request) (int64, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errInvalidIDParam
+	}
+
+	return id, nil
+}
+
+// movieIDParam returns the ID that identifies the movie in URLs and
+// responses: its UUID with -movie-ids=uuid, otherwise its integer ID.
+func (app *application) movieIDParam(movie *data.Movie) string {
+	return fmt.Sprint(app.movieRef(movie.ID, movie.UUID))
+}
+
+// movieRef is movieIDParam for the movie with the given ID and UUID, as a
+// string or an int64 so that it keeps its type in JSON. Everything clients
+// see, from events to the audit log, refers to movies this way.
+func (app *application) movieRef(id int64, uuid string) any {
+	if app.config.movieIDs == movieIDsUUID {
+		return uuid
+	}
+	return id
+}
+
+func (app *application) writeJSON(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) error {
+	js, err := app.marshalJSON(r, data)
 	if err != nil {
 		return err
 	}
 
-	js = append(js, '\n')
+	writeJSONBody(w, status, js, headers)
+	return nil
+}
+
+// writeCacheableJSON writes a 200 response to a GET that browsers and proxies
+// may cache as directed by cacheControl. Unless the headers already include an
+// ETag, a weak one is derived from the body, and a request whose If-None-Match
+// matches it gets 304 Not Modified instead. The body is indented for an
+// X-Pretty header, so caches are told to key on it.
+func (app *application) writeCacheableJSON(w http.ResponseWriter, r *http.Request, cacheControl string, data envelope, headers http.Header) error {
+	js, err := app.marshalJSON(r, data)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Add("Vary", "X-Pretty")
+
+	app.writeCacheable(w, r, cacheControl, js, headers)
+	return nil
+}
+
+// writeCacheableXML is writeCacheableJSON for an XML body with the given root
+// element. A preset ETag gets an "-xml" suffix so that the two representations
+// of a resource never share one.
+func (app *application) writeCacheableXML(w http.ResponseWriter, r *http.Request, cacheControl string, root string, data any, headers http.Header) error {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "\t")
+	err := enc.EncodeElement(data, xml.StartElement{Name: xml.Name{Local: root}})
+	if err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	if etag := headers.Get("ETag"); etag != "" {
+		headers.Set("ETag", strings.TrimSuffix(etag, `"`)+`-xml"`)
+	}
+	headers.Set("Content-Type", "application/xml; charset=utf-8")
+
+	app.writeCacheable(w, r, cacheControl, buf.Bytes(), headers)
+	return nil
+}
+
+// writeCacheable does the work of writeCacheableJSON once the body is ready.
+func (app *application) writeCacheable(w http.ResponseWriter, r *http.Request, cacheControl string, body []byte, headers http.Header) {
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	if cacheControl != "" {
+		headers.Set("Cache-Control", cacheControl)
+	}
+
+	etag := headers.Get("ETag")
+	if etag == "" {
+		sum := sha256.Sum256(body)
+		etag = fmt.Sprintf(`W/"%x"`, sum[:16])
+		headers.Set("ETag", etag)
+	}
 
+	if ifNoneMatch(r, etag) {
+		for k, v := range headers {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	writeJSONBody(w, http.StatusOK, body, headers)
+}
+
+// With -envelope=data, responses put their payload under a "data" key instead
+// of a key named after it, e.g. {"data": {...}} rather than {"movie": {...}}.
+const (
+	envelopeNamed = "named"
+	envelopeData  = "data"
+)
+
+// reshapeEnvelope applies -envelope=data to an envelope. Pagination metadata
+// and links stay at the top level, as does an error. If one other key is left
+// its value becomes the data, otherwise the remaining keys do.
+func (app *application) reshapeEnvelope(data envelope) envelope {
+	if app.config.envelope != envelopeData {
+		return data
+	}
+	if _, ok := data["error"]; ok {
+		return data
+	}
+
+	reshaped := envelope{}
+	payload := envelope{}
+	for key, value := range data {
+		switch key {
+		case "metadata", "links":
+			reshaped[key] = value
+		default:
+			payload[key] = value
+		}
+	}
+
+	if len(payload) == 1 {
+		for _, value := range payload {
+			reshaped["data"] = value
+		}
+	} else {
+		reshaped["data"] = payload
+	}
+	return reshaped
+}
+
+// marshalJSON encodes a response in the -envelope style compactly, or
+// indented by two spaces when the request asks for it with ?pretty=true or an
+// X-Pretty: true header, with the JSON naming negotiated for the request.
+func (app *application) marshalJSON(r *http.Request, data envelope) ([]byte, error) {
+	js, err := json.Marshal(app.reshapeEnvelope(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if app.contextGetJSONNaming(r) == jsonNamingCamel {
+		js, err = renameKeys(js, snakeToCamel)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if wantsPrettyJSON(r) {
+		var buf bytes.Buffer
+		err = json.Indent(&buf, js, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		js = buf.Bytes()
+	}
+
+	return append(js, '\n'), nil
+}
+
+func wantsPrettyJSON(r *http.Request) bool {
+	pretty, _ := strconv.ParseBool(prettyValue(r))
+	return pretty
+}
+
+// prettyValue returns the ?pretty parameter, or the X-Pretty header if the
+// parameter isn't set.
+func prettyValue(r *http.Request) string {
+	value := r.URL.Query().Get("pretty")
+	if value == "" {
+		value = r.Header.Get("X-Pretty")
+	}
+	return value
+}
+
+func writeJSONBody(w http.ResponseWriter, status int, js []byte, headers http.Header) {
 	for k, v := range headers {
 		w.Header()[k] = v
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	// Keep a content type that was already chosen, e.g. a versioned media type.
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
 
 	// Sigm, seal, deliver
 	w.WriteHeader(status)
 	w.Write(js)
+}
 
-	return nil
+// maxJSONBytes is the largest request body readJSON accepts.
+const maxJSONBytes = 1_048_576
+
+var errUnsupportedMediaType = errors.New("body must be sent with Content-Type: application/json")
+
+// hasJSONContentType reports whether the request declares a JSON body, either
+// application/json or a +json type such as application/vnd.greenlight.v2+json.
+func hasJSONContentType(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// hasMergePatchContentType reports whether the request body is a JSON Merge
+// Patch.
+func hasMergePatchContentType(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/merge-patch+json"
 }
 
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
-	maxBytes := 1_048_576
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
-	dec := json.NewDecoder(r.Body)
+	// An empty body is reported as such below, whatever its content type.
+	if app.config.strictContentType && r.ContentLength != 0 && !hasJSONContentType(r) {
+		return errUnsupportedMediaType
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBytes)
+
+	// The body is read up front so that its nesting can be checked before
+	// anything recursive sees it.
+	js, err := io.ReadAll(r.Body)
+	if err == nil && jsonDepthExceeds(js, app.config.jsonMaxDepth) {
+		return i18n.Errorf("body must not be nested more than %d levels deep", app.config.jsonMaxDepth)
+	}
+
+	// Unknown keys in a camelCase body are reported by their snake_case names.
+	if err == nil && app.contextGetJSONNaming(r) == jsonNamingCamel && len(bytes.TrimSpace(js)) > 0 {
+		js, err = renameKeys(js, camelToSnake)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
 	dec.DisallowUnknownFields()
 
-	err := dec.Decode(dst)
+	if err == nil {
+		err = dec.Decode(dst)
+	}
 	if err != nil {
 		var syntaxError *json.SyntaxError
 		var unmarshalTypeError *json.UnmarshalTypeError
@@ -62,7 +316,7 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 
 		switch {
 		case errors.As(err, &syntaxError):
-			return fmt.Errorf(
+			return i18n.Errorf(
 				"body contains badly-formed JSON (at character %d)",
 				syntaxError.Offset,
 			)
@@ -71,12 +325,12 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 				"body contains badly-formed JSON")
 		case errors.As(err, &unmarshalTypeError):
 			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf(
+				return i18n.Errorf(
 					"body contains incorrect JSON type for field %q",
 					unmarshalTypeError.Field,
 				)
 			}
-			return fmt.Errorf(
+			return i18n.Errorf(
 				"body contains incorrect JSON type (at character %d)",
 				unmarshalTypeError.Offset,
 			)
@@ -84,9 +338,9 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 			return errors.New("body must not be empty")
 		case strings.HasPrefix(err.Error(), "json: unknown field "):
 			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
-			return fmt.Errorf("body contains unknown key %s", fieldName)
+			return i18n.Errorf("body contains unknown key %s", fieldName)
 		case errors.As(err, &maxBytesError):
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+			return i18n.Errorf("body must not be larger than %d bytes", maxJSONBytes)
 		case errors.As(err, &invalidUnmarshalError):
 			panic(err)
 		default:
@@ -101,6 +355,97 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 	return nil
 }
 
+// readMergePatch is readJSON for a JSON Merge Patch (RFC 7386). dst must be a
+// struct of optional fields, which already decode with the RFC's semantics: a
+// null member clears the field and absent members keep theirs. Documents
+// without nested objects, like a movie, need nothing more, except that a patch
+// that isn't an object would replace the whole document. That can never leave
+// a valid document, so such patches are rejected.
+func (app *application) readMergePatch(w http.ResponseWriter, r *http.Request, dst any) error {
+	br := bufio.NewReader(http.MaxBytesReader(w, r.Body, maxJSONBytes))
+
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			// readJSON reports empty and oversized bodies.
+			break
+		}
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			continue
+		}
+		if c != '{' {
+			return errors.New("body must be a JSON object")
+		}
+		br.UnreadByte()
+		break
+	}
+
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, r.Body}
+
+	return app.readJSON(w, r, dst)
+}
+
+// withTx runs fn in a transaction, which is committed if fn succeeds and
+// rolled back otherwise.
+func (app *application) withTx(ctx context.Context, fn func(*sql.Tx) error) error {
+	tx, err := app.models.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// jsonDepthExceeds reports whether objects and arrays in js are nested more
+// than maxDepth deep. It only tracks brackets outside strings, leaving any
+// other problems with js to the decoder.
+func jsonDepthExceeds(js []byte, maxDepth int) bool {
+	depth := 0
+	inString, escaped := false, false
+
+	for _, c := range js {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+			// Brackets in strings don't nest anything.
+		case c == '{', c == '[':
+			depth++
+			if depth > maxDepth {
+				return true
+			}
+		case c == '}', c == ']':
+			depth--
+		}
+	}
+	return false
+}
+
+// accepts reports whether the request's Accept header explicitly lists the
+// given media type.
+func (app *application) accepts(r *http.Request, mediaType string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		accepted, _, _ = strings.Cut(accepted, ";")
+		if strings.EqualFold(strings.TrimSpace(accepted), mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
 func (app *application) readString(qs url.Values, key string, defaultValue string) string {
 	s := qs.Get(key)
 	if s == "" {
@@ -124,19 +469,116 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	}
 	i, err := strconv.Atoi(s)
 	if err != nil {
-		v.AddError(key, "must be an integer value")
+		v.AddError(key, validator.CodeInvalidFormat, "must be an integer value")
 		return defaultValue
 	}
 	return i
 }
 
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, validator.CodeInvalidFormat, "must be a boolean value")
+		return defaultValue
+	}
+	return b
+}
+
+// asOfYear returns the year of the as_of filter of a movie list, which is an
+// RFC 3339 date and time or a date on its own, or 0 if s is empty. The year is
+// taken in the UTC offset given, so that a client ahead of UTC gets its own
+// new year at midnight. Movies from later years are left out of the list.
+func (app *application) asOfYear(s string, v *validator.Validator) int32 {
+	if s == "" {
+		return 0
+	}
+
+	// A + in the UTC offset arrives as a space unless the client escaped it.
+	s = strings.ReplaceAll(s, " ", "+")
+
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return int32(t.Year())
+		}
+	}
+
+	v.AddError("as_of", validator.CodeInvalidFormat, "must be an RFC 3339 date and time or a YYYY-MM-DD date")
+	return 0
+}
+
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// movieETag identifies a representation of a movie, which changes with the
+// movie's version, its view count, its rating aggregate, the negotiated API
+// version and JSON naming, and whether the JSON is pretty-printed. Neither
+// views nor ratings bump the version, so they're included separately. The
+// ETag is strong, so each byte-for-byte different body needs its own.
+func (app *application) movieETag(r *http.Request, movie *data.Movie) string {
+	average := "none"
+	if movie.RatingAverage != nil {
+		average = strconv.FormatFloat(*movie.RatingAverage, 'f', -1, 64)
+	}
+
+	representation := app.contextGetJSONNaming(r)
+	if wantsPrettyJSON(r) {
+		representation += "-pretty"
+	}
+
+	return fmt.Sprintf(`"%s-%d-%d-%d-%s-v%d-%s"`, app.movieIDParam(movie), movie.Version, movie.ViewCount, movie.RatingCount, average, app.contextGetAPIVersion(r), representation)
+}
+
+// ifNoneMatch reports whether the If-None-Match header matches the ETag, in
+// which case a GET can be answered with 304 Not Modified. As RFC 9110
+// requires, weak ETags compare equal to strong ones with the same value.
+func ifNoneMatch(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModifiedSince reports whether the If-Modified-Since header shows that the
+// client has the version of a resource last modified at lastModified. The
+// header is ignored when If-None-Match is sent, as that takes precedence.
+func notModifiedSince(r *http.Request, lastModified time.Time) bool {
+	header := r.Header.Get("If-Modified-Since")
+	if header == "" || r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+
+	since, err := http.ParseTime(header)
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
 	go func() {
 		defer app.wg.Done()
 		defer func() {
 			if err := recover(); err != nil {
-				app.logger.Error(err.(error).Error())
+				app.reportPanic(nil, err)
 			}
 		}()
 		fn()
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mathiasb/greenlight/internal/data"
+	"github.com/mathiasb/greenlight/internal/validator"
+)
+
+// withParams returns r with the httprouter params set, as the router would.
+func withParams(r *http.Request, params ...httprouter.Param) *http.Request {
+	ctx := context.WithValue(r.Context(), httprouter.ParamsKey, httprouter.Params(params))
+	return r.WithContext(ctx)
+}
+
+func TestReadIDParam(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		want    int64
+		wantErr error
+	}{
+		{"one", "1", 1, nil},
+		{"max int64", "9223372036854775807", 9223372036854775807, nil},
+		{"zero", "0", 0, errInvalidIDParam},
+		{"negative", "-1", 0, errInvalidIDParam},
+		{"overflow", "9223372036854775808", 0, errInvalidIDParam},
+		{"huge", "99999999999999999999999999", 0, errInvalidIDParam},
+		{"non-numeric", "abc", 0, errInvalidIDParam},
+		{"decimal", "1.5", 0, errInvalidIDParam},
+		{"plus sign", "+1", 1, nil},
+		{"empty", "", 0, errInvalidIDParam},
+		// In integer mode a UUID isn't an ID, and isn't looked up.
+		{"uuid", "0b9c7f9e-4f2a-4c8e-9a53-3f1a9f0c1d2e", 0, errInvalidIDParam},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+
+			r := withParams(httptest.NewRequest(http.MethodGet, "/", nil), httprouter.Param{Key: "id", Value: tt.id})
+
+			got, err := app.readIDParam(r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadIDParamUUIDFormat(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.movieIDs = movieIDsUUID
+
+	// Malformed UUIDs are rejected before any lookup, so no database is
+	// needed.
+	for _, id := range []string{"1", "-1", "not-a-uuid", "0b9c7f9e-4f2a-4c8e-9a53-3f1a9f0c1d2", "0b9c7f9e4f2a4c8e9a533f1a9f0c1d2e"} {
+		r := withParams(httptest.NewRequest(http.MethodGet, "/", nil), httprouter.Param{Key: "id", Value: id})
+
+		_, err := app.readIDParam(r)
+		if !errors.Is(err, errInvalidIDParam) {
+			t.Errorf("readIDParam(%q) got error %v; want %v", id, err, errInvalidIDParam)
+		}
+	}
+}
+
+func TestAsOfYear(t *testing.T) {
+	tests := []struct {
+		name  string
+		asOf  string
+		want  int32
+		valid bool
+	}{
+		{"empty", "", 0, true},
+		{"date", "2024-12-31", 2024, true},
+		{"behind UTC", "2024-12-31T23:30:00-05:00", 2024, true},
+		{"ahead of UTC", "2025-01-01T02:00:00+09:00", 2025, true},
+		{"unescaped plus", "2025-01-01T02:00:00 09:00", 2025, true},
+		{"UTC", "2025-01-01T00:00:00Z", 2025, true},
+		{"no offset", "2025-01-01T00:00:00", 0, false},
+		{"not a date", "yesterday", 0, false},
+		{"invalid date", "2024-02-30", 0, false},
+	}
+
+	app := newTestApplication(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+
+			if got := app.asOfYear(tt.asOf, v); got != tt.want {
+				t.Errorf("got %d; want %d", got, tt.want)
+			}
+			if v.Valid() != tt.valid {
+				t.Errorf("got valid %t; want %t (errors %v)", v.Valid(), tt.valid, v.FieldErrors)
+			}
+			if !tt.valid && (len(v.Errors) != 1 || v.Errors[0].Field != "as_of" || v.Errors[0].Code != validator.CodeInvalidFormat) {
+				t.Errorf("got errors %+v; want one %s error for as_of", v.Errors, validator.CodeInvalidFormat)
+			}
+		})
+	}
+}
+
+func TestReadBool(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  bool
+		valid bool
+	}{
+		{"absent", "", false, true},
+		{"true", "merge=true", true, true},
+		{"one", "merge=1", true, true},
+		{"false", "merge=false", false, true},
+		{"malformed", "merge=yes2", false, false},
+	}
+
+	app := newTestApplication(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qs, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v := validator.New()
+
+			if got := app.readBool(qs, "merge", false, v); got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+			if v.Valid() != tt.valid {
+				t.Errorf("got valid %t; want %t (errors %v)", v.Valid(), tt.valid, v.FieldErrors)
+			}
+		})
+	}
+}
+
+func TestInvalidPretty(t *testing.T) {
+	routes := newTestRoutes(t)
+
+	tests := []struct {
+		name   string
+		target string
+		header string
+	}{
+		{"query", "/v1/healthcheck?pretty=yes2", ""},
+		{"header", "/v1/healthcheck", "yes2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set("X-Pretty", tt.header)
+			}
+			rr := httptest.NewRecorder()
+
+			routes.ServeHTTP(rr, r)
+
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Errorf("got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+			}
+			if !strings.Contains(rr.Body.String(), `"pretty"`) {
+				t.Errorf("got body %s; want an error for pretty", rr.Body)
+			}
+		})
+	}
+}
+
+func TestMarshalJSONPretty(t *testing.T) {
+	data := envelope{"movie": map[string]any{"title": "Up", "genres": []string{"animation"}}}
+	compact := `{"movie":{"genres":["animation"],"title":"Up"}}` + "\n"
+	pretty := "{\n  \"movie\": {\n    \"genres\": [\n      \"animation\"\n    ],\n    \"title\": \"Up\"\n  }\n}\n"
+
+	tests := []struct {
+		name   string
+		target string
+		header string
+		want   string
+	}{
+		{"default", "/", "", compact},
+		{"query", "/?pretty=true", "", pretty},
+		{"query 1", "/?pretty=1", "", pretty},
+		{"query false", "/?pretty=false", "", compact},
+		{"query invalid", "/?pretty=yes", "", compact},
+		{"header", "/", "true", pretty},
+		// The query parameter takes precedence over the header.
+		{"query over header", "/?pretty=false", "true", compact},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set("X-Pretty", tt.header)
+			}
+
+			got, err := app.marshalJSON(r, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONDepthExceeds(t *testing.T) {
+	tests := []struct {
+		name     string
+		js       string
+		maxDepth int
+		want     bool
+	}{
+		{"scalar", `1`, 1, false},
+		{"flat object", `{"a":1}`, 1, false},
+		{"at the limit", `{"a":[{"b":1}]}`, 3, false},
+		{"over the limit", `{"a":[{"b":[1]}]}`, 3, true},
+		{"arrays", `[[[[]]]]`, 3, true},
+		{"siblings don't add up", `[{},{},[],[]]`, 2, false},
+		{"brackets in strings", `{"a":"[[[[{{{{"}`, 1, false},
+		{"escaped quote in string", `{"a":"\"[[[["}`, 1, false},
+		{"escaped backslash before quote", `{"a":"\\"}`, 1, false},
+		{"nested after string", `{"a":"\\","b":[[1]]}`, 2, true},
+		{"deep", strings.Repeat("[", 10_000) + strings.Repeat("]", 10_000), 64, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jsonDepthExceeds([]byte(tt.js), tt.maxDepth); got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadJSONMaxDepth(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.jsonMaxDepth = 3
+
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{"at the limit", `{"genres":[{"a":1}]}`, ""},
+		{"over the limit", `{"genres":[{"a":[1]}]}`, "body must not be nested more than 3 levels deep"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+
+			var dst map[string]any
+			err := app.readJSON(httptest.NewRecorder(), r, &dst)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Fatalf("got error %v; want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJSONMaxDepthResponse(t *testing.T) {
+	routes := newTestRoutes(t)
+
+	body := `{"name":` + strings.Repeat("[", 65) + strings.Repeat("]", 65) + `}`
+	r := httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	routes.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("got status %d; want %d", rr.Code, http.StatusBadRequest)
+	}
+	if want := "body must not be nested more than 64 levels deep"; !strings.Contains(rr.Body.String(), want) {
+		t.Errorf("got body %s; want it to contain %q", rr.Body, want)
+	}
+}
+
+func TestReadMergePatch(t *testing.T) {
+	ptr := func(s string) *string { return &s }
+
+	tests := []struct {
+		name        string
+		body        string
+		wantErr     string
+		wantTitle   string
+		wantSummary *string
+		wantIMDbID  *string
+	}{
+		{"absent keeps", `{"year":2017}`, "", "Moana", ptr("A girl sails"), ptr("tt3521164")},
+		{"null clears", `{"summary":null,"imdb_id":null}`, "", "Moana", nil, nil},
+		{"value sets", ` {"title":"Moana 2","summary":"She sails again"}`, "", "Moana 2", ptr("She sails again"), ptr("tt3521164")},
+		{"array", `[{"title":"Moana 2"}]`, "body must be a JSON object", "", nil, nil},
+		{"null document", "\n null", "body must be a JSON object", "", nil, nil},
+		{"string", `"Moana 2"`, "body must be a JSON object", "", nil, nil},
+		{"empty", "  ", "body must not be empty", "", nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+
+			r := httptest.NewRequest(http.MethodPatch, "/v1/movies/1", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/merge-patch+json")
+			if !hasMergePatchContentType(r) {
+				t.Fatal("want a merge patch content type")
+			}
+
+			var input movieUpdateInput
+			err := app.readMergePatch(httptest.NewRecorder(), r, &input)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v; want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			movie := &data.Movie{
+				Title:   "Moana",
+				Year:    2016,
+				Runtime: 107,
+				Genres:  []string{"animation"},
+				Summary: ptr("A girl sails"),
+				IMDbID:  ptr("tt3521164"),
+			}
+			input.apply(movie)
+
+			if movie.Title != tt.wantTitle {
+				t.Errorf("got title %q; want %q", movie.Title, tt.wantTitle)
+			}
+			if !equalPtr(movie.Summary, tt.wantSummary) {
+				t.Errorf("got summary %v; want %v", movie.Summary, tt.wantSummary)
+			}
+			if !equalPtr(movie.IMDbID, tt.wantIMDbID) {
+				t.Errorf("got IMDb ID %v; want %v", movie.IMDbID, tt.wantIMDbID)
+			}
+		})
+	}
+}
+
+func TestNotModifiedSince(t *testing.T) {
+	updated := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	// A deletion after the last update is what LastModified then returns.
+	deleted := updated.Add(time.Minute)
+
+	tests := []struct {
+		name            string
+		ifModifiedSince string
+		ifNoneMatch     string
+		lastModified    time.Time
+		want            bool
+	}{
+		{"no header", "", "", updated, false},
+		{"unchanged", updated.Format(http.TimeFormat), "", updated, true},
+		{"fractional seconds", updated.Format(http.TimeFormat), "", updated.Add(500 * time.Millisecond), true},
+		{"updated since", updated.Format(http.TimeFormat), "", updated.Add(time.Second), false},
+		{"deleted since", updated.Format(http.TimeFormat), "", deleted, false},
+		{"If-None-Match takes precedence", updated.Format(http.TimeFormat), `"etag"`, updated, false},
+		{"invalid date", "yesterday", "", updated, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+			if tt.ifModifiedSince != "" {
+				r.Header.Set("If-Modified-Since", tt.ifModifiedSince)
+			}
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+
+			if got := notModifiedSince(r, tt.lastModified); got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
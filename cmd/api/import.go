@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/mathiasb/greenlight/internal/data"
+	"github.com/mathiasb/greenlight/internal/validator"
+)
+
+const (
+	moviesImported = "movies.imported"
+
+	// importBatchSize is the number of movies upserted per transaction.
+	importBatchSize = 500
+	// importMaxErrors caps the number of failed lines listed in the report.
+	importMaxErrors = 100
+	// importMaxLineLength is well above the longest movie the API accepts.
+	importMaxLineLength = 64 * 1024
+)
+
+type importError struct {
+	Line  int               `json:"line"`
+	Error any               `json:"error"`
+	Codes map[string]string `json:"error_codes,omitempty"`
+}
+
+type importReport struct {
+	Inserted int             `json:"inserted"`
+	Updated  int             `json:"updated"`
+	Skipped  int             `json:"skipped"`
+	Failed   int             `json:"failed"`
+	Errors   []importError   `json:"errors"`
+	Manifest *exportManifest `json:"manifest,omitempty"`
+}
+
+// importMoviesHandler reads an export produced by exportMoviesHandler line by
+// line, upserting the valid movies in batches. Each batch is committed on its
+// own, so if a batch fails the earlier ones stay imported. Lines that can't be
+// parsed, fail validation or clash with another movie's title and year or
+// IMDb ID are counted as failed and listed in the report.
+func (app *application) importMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+
+	// Reading a large export can take longer than the server's timeouts.
+	err := rc.SetReadDeadline(time.Time{})
+	if err == nil {
+		err = rc.SetWriteDeadline(time.Time{})
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		app.badRequestResponse(w, r, errors.New("body must be a gzipped NDJSON export"))
+		return
+	}
+	defer gz.Close()
+
+	report := importReport{Errors: []importError{}}
+	batch := make([]*data.Movie, 0, importBatchSize)
+	batchLines := make([]int, 0, importBatchSize)
+
+	fail := func(line int, message any) {
+		report.Failed++
+		if len(report.Errors) < importMaxErrors {
+			report.Errors = append(report.Errors, importError{Line: line, Error: message})
+		}
+	}
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		ids := make([]int64, len(batch))
+		for i, movie := range batch {
+			ids[i] = movie.ID
+		}
+
+		app.movieCache.invalidate(ids...)
+		result, err := app.models.Movies.Import(r.Context(), batch)
+		app.movieCache.invalidate(ids...)
+		if err != nil {
+			return err
+		}
+
+		report.Inserted += result.Inserted
+		report.Updated += result.Updated
+		report.Skipped += result.Skipped
+		for i, line := range batchLines {
+			err, found := result.Failed[i]
+			if !found {
+				continue
+			}
+
+			v := validator.New()
+			addDuplicateMovieError(v, err)
+			fail(line, v)
+		}
+
+		batch = batch[:0]
+		batchLines = batchLines[:0]
+		return nil
+	}
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 0, 4096), importMaxLineLength)
+
+	for line := 1; scanner.Scan(); line++ {
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+
+		var record struct {
+			exportedMovie
+			Manifest *exportManifest `json:"manifest"`
+		}
+
+		err := json.Unmarshal(b, &record)
+		if err != nil {
+			fail(line, err.Error())
+			continue
+		}
+
+		if record.Manifest != nil {
+			report.Manifest = record.Manifest
+			continue
+		}
+
+		movie := data.Movie(record.exportedMovie)
+
+		v := validator.New()
+		v.Check(movie.ID > 0, "id", validator.CodeTooSmall, "must be a positive integer")
+		v.Check(movie.Version > 0, "version", validator.CodeTooSmall, "must be a positive integer")
+		v.Check(movie.ViewCount >= 0, "view_count", validator.CodeTooSmall, "must not be negative")
+		v.Check(movie.UUID == "" || uuidRX.MatchString(movie.UUID), "uuid", validator.CodeInvalidFormat, "must be a valid UUID")
+		if data.ValidateMovie(v, &movie, app.models.Clock.Now(), app.config.movieRules); !v.Valid() {
+			fail(line, v)
+			continue
+		}
+
+		batch = append(batch, &movie)
+		batchLines = append(batchLines, line)
+		if len(batch) == importBatchSize {
+			err = flush()
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		app.badRequestResponse(w, r, fmt.Errorf("unable to read export: %w", err))
+		return
+	}
+
+	err = flush()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, moviesImported, "movies")
+
+	// Clashes are only found when a batch is written, after any later lines
+	// in it that failed to parse.
+	slices.SortStableFunc(report.Errors, func(a, b importError) int {
+		return cmp.Compare(a.Line, b.Line)
+	})
+
+	// Validation errors are translated like those of failedValidationResponse.
+	tag := app.language(w, r)
+	for i, e := range report.Errors {
+		if v, ok := e.Error.(*validator.Validator); ok {
+			report.Errors[i].Error, report.Errors[i].Codes = app.localizeFieldErrors(tag, v)
+		}
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"import": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
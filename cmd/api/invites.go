@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/mathiasb/greenlight/internal/data"
+	"github.com/mathiasb/greenlight/internal/validator"
+)
+
+// With -registration=invite, new users need an invite token created by
+// createInviteHandler; with closed, they can't register at all.
+const (
+	registrationOpen   = "open"
+	registrationInvite = "invite"
+	registrationClosed = "closed"
+)
+
+const (
+	inviteCreated  = "invite.created"
+	inviteRedeemed = "invite.redeemed"
+
+	// inviteTTL is how long an invite can be used to register.
+	inviteTTL = 7 * 24 * time.Hour
+)
+
+// errInviteEmailMismatch rolls back a registration with an invite issued for
+// another email address.
+var errInviteEmailMismatch = errors.New("invite was issued for a different email address")
+
+// createInviteHandler creates a single-use invite token. The invite can be
+// limited to one email address, which it's then sent to, and can grant
+// permissions on top of movies:read to the user who registers with it, as
+// long as the inviter holds them too.
+func (app *application) createInviteHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email       string   `json:"email"`
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	invite := &data.Invite{Email: input.Email, Permissions: input.Permissions}
+	if invite.Permissions == nil {
+		invite.Permissions = data.Permissions{}
+	}
+
+	granted, err := app.permissionsFor(app.contextGetUser(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateInvite(v, invite, granted); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	invite, err = app.models.Invites.New(app.contextGetUser(r).ID, inviteTTL, invite.Email, invite.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if invite.Email != "" {
+		app.background(func() {
+			data := map[string]any{
+				"inviteToken": invite.Token.Plaintext,
+			}
+			err := app.mailer.Send(invite.Email, "user_invite.tmpl", data)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		})
+	}
+
+	app.audit(r, inviteCreated, "invites")
+
+	err = app.writeJSON(w, r, http.StatusCreated, envelope{"invite": invite}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -3,20 +3,29 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
 	"log/slog"
+	"net/mail"
+	"net/netip"
+	"net/url"
 	"os"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/mathiasb/greenlight/internal/data"
+	"github.com/mathiasb/greenlight/internal/hibp"
 	"github.com/mathiasb/greenlight/internal/mailer"
+	"github.com/mathiasb/greenlight/internal/validator"
 	"github.com/mathiasb/greenlight/internal/vcs"
+	"github.com/mathiasb/greenlight/internal/webhook"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -27,15 +36,35 @@ type config struct {
 	port int
 	env  string
 	db   struct {
-		dsn          string
-		maxOpenConns int
-		maxIdleConns int
-		maxIdleTime  time.Duration
+		dsn           string
+		maxOpenConns  int
+		maxIdleConns  int
+		maxIdleTime   time.Duration
+		slowQuery     time.Duration
+		queryTimeout  time.Duration
+		schemaVersion int
+		migrate       string
+		autoMigrate   bool
+		// connectRetries is how many more times the initial connection is
+		// tried, waiting connectRetryDelay and then twice as long each time.
+		connectRetries    int
+		connectRetryDelay time.Duration
+		requireSSL        bool
 	}
 	limiter struct {
 		rps     float64
 		burst   int
 		enabled bool
+		exempt  []netip.Prefix
+
+		// warmup is how long after startup the limiter allows bursts of
+		// warmupBurst instead, for clients reconnecting after a restart.
+		warmup      time.Duration
+		warmupBurst int
+
+		// exportInterval is the minimum time between a user's personal data
+		// exports, which are expensive to produce.
+		exportInterval time.Duration
 	}
 	smtp struct {
 		host     string
@@ -46,49 +75,444 @@ type config struct {
 	}
 	cors struct {
 		trustedOrigins []string
+		maxAge         int
 	}
+	trustedProxies []netip.Prefix
+	password       struct {
+		hasher     string
+		bcryptCost int
+		check      string
+		blocklist  string
+		policy     data.PasswordPolicy
+	}
+	token struct {
+		mode               string
+		jwtSecret          string
+		jwtRevocationCheck bool
+	}
+	webhook struct {
+		url    string
+		secret string
+	}
+	metrics struct {
+		auth          string
+		token         string
+		localhostOnly bool
+	}
+	headers struct {
+		contentTypeOptions bool
+		frameOptions       string
+		referrerPolicy     string
+		csp                string
+		hsts               string
+	}
+	seed struct {
+		enabled    bool
+		adminEmail string
+	}
+	logBodies struct {
+		routes  []string
+		maxSize int
+		redact  string
+	}
+	cacheControl struct {
+		show string
+		list string
+	}
+	basePath              string
+	validationErrorFormat string
+	movieIDs              string
+	jsonNaming            string
+	envelope              string
+	strictContentType     bool
+	jsonMaxDepth          int
+	strictAccept          bool
+	publicReads           bool
+	requireActivation     bool
+	registration          string
+	idempotencyTTL        time.Duration
+	requestTimeout        time.Duration
+	responseTimeHeader    bool
+	slowResponse          time.Duration
+	batchDeleteMax        int
+	defaultMovieSort      string
+	movieRules            data.MovieRules
+	movieOwnership        bool
+	cacheMovies           bool
+	cacheMoviesSize       int
+	viewFlushInterval     time.Duration
+	trendingLimit         int
+	enablePprof           bool
+	allowExplain          bool
+	logLevel              slog.Level
+	configFile            string
+	force                 bool
 }
 
-type application struct {
-	config config
-	logger *slog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
-}
-
-func main() {
-	var cfg config
-
-	flag.IntVar(&cfg.port, "port", 4000, "Server port to listen on")
-	flag.StringVar(&cfg.env, "env", "development", "Application environment {development|production|staging}")
-	flag.StringVar(
+// defineFlags registers a flag for every config setting. It's used both at
+// startup and when reloading the config on SIGHUP.
+func defineFlags(fs *flag.FlagSet, cfg *config) {
+	fs.IntVar(&cfg.port, "port", 4000, "Server port to listen on")
+	fs.StringVar(&cfg.env, "env", "development", "Application environment {development|production|staging}")
+	fs.TextVar(&cfg.logLevel, "log-level", slog.LevelInfo, "Minimum log level {debug|info|warn|error}")
+	fs.StringVar(&cfg.basePath, "base-path", "/v1", "Path prefix for all API routes")
+	fs.StringVar(&cfg.validationErrorFormat, "validation-error-format", "map", "Format of validation errors in responses {map|list}")
+	fs.BoolVar(&cfg.strictContentType, "strict-content-type", true, "Reject JSON request bodies without a JSON Content-Type with 415")
+	fs.IntVar(&cfg.jsonMaxDepth, "json-max-depth", 64, "Maximum nesting depth of objects and arrays in JSON request bodies")
+	fs.BoolVar(&cfg.strictAccept, "strict-accept", true, "Reject requests whose Accept header rules out every media type the route offers with 406")
+	fs.StringVar(&cfg.jsonNaming, "json-naming", jsonNamingSnake, "Default naming of JSON keys, overridable by an Accept profile parameter {snake|camel}")
+	fs.StringVar(&cfg.registration, "registration", registrationOpen, "Who can register new users: anyone, only holders of an invite token, or no one {open|invite|closed}")
+	fs.BoolVar(&cfg.requireActivation, "require-activation", true, "Require new users to activate their account from the welcome email")
+	fs.BoolVar(&cfg.publicReads, "public-reads", false, "Allow reading movies without an authentication token")
+	fs.StringVar(&cfg.envelope, "envelope", envelopeNamed, "Top-level key of response payloads, named after the payload or always data {named|data}")
+	fs.StringVar(&cfg.movieIDs, "movie-ids", movieIDsInt, "How movies are identified in URLs and responses {int|uuid}")
+	fs.DurationVar(&cfg.requestTimeout, "request-timeout", 5*time.Second, "Maximum time to process a request, excluding streaming responses (0 to disable)")
+	fs.BoolVar(&cfg.responseTimeHeader, "response-time-header", false, "Send an X-Response-Time-Ms header with each response")
+	fs.DurationVar(&cfg.slowResponse, "slow-response-threshold", 0, "Log responses that take longer than this (0 to disable)")
+	fs.StringVar(
 		&cfg.db.dsn,
 		"db-dsn",
 		"",
 		"PostgreSQL DSN",
 	)
 
-	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
-	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
-	flag.DurationVar(&cfg.db.maxIdleTime, "db-max-idle-time", 15*time.Minute, "PostgreSQL max connection idle time")
+	fs.BoolVar(&cfg.db.requireSSL, "db-require-ssl", false, "Refuse to start with -env=production when -db-dsn doesn't encrypt the connection, rather than only warning")
+	fs.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
+	fs.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
+	fs.DurationVar(&cfg.db.maxIdleTime, "db-max-idle-time", 15*time.Minute, "PostgreSQL max connection idle time")
+	fs.StringVar(&cfg.db.migrate, "migrate", "", "Apply the embedded migrations and exit {up|down|version}")
+	fs.BoolVar(&cfg.db.autoMigrate, "auto-migrate", false, "Apply pending migrations at startup")
+	fs.IntVar(&cfg.db.schemaVersion, "db-schema-version", 0, "Schema version expected by the ready check (0 for the newest embedded migration)")
+	fs.DurationVar(&cfg.db.slowQuery, "db-slow-query-threshold", 0, "Log queries that take longer than this (0 to disable)")
+	fs.DurationVar(&cfg.db.queryTimeout, "db-query-timeout", 3*time.Second, "Maximum time for a query, including waiting for a free connection; reads that exceed it get 503")
+	fs.IntVar(&cfg.db.connectRetries, "db-connect-retries", 0, "How many times to retry connecting to PostgreSQL at startup before giving up")
+	fs.DurationVar(&cfg.db.connectRetryDelay, "db-connect-retry-delay", time.Second, "Delay before the first retry of the startup connection, doubled for each later one")
 
-	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
-	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
-	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	fs.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
+	fs.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
+	fs.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	fs.DurationVar(&cfg.limiter.warmup, "limiter-warmup", 0, "How long after startup the rate limiter uses -limiter-warmup-burst (0 = no warmup)")
+	fs.IntVar(&cfg.limiter.warmupBurst, "limiter-warmup-burst", 20, "Rate limiter maximum burst during -limiter-warmup")
+	fs.Func("limiter-exempt", "IPs or CIDR ranges of clients the rate limiter doesn't apply to (space separated)", func(val string) error {
+		var err error
+		cfg.limiter.exempt, err = parsePrefixes(val)
+		return err
+	})
+	fs.DurationVar(&cfg.limiter.exportInterval, "limiter-export-interval", 15*time.Minute, "Minimum time between a user's personal data exports (0 = no limit)")
 
-	flag.StringVar(&cfg.smtp.host, "smtp-host", "sandbox.smtp.mailtrap.io", "SMTP host")
-	flag.IntVar(&cfg.smtp.port, "smtp-port", 2525, "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", "0fb33e10529d62", "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", "e21865493483f5", "SMTP password")
-	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.com>", "SMTP sender")
+	fs.StringVar(&cfg.smtp.host, "smtp-host", "sandbox.smtp.mailtrap.io", "SMTP host")
+	fs.IntVar(&cfg.smtp.port, "smtp-port", 2525, "SMTP port")
+	fs.StringVar(&cfg.smtp.username, "smtp-username", "0fb33e10529d62", "SMTP username")
+	fs.StringVar(&cfg.smtp.password, "smtp-password", "e21865493483f5", "SMTP password")
+	fs.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.com>", "SMTP sender")
 
-	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
+	fs.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
 		cfg.cors.trustedOrigins = strings.Fields(val)
 		return nil
 	})
+	fs.IntVar(&cfg.cors.maxAge, "cors-max-age", 600, "Seconds browsers may cache a CORS preflight response (0 to 86400, 0 to omit the header; Chromium caps it at 7200)")
 	// https://www.alexedwards.net/blog/custom-command-line-flags
 
+	fs.Func("trusted-proxies", "IPs or CIDR ranges of proxies whose X-Forwarded-* headers are trusted (space separated)", func(val string) error {
+		var err error
+		cfg.trustedProxies, err = parsePrefixes(val)
+		return err
+	})
+
+	fs.StringVar(&cfg.password.hasher, "password-hasher", "bcrypt", "Password hashing scheme for newly set passwords {bcrypt|argon2id}")
+	fs.IntVar(&cfg.password.bcryptCost, "bcrypt-cost", 12, "Bcrypt cost for newly set passwords (4-31)")
+	fs.IntVar(&cfg.password.policy.MinLength, "password-min-length", 8, "Minimum length of new passwords (at least 8)")
+	fs.BoolVar(&cfg.password.policy.RequireMixedCase, "password-require-mixed-case", false, "Require new passwords to contain upper and lower case letters")
+	fs.BoolVar(&cfg.password.policy.RequireDigit, "password-require-digit", false, "Require new passwords to contain a digit")
+	fs.BoolVar(&cfg.password.policy.RequireSymbol, "password-require-symbol", false, "Require new passwords to contain a symbol")
+	fs.IntVar(&cfg.password.policy.MinStrength, "password-min-strength", 0, "Minimum zxcvbn strength score of new passwords (0-4, 0 to disable)")
+	fs.StringVar(&cfg.password.check, "password-check", "none", "Reject known-bad new passwords {none|blocklist|hibp}")
+	fs.StringVar(&cfg.password.blocklist, "password-blocklist", "", "File of disallowed passwords, one per line, used with -password-check=blocklist")
+
+	fs.StringVar(&cfg.token.mode, "token-mode", tokenModeStateful, "Authentication token mode {stateful|jwt}")
+	fs.StringVar(&cfg.token.jwtSecret, "jwt-secret", "", "Secret used to sign JWT authentication tokens (at least 32 bytes)")
+	fs.BoolVar(&cfg.token.jwtRevocationCheck, "jwt-revocation-check", false, "Check JWT authentication tokens against the database for revocation")
+
+	fs.StringVar(&cfg.webhook.url, "webhook-url", "", "URL to POST movie change events to (disabled if empty)")
+	fs.StringVar(&cfg.webhook.secret, "webhook-secret", "", "Secret used to sign webhook payloads")
+
+	fs.StringVar(&cfg.metrics.auth, "metrics-auth", metricsAuthPermission, "How /debug endpoints are protected {permission|token|none}")
+	fs.StringVar(&cfg.metrics.token, "metrics-token", "", "Bearer token for /debug endpoints when -metrics-auth=token")
+	fs.BoolVar(&cfg.metrics.localhostOnly, "metrics-localhost-only", false, "Only serve /debug endpoints to requests from localhost")
+	fs.BoolVar(&cfg.enablePprof, "enable-pprof", false, "Serve net/http/pprof profiles under /debug/pprof/")
+	fs.BoolVar(&cfg.allowExplain, "allow-explain", false, "Allow ?explain=true on movie lists when -env=production")
+
+	fs.BoolVar(&cfg.headers.contentTypeOptions, "header-content-type-options", true, "Send X-Content-Type-Options: nosniff")
+	fs.StringVar(&cfg.headers.frameOptions, "header-frame-options", "DENY", "X-Frame-Options header (omitted if empty)")
+	fs.StringVar(&cfg.headers.referrerPolicy, "header-referrer-policy", "no-referrer", "Referrer-Policy header (omitted if empty)")
+	fs.StringVar(&cfg.headers.csp, "header-csp", "default-src 'none'; frame-ancestors 'none'", "Content-Security-Policy header (omitted if empty)")
+	fs.StringVar(&cfg.headers.hsts, "header-hsts", "max-age=63072000; includeSubDomains", "Strict-Transport-Security header for HTTPS requests (omitted if empty)")
+
+	fs.StringVar(&cfg.cacheControl.show, "cache-control-show", "no-store", "Cache-Control header for GET /v1/movies/:id (omitted if empty)")
+	fs.StringVar(&cfg.cacheControl.list, "cache-control-list", "no-store", "Cache-Control header for movie lists (omitted if empty)")
+	fs.BoolVar(&cfg.cacheMovies, "cache-movies", false, "Cache single movie reads in memory")
+	fs.IntVar(&cfg.cacheMoviesSize, "cache-movies-size", 1000, "Maximum number of movies kept in the cache")
+	fs.DurationVar(&cfg.viewFlushInterval, "view-flush-interval", 10*time.Second, "How often movie view counts are written to the database")
+	fs.IntVar(&cfg.trendingLimit, "trending-limit", 10, "Number of movies listed by GET /v1/movies/trending")
+	fs.StringVar(&cfg.defaultMovieSort, "default-movie-sort", "id", "Sort order of movie lists that don't give one, e.g. -year")
+	fs.IntVar(&cfg.batchDeleteMax, "batch-delete-max", 100, "Maximum number of movies deleted by one DELETE /v1/movies request")
+	fs.IntVar(&cfg.movieRules.FutureYears, "movie-future-years", 0, "How many years after the current one a movie's year may be, for upcoming releases")
+	fs.IntVar(&cfg.movieRules.MinGenres, "movie-min-genres", 1, "Minimum number of genres per movie")
+	fs.IntVar(&cfg.movieRules.MaxGenres, "movie-max-genres", 5, "Maximum number of genres per movie")
+	fs.BoolVar(&cfg.movieOwnership, "movie-ownership", false, "Only let a movie's creator, or users with admin:movies, update or delete it")
+	fs.DurationVar(&cfg.idempotencyTTL, "idempotency-ttl", 24*time.Hour, "How long responses to requests with an Idempotency-Key are kept")
+
+	fs.BoolVar(&cfg.seed.enabled, "seed", false, "Insert an admin user and sample movies for development and exit")
+	fs.StringVar(&cfg.seed.adminEmail, "seed-admin-email", "admin@example.com", "Email address of the admin user created by -seed")
+	fs.BoolVar(&cfg.force, "force", false, "Allow -seed and -log-bodies with -env=production")
+
+	fs.Func("log-bodies", "Log request and response bodies of routes under these path prefixes, for debugging (space separated)", func(val string) error {
+		cfg.logBodies.routes = strings.Fields(val)
+		return nil
+	})
+	fs.IntVar(&cfg.logBodies.maxSize, "log-bodies-max-size", 4096, "Maximum number of bytes of each body logged by -log-bodies")
+	fs.StringVar(&cfg.logBodies.redact, "log-bodies-redact", "password token invite_token totp_code totp_secret otpauth_uri", "JSON keys whose values -log-bodies replaces with [REDACTED] (space separated)")
+
+	fs.StringVar(&cfg.configFile, "config", "", "Path to a YAML or JSON config file keyed by flag name")
+}
+
+// validate checks the merged config, normalizing the base path as it goes.
+// It reports every problem it finds, joined into one error, so that they can
+// all be fixed at once.
+func (cfg *config) validate() error {
+	var problems []error
+
+	if !validator.Between(cfg.port, 1, 65535) {
+		problems = append(problems, errors.New("-port must be between 1 and 65535"))
+	}
+
+	// lib/pq falls back to the PG* environment variables for an empty DSN.
+	if cfg.db.dsn == "" && os.Getenv("PGHOST") == "" {
+		problems = append(problems, errors.New("-db-dsn must be provided unless PGHOST is set"))
+	}
+
+	if cfg.smtp.sender != "" {
+		if cfg.smtp.host == "" {
+			problems = append(problems, errors.New("-smtp-host must be provided when -smtp-sender is set"))
+		}
+		if !validator.Between(cfg.smtp.port, 1, 65535) {
+			problems = append(problems, errors.New("-smtp-port must be between 1 and 65535"))
+		}
+		if _, err := mail.ParseAddress(cfg.smtp.sender); err != nil {
+			problems = append(problems, fmt.Errorf("invalid -smtp-sender %q", cfg.smtp.sender))
+		}
+	}
+
+	for _, origin := range cfg.cors.trustedOrigins {
+		if !validator.IsOrigin(origin) {
+			problems = append(problems, fmt.Errorf("invalid -cors-trusted-origins %q: not an http or https origin, such as https://example.com", origin))
+		}
+	}
+
+	if cfg.password.bcryptCost < bcrypt.MinCost || cfg.password.bcryptCost > bcrypt.MaxCost {
+		problems = append(problems, fmt.Errorf("-bcrypt-cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost))
+	}
+
+	cfg.basePath = strings.TrimSuffix(cfg.basePath, "/")
+	if cfg.basePath != "" && !strings.HasPrefix(cfg.basePath, "/") {
+		problems = append(problems, fmt.Errorf("-base-path %q must start with a slash", cfg.basePath))
+	}
+
+	if cfg.env == "production" && cfg.db.requireSSL && !isEncryptedSSLMode(dsnSSLMode(cfg.db.dsn)) {
+		problems = append(problems, fmt.Errorf("-db-dsn must not use sslmode=%s in production with -db-require-ssl", dsnSSLMode(cfg.db.dsn)))
+	}
+
+	if cfg.validationErrorFormat != "map" && cfg.validationErrorFormat != "list" {
+		problems = append(problems, fmt.Errorf("invalid -validation-error-format %q", cfg.validationErrorFormat))
+	}
+
+	if cfg.jsonNaming != jsonNamingSnake && cfg.jsonNaming != jsonNamingCamel {
+		problems = append(problems, fmt.Errorf("invalid -json-naming %q", cfg.jsonNaming))
+	}
+
+	if cfg.envelope != envelopeNamed && cfg.envelope != envelopeData {
+		problems = append(problems, fmt.Errorf("invalid -envelope %q", cfg.envelope))
+	}
+
+	if cfg.registration != registrationOpen && cfg.registration != registrationInvite && cfg.registration != registrationClosed {
+		problems = append(problems, fmt.Errorf("invalid -registration %q", cfg.registration))
+	}
+
+	if cfg.movieIDs != movieIDsInt && cfg.movieIDs != movieIDsUUID {
+		problems = append(problems, fmt.Errorf("invalid -movie-ids %q", cfg.movieIDs))
+	}
+
+	if cfg.webhook.url != "" && !validator.IsURL(cfg.webhook.url) {
+		problems = append(problems, fmt.Errorf("invalid -webhook-url %q", cfg.webhook.url))
+	}
+	if cfg.webhook.url != "" && cfg.webhook.secret == "" {
+		problems = append(problems, errors.New("-webhook-secret must be set when -webhook-url is"))
+	}
+
+	if cfg.password.hasher != "bcrypt" && cfg.password.hasher != "argon2id" {
+		problems = append(problems, fmt.Errorf("invalid -password-hasher %q", cfg.password.hasher))
+	}
+
+	if cfg.password.policy.MinLength < 8 || cfg.password.policy.MinLength > 72 {
+		problems = append(problems, errors.New("-password-min-length must be between 8 and 72"))
+	}
+
+	if cfg.password.policy.MinStrength < 0 || cfg.password.policy.MinStrength > 4 {
+		problems = append(problems, errors.New("-password-min-strength must be between 0 and 4"))
+	}
+
+	switch cfg.metrics.auth {
+	case metricsAuthPermission, metricsAuthNone:
+	case metricsAuthToken:
+		if len(cfg.metrics.token) < 16 {
+			problems = append(problems, errors.New("-metrics-token must be at least 16 bytes long when -metrics-auth=token"))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("invalid -metrics-auth %q", cfg.metrics.auth))
+	}
+
+	if cfg.cacheMovies && cfg.cacheMoviesSize < 1 {
+		problems = append(problems, errors.New("-cache-movies-size must be at least 1"))
+	}
+
+	switch cfg.db.migrate {
+	case "", migrateUp, migrateDown, migrateVersion:
+	default:
+		problems = append(problems, fmt.Errorf("invalid -migrate %q", cfg.db.migrate))
+	}
+
+	if cfg.seed.enabled && cfg.env == "production" && !cfg.force {
+		problems = append(problems, errors.New("refusing to -seed a production environment without -force"))
+	}
+
+	if len(cfg.logBodies.routes) > 0 && cfg.env == "production" && !cfg.force {
+		problems = append(problems, errors.New("refusing to -log-bodies in a production environment without -force"))
+	}
+
+	if cfg.logBodies.maxSize < 1 {
+		problems = append(problems, errors.New("-log-bodies-max-size must be at least 1"))
+	}
+
+	if cfg.db.schemaVersion < 0 {
+		problems = append(problems, errors.New("-db-schema-version must not be negative"))
+	}
+
+	if cfg.db.connectRetries < 0 || cfg.db.connectRetryDelay <= 0 {
+		problems = append(problems, errors.New("-db-connect-retries must not be negative and -db-connect-retry-delay must be positive"))
+	}
+
+	if cfg.viewFlushInterval <= 0 {
+		problems = append(problems, errors.New("-view-flush-interval must be positive"))
+	}
+
+	if cfg.trendingLimit < 1 {
+		problems = append(problems, errors.New("-trending-limit must be at least 1"))
+	}
+
+	if !validator.PermittedValue(cfg.defaultMovieSort, movieSortSafeList...) {
+		problems = append(problems, fmt.Errorf("invalid -default-movie-sort %q", cfg.defaultMovieSort))
+	}
+
+	if cfg.batchDeleteMax < 1 {
+		problems = append(problems, errors.New("-batch-delete-max must be at least 1"))
+	}
+
+	if cfg.db.queryTimeout <= 0 {
+		problems = append(problems, errors.New("-db-query-timeout must be positive"))
+	}
+
+	// An unlimited pool never makes queries wait, so -db-query-timeout
+	// would never turn saturation into a 503.
+	if cfg.db.maxOpenConns < 1 {
+		problems = append(problems, errors.New("-db-max-open-conns must be at least 1"))
+	}
+
+	if cfg.db.maxIdleConns < 0 || cfg.db.maxIdleTime < 0 {
+		problems = append(problems, errors.New("-db-max-idle-conns and -db-max-idle-time must not be negative"))
+	}
+
+	if cfg.cors.maxAge < 0 || cfg.cors.maxAge > 86400 {
+		problems = append(problems, errors.New("-cors-max-age must be between 0 and 86400"))
+	}
+
+	if cfg.movieRules.FutureYears < 0 {
+		problems = append(problems, errors.New("-movie-future-years must not be negative"))
+	}
+
+	if cfg.movieRules.MinGenres < 1 {
+		problems = append(problems, errors.New("-movie-min-genres must be at least 1"))
+	}
+
+	if cfg.movieRules.MaxGenres < cfg.movieRules.MinGenres {
+		problems = append(problems, errors.New("-movie-max-genres must not be less than -movie-min-genres"))
+	}
+
+	switch cfg.password.check {
+	case "none", "hibp":
+	case "blocklist":
+		if cfg.password.blocklist == "" {
+			problems = append(problems, errors.New("-password-blocklist must be set when -password-check=blocklist"))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("invalid -password-check %q", cfg.password.check))
+	}
+
+	switch cfg.token.mode {
+	case tokenModeStateful:
+	case tokenModeJWT:
+		if len(cfg.token.jwtSecret) < 32 {
+			problems = append(problems, errors.New("-jwt-secret must be at least 32 bytes long when -token-mode=jwt"))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("invalid -token-mode %q", cfg.token.mode))
+	}
+
+	if cfg.limiter.enabled && (cfg.limiter.rps <= 0 || cfg.limiter.burst < 1) {
+		problems = append(problems, errors.New("-limiter-rps must be greater than zero and -limiter-burst at least 1"))
+	}
+
+	if cfg.jsonMaxDepth < 1 {
+		problems = append(problems, errors.New("-json-max-depth must be at least 1"))
+	}
+
+	if cfg.limiter.warmup < 0 {
+		problems = append(problems, errors.New("-limiter-warmup must not be negative"))
+	}
+
+	if cfg.limiter.warmup > 0 && cfg.limiter.warmupBurst < 1 {
+		problems = append(problems, errors.New("-limiter-warmup-burst must be at least 1"))
+	}
+
+	if cfg.limiter.exportInterval < 0 {
+		problems = append(problems, errors.New("-limiter-export-interval must not be negative"))
+	}
+	return errors.Join(problems...)
+}
+
+type application struct {
+	config      config
+	logger      *slog.Logger
+	models      data.Models
+	mailer      mailer.Mailer
+	webhook     webhook.Notifier
+	events      *movieEventHub
+	movieCache  *movieCache
+	views       *viewCounter
+	trending    trendingCache
+	maintenance atomic.Int32
+	logLevel    *slog.LevelVar
+	panicHook   panicHook
+	live        liveConfig
+	wg          sync.WaitGroup
+
+	personalDataExports *exportLimiter
+}
+
+func main() {
+	var cfg config
+
+	defineFlags(flag.CommandLine, &cfg)
+
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
 	flag.Parse()
@@ -98,14 +522,92 @@ func main() {
 		os.Exit(0)
 	}
 
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	logLevel := new(slog.LevelVar)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel}))
 
-	db, err := openDB(cfg)
+	err := loadConfig(flag.CommandLine, cfg.configFile)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		for _, problem := range strings.Split(err.Error(), "\n") {
+			logger.Error(problem)
+		}
+		os.Exit(1)
+	}
+
+	logLevel.Set(cfg.logLevel)
+
+	sslMode := dsnSSLMode(cfg.db.dsn)
+	logger.Info("database connection", "sslmode", sslMode)
+	if cfg.env == "production" && !isEncryptedSSLMode(sslMode) {
+		logger.Warn("the database connection may not be encrypted in production", "sslmode", sslMode)
+	}
+
+	if cfg.db.migrate != "" {
+		err = runMigrations(cfg.db.dsn, cfg.db.migrate, logger)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	db, err := openDB(cfg, logger)
 	if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
 	}
-	defer db.Close()
+
+	if cfg.db.autoMigrate {
+		err = runMigrations(cfg.db.dsn, migrateUp, logger)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	var hasher data.PasswordHasher
+	switch cfg.password.hasher {
+	case "bcrypt":
+		hasher = data.BcryptHasher{Cost: cfg.password.bcryptCost}
+	case "argon2id":
+		hasher = data.DefaultArgon2idHasher()
+	}
+
+	policy := cfg.password.policy
+	switch cfg.password.check {
+	case "blocklist":
+		blocklist, err := data.LoadPasswordBlocklist(cfg.password.blocklist)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		policy.Checker = blocklist
+		logger.Info("password blocklist loaded", "passwords", len(blocklist))
+	case "hibp":
+		policy.Checker = hibp.New(func(err error) {
+			logger.Warn("unable to check password against breach database", "error", err.Error())
+		})
+	}
+
+	modelDB := data.NewDB(db, logger, cfg.db.slowQuery, cfg.db.queryTimeout)
+	modelDB.RequestID = func(ctx context.Context) string {
+		requestID, _ := ctx.Value(contextKeyRequestID).(string)
+		return requestID
+	}
+	defer modelDB.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	err = modelDB.Prepare(ctx)
+	cancel()
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
 
 	logger.Info("database connection pool established")
 
@@ -119,12 +621,55 @@ func main() {
 	expvar.Publish("timestamp", expvar.Func(func() any {
 		return time.Now().Unix()
 	}))
+	// expvar already publishes the full runtime.MemStats as "memstats"; this
+	// is the handful of figures worth watching, read on each scrape.
+	expvar.Publish("runtime", expvar.Func(func() any {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+
+		return map[string]any{
+			"heap_alloc_bytes":     m.HeapAlloc,
+			"heap_inuse_bytes":     m.HeapInuse,
+			"heap_objects":         m.HeapObjects,
+			"sys_bytes":            m.Sys,
+			"gc_count":             m.NumGC,
+			"gc_pause_total_ns":    m.PauseTotalNs,
+			"gc_last_pause_ns":     m.PauseNs[(m.NumGC+255)%256],
+			"gc_last_run_unix":     time.Unix(0, int64(m.LastGC)).Unix(),
+			"gc_cpu_fraction":      m.GCCPUFraction,
+			"next_gc_target_bytes": m.NextGC,
+		}
+	}))
 
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:   cfg,
+		logger:   logger,
+		models:   data.NewModels(modelDB, hasher, policy),
+		mailer:   mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		webhook:  webhook.New(cfg.webhook.url, cfg.webhook.secret),
+		events:   newMovieEventHub(),
+		views:    newViewCounter(),
+		logLevel: logLevel,
+
+		personalDataExports: newExportLimiter(),
+	}
+	app.live.set(cfg)
+
+	if cfg.cacheMovies {
+		app.movieCache, err = newMovieCache(cfg.cacheMoviesSize)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if cfg.seed.enabled {
+		err = app.seed()
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
 	err = app.serve()
@@ -134,21 +679,73 @@ func main() {
 	}
 }
 
-func openDB(cfg config) (*sql.DB, error) {
+// openDB connects to PostgreSQL. A connection that fails, e.g. because the
+// database is still starting, is retried -db-connect-retries times with
+// exponential backoff. The pool is sized by -db-max-open-conns and
+// -db-max-idle-conns.
+func openDB(cfg config, logger *slog.Logger) (*sql.DB, error) {
 	db, err := sql.Open("postgres", cfg.db.dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	delay := cfg.db.connectRetryDelay
+	for attempt := 1; ; attempt++ {
+		err = pingDB(db)
+		if err == nil || attempt > cfg.db.connectRetries {
+			break
+		}
 
-	err = db.PingContext(ctx)
+		logger.Warn("unable to connect to database, retrying", "attempt", attempt, "retries", cfg.db.connectRetries, "delay", delay, "error", err.Error())
+		time.Sleep(delay)
+		delay *= 2
+	}
 	if err != nil {
 		db.Close()
 		return nil, err
 	}
 
-	db.SetMaxOpenConns(25)
+	db.SetMaxOpenConns(cfg.db.maxOpenConns)
+	db.SetMaxIdleConns(cfg.db.maxIdleConns)
+	db.SetConnMaxIdleTime(cfg.db.maxIdleTime)
 	return db, nil
 }
+
+// dsnSSLMode returns the sslmode a connection with the DSN uses, from the DSN
+// itself, which may be a URL or key=value pairs, or else from PGSSLMODE. Like
+// lib/pq it defaults to require.
+func dsnSSLMode(dsn string) string {
+	var mode string
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		if u, err := url.Parse(dsn); err == nil {
+			mode = u.Query().Get("sslmode")
+		}
+	} else {
+		for _, field := range strings.Fields(dsn) {
+			if key, value, ok := strings.Cut(field, "="); ok && key == "sslmode" {
+				mode = strings.Trim(value, "'")
+			}
+		}
+	}
+
+	if mode == "" {
+		mode = os.Getenv("PGSSLMODE")
+	}
+	if mode == "" {
+		mode = "require"
+	}
+	return mode
+}
+
+// isEncryptedSSLMode reports whether the sslmode insists on encryption; allow
+// and prefer fall back to plaintext.
+func isEncryptedSSLMode(mode string) bool {
+	return mode == "require" || mode == "verify-ca" || mode == "verify-full"
+}
+
+func pingDB(db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return db.PingContext(ctx)
+}
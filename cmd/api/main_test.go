@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidateTrustedOrigins(t *testing.T) {
+	tests := []struct {
+		name    string
+		origins []string
+		valid   bool
+	}{
+		{"none", nil, true},
+		{"origins", []string{"https://example.com", "http://localhost:3000"}, true},
+		{"trailing slash", []string{"https://example.com/"}, false},
+		{"path", []string{"https://example.com", "https://example.com/app"}, false},
+		{"no scheme", []string{"example.com"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestApplication(t).config
+			cfg.cors.trustedOrigins = tt.origins
+
+			err := cfg.validate()
+			invalid := err != nil && strings.Contains(err.Error(), "-cors-trusted-origins")
+			if invalid == tt.valid {
+				t.Errorf("got error %v; want valid %t", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestConfigValidateWebhook(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		secret string
+		valid  bool
+	}{
+		{"disabled", "", "", true},
+		{"signed", "https://example.com/hook", "secret", true},
+		{"no secret", "https://example.com/hook", "", false},
+		{"invalid URL", "example.com/hook", "secret", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestApplication(t).config
+			cfg.webhook.url = tt.url
+			cfg.webhook.secret = tt.secret
+
+			err := cfg.validate()
+			invalid := err != nil && strings.Contains(err.Error(), "-webhook-")
+			if invalid == tt.valid {
+				t.Errorf("got error %v; want valid %t", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestConfigValidateMovieGenres(t *testing.T) {
+	tests := []struct {
+		name      string
+		minGenres int
+		maxGenres int
+		valid     bool
+	}{
+		{"defaults", 1, 5, true},
+		{"exactly one", 1, 1, true},
+		{"more", 2, 10, true},
+		{"no minimum", 0, 5, false},
+		{"max below min", 3, 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestApplication(t).config
+			cfg.movieRules.MinGenres = tt.minGenres
+			cfg.movieRules.MaxGenres = tt.maxGenres
+
+			err := cfg.validate()
+			invalid := err != nil && strings.Contains(err.Error(), "-movie-m")
+			if invalid == tt.valid {
+				t.Errorf("got error %v; want valid %t", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestConfigValidateDBPool(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxOpenConns int
+		maxIdleConns int
+		maxIdleTime  time.Duration
+		valid        bool
+	}{
+		{"defaults", 25, 25, 15 * time.Minute, true},
+		{"small pool", 1, 0, 0, true},
+		{"unlimited open connections", 0, 25, 15 * time.Minute, false},
+		{"negative idle connections", 25, -1, 15 * time.Minute, false},
+		{"negative idle time", 25, 25, -time.Second, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestApplication(t).config
+			cfg.db.maxOpenConns = tt.maxOpenConns
+			cfg.db.maxIdleConns = tt.maxIdleConns
+			cfg.db.maxIdleTime = tt.maxIdleTime
+
+			err := cfg.validate()
+			invalid := err != nil && strings.Contains(err.Error(), "-db-max-")
+			if invalid == tt.valid {
+				t.Errorf("got error %v; want valid %t", err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const (
+	maintenanceOff int32 = iota
+	maintenanceReadOnly
+	maintenanceDown
+)
+
+var maintenanceModes = []string{"off", "read_only", "down"}
+
+func (app *application) maintenanceModeName() string {
+	return maintenanceModes[app.maintenance.Load()]
+}
+
+// listenForMaintenanceSignal cycles the maintenance mode through off,
+// read_only and down each time the process receives SIGUSR1.
+func (app *application) listenForMaintenanceSignal() {
+	toggle := make(chan os.Signal, 1)
+	signal.Notify(toggle, syscall.SIGUSR1)
+
+	go func() {
+		for range toggle {
+			mode := (app.maintenance.Load() + 1) % int32(len(maintenanceModes))
+			app.maintenance.Store(mode)
+			app.logger.Info("maintenance mode changed", "mode", maintenanceModes[mode])
+		}
+	}()
+}
+
+func (app *application) showMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, r, http.StatusOK, envelope{"maintenance_mode": app.maintenanceModeName()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Mode string `json:"mode"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	mode := -1
+	for i, name := range maintenanceModes {
+		if input.Mode == name {
+			mode = i
+		}
+	}
+	if mode < 0 {
+		app.badRequestResponse(w, r, errors.New("mode must be one of off, read_only or down"))
+		return
+	}
+
+	app.maintenance.Store(int32(mode))
+	app.logger.Info("maintenance mode changed", "mode", input.Mode, "user_id", app.contextGetUser(r).ID)
+
+	app.showMaintenanceHandler(w, r)
+}
@@ -1,27 +1,89 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
 	"expvar"
 	"fmt"
+	"io"
+	"maps"
+	"mime"
 	"net/http"
+	"net/netip"
+	"regexp"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/mathiasb/greenlight/internal/data"
+	"github.com/mathiasb/greenlight/internal/i18n"
 	"github.com/mathiasb/greenlight/internal/validator"
-	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
 )
 
+var requestIDRX = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// requestID tags each request with an ID, reusing a well-formed X-Request-ID
+// header from the client or proxy if there is one, and echoes it back in the
+// response.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if !requestIDRX.MatchString(requestID) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			requestID = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-ID", requestID)
+		r = app.contextSetRequestID(r, requestID)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// secureHeaders sets the security headers configured by the -header-* flags.
+// Strict-Transport-Security is only sent on HTTPS requests, as browsers ignore
+// it over plain HTTP.
+func (app *application) secureHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers := app.config.headers
+
+		if headers.contentTypeOptions {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+		}
+		if headers.frameOptions != "" {
+			w.Header().Set("X-Frame-Options", headers.frameOptions)
+		}
+		if headers.referrerPolicy != "" {
+			w.Header().Set("Referrer-Policy", headers.referrerPolicy)
+		}
+		if headers.csp != "" {
+			w.Header().Set("Content-Security-Policy", headers.csp)
+		}
+		if headers.hsts != "" && app.externalScheme(r) == "https" {
+			w.Header().Set("Strict-Transport-Security", headers.hsts)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
+				app.reportPanic(r, err)
+
 				w.Header().Set("Connection", "close")
-				app.serverErrorResponse(w, r, fmt.Errorf("%s", err))
+				message := "the server encountered a problem and could not process your request"
+				app.errorResponse(w, r, http.StatusInternalServerError, message)
 			}
 		}()
 
@@ -29,14 +91,42 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
+// maintenanceMode rejects requests with a 503 while the API is down for
+// maintenance, or only writes while it is read-only; a movie search is a POST
+// but doesn't write. The healthcheck and the maintenance endpoint itself stay
+// available so the mode can be observed and switched back.
+func (app *application) maintenanceMode(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mode := app.maintenance.Load()
+
+		if mode != maintenanceOff &&
+			r.URL.Path != app.apiPath("/healthcheck") &&
+			r.URL.Path != app.apiPath("/admin/maintenance") {
+
+			readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions ||
+				r.URL.Path == app.apiPath("/movies/search")
+			if mode == maintenanceDown || !readOnly {
+				app.maintenanceResponse(w, r)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimit limits each client IP to -limiter-rps requests per second, with
+// bursts of -limiter-burst, or -limiter-warmup-burst for -limiter-warmup after
+// startup. Clients in -limiter-exempt aren't limited.
 func (app *application) rateLimit(next http.Handler) http.Handler {
 	type client struct {
 		limiter  *rate.Limiter
 		lastSeen time.Time
 	}
 	var (
-		mu      = sync.Mutex{}
-		clients = make(map[string]*client)
+		mu          = sync.Mutex{}
+		clients     = make(map[string]*client)
+		warmupUntil = time.Now().Add(app.config.limiter.warmup)
 	)
 	go func() {
 		for {
@@ -51,18 +141,31 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 		}
 	}()
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if app.config.limiter.enabled {
-			ip := realip.FromRequest(r)
+		if ip := app.clientIP(r); app.config.limiter.enabled && !app.isLimiterExempt(ip) {
+
+			rps, burst := app.live.limiter()
+			if time.Now().Before(warmupUntil) {
+				burst = max(burst, app.config.limiter.warmupBurst)
+			}
 
 			mu.Lock()
 			if _, found := clients[ip]; !found {
 				clients[ip] = &client{
 					limiter: rate.NewLimiter(
-						rate.Limit(app.config.limiter.rps),
-						app.config.limiter.burst)}
+						rate.Limit(rps),
+						burst)}
 			}
 			clients[ip].lastSeen = time.Now()
 
+			// Apply any limits changed by a config reload, or by the end of the
+			// warmup, to existing clients.
+			if clients[ip].limiter.Limit() != rate.Limit(rps) {
+				clients[ip].limiter.SetLimit(rate.Limit(rps))
+			}
+			if clients[ip].limiter.Burst() != burst {
+				clients[ip].limiter.SetBurst(burst)
+			}
+
 			if !clients[ip].limiter.Allow() {
 				mu.Unlock()
 				app.rateLimitExceededResponse(w, r)
@@ -74,6 +177,137 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 	})
 }
 
+// isLimiterExempt reports whether the client IP is in -limiter-exempt.
+func (app *application) isLimiterExempt(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && containsAddr(app.config.limiter.exempt, addr)
+}
+
+// timeout gives each request a deadline of -request-timeout, separate from
+// the server's write timeout. The handler runs in its own goroutine, writing
+// to a buffer; if it hasn't finished when the deadline passes, the client
+// gets a 503 straight away and whatever the handler writes afterwards is
+// dropped. Database queries made with the request's context are cancelled at
+// the same time. Streaming responses, which are expected to run for a long
+// time, are exempt.
+func (app *application) timeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.config.requestTimeout <= 0 || app.isLongRunning(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), app.config.requestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutResponseWriter{header: w.Header().Clone()}
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+
+		go func() {
+			defer func() {
+				if err := recover(); err != nil {
+					panicked <- goroutinePanic{value: err, stack: debug.Stack()}
+				}
+			}()
+			next.ServeHTTP(tw, r)
+			close(done)
+		}()
+
+		select {
+		case err := <-panicked:
+			// Re-panic on the request's goroutine for recoverPanic.
+			panic(err)
+		case <-done:
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+
+				tw.timedOut = true
+				app.timeoutResponse(w, r, ctx.Err())
+				return
+			}
+
+			// The client went away before the deadline. The handler sees
+			// that too, and its response is still what gets logged.
+			select {
+			case err := <-panicked:
+				panic(err)
+			case <-done:
+			}
+		}
+
+		tw.mu.Lock()
+		defer tw.mu.Unlock()
+
+		clear(w.Header())
+		maps.Copy(w.Header(), tw.header)
+		if tw.statusCode == 0 {
+			tw.statusCode = http.StatusOK
+		}
+		w.WriteHeader(tw.statusCode)
+		w.Write(tw.body.Bytes())
+	})
+}
+
+// timeoutResponseWriter buffers a response for timeout, which only sends it
+// if the handler finishes in time. Writes after the deadline fail with
+// http.ErrHandlerTimeout.
+type timeoutResponseWriter struct {
+	mu         sync.Mutex
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+	timedOut   bool
+}
+
+func (tw *timeoutResponseWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutResponseWriter) WriteHeader(statusCode int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.statusCode == 0 && !tw.timedOut {
+		tw.statusCode = statusCode
+	}
+}
+
+func (tw *timeoutResponseWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.statusCode == 0 {
+		tw.statusCode = http.StatusOK
+	}
+	return tw.body.Write(b)
+}
+
+// isLongRunning reports whether the request streams a response or body: the
+// movie event stream, an NDJSON export of the movie list or the whole
+// catalogue, an import, a personal data export, or a pprof profile.
+func (app *application) isLongRunning(r *http.Request) bool {
+	switch {
+	case r.URL.Path == app.apiPath("/movies/events"):
+		return true
+	case r.URL.Path == app.apiPath("/admin/export"), r.URL.Path == app.apiPath("/admin/import"):
+		return true
+	case r.URL.Path == app.apiPath("/users/me/export"):
+		return true
+	case strings.HasPrefix(r.URL.Path, app.rootPath("/debug/pprof/")):
+		return true
+	case app.accepts(r, "application/x-ndjson"):
+		return true
+	}
+	return false
+}
+
 /***
 ** User authenticaton and persmissions
 ***/
@@ -83,7 +317,9 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Add("Vary", "Authorization")
 			authorizationHeader := r.Header.Get("Authorization")
-			if authorizationHeader == "" {
+			// The metrics token isn't a user token, so it's left for
+			// protectDebug to check.
+			if authorizationHeader == "" || app.usesMetricsToken(r) {
 				r = app.contextSetUser(r, data.AnonymousUser)
 				next.ServeHTTP(w, r)
 				return
@@ -96,16 +332,25 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			}
 
 			token := headerParts[1]
-			v := validator.New()
-			if data.ValidateTokenPlaintext(v, token); !v.Valid() {
-				app.invalidAuthenticationTokenResponse(w, r)
-				return
-			}
 
-			user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+			var (
+				user *data.User
+				err  error
+			)
+			if app.config.token.mode == tokenModeJWT {
+				user, err = app.userForJWT(token)
+			} else {
+				v := validator.New()
+				if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+					app.invalidAuthenticationTokenResponse(w, r)
+					return
+				}
+
+				user, err = app.models.Users.GetForToken(data.ScopeAuthentication, token)
+			}
 			if err != nil {
 				switch {
-				case errors.Is(err, data.ErrRecordNotFound):
+				case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, errInvalidJWT):
 					app.invalidAuthenticationTokenResponse(w, r)
 				default:
 					app.serverErrorResponse(w, r, err)
@@ -133,12 +378,14 @@ func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.Han
 	)
 }
 
+// requireActivatedUser only lets activated users through, or any
+// authenticated user without -require-activation.
 func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return app.requireAuthenticatedUser(
 		http.HandlerFunc(
 			func(w http.ResponseWriter, r *http.Request) {
 				user := app.contextGetUser(r)
-				if !user.Activated {
+				if !user.Activated && app.config.requireActivation {
 					app.inactiveAccountResponse(w, r)
 					return
 				}
@@ -148,10 +395,26 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	)
 }
 
+// requireUnscopedToken turns away users who authenticated with a scoped
+// token, for routes that manage the account itself rather than act on a
+// permission. It goes inside requireAuthenticatedUser or
+// requireActivatedUser.
+func (app *application) requireUnscopedToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetUser(r).TokenPermissions != nil {
+			app.scopedTokenResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// requirePermission only lets activated users holding the permission code
+// through to next.
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.permissionsFor(user)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -164,9 +427,25 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 
 		next.ServeHTTP(w, r)
 	}
+
+	// With -public-reads everyone holds movies:read, including anonymous users
+	// and users who haven't activated their account.
+	if code == data.PermissionRead && app.config.publicReads {
+		return next
+	}
 	return app.requireActivatedUser(fn)
 }
 
+// permissionsFor returns the permissions the user holds through the token they
+// authenticated with, which for a scoped token are only those in its scope.
+func (app *application) permissionsFor(user *data.User) (data.Permissions, error) {
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return permissions.Scoped(user.TokenPermissions), nil
+}
+
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
@@ -174,23 +453,365 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 			w.Header().Add("Vart", "Access-Control-Request-Method")
 			origin := r.Header.Get("Origin")
 
-			if origin != "" {
-				for _, o := range app.config.cors.trustedOrigins {
-					if origin == o {
-						w.Header().Set("Access-Control-Allow-Origin", origin)
-						// Check for pre-flight reqest
-						if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
-							// Set pre-flight response headers
-							w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-							w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
-							// Write the header and return, stopping the middleware chain
-							// https://stackoverflow.com/questions/46026409/what-are-proper-status-codes-for-cors-preflight-requests/58794243#58794243
-							w.WriteHeader(http.StatusOK)
-							return
-						}
-
-						break
+			if origin != "" && app.live.isTrustedOrigin(origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				// Check for pre-flight reqest
+				if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+					// Set pre-flight response headers
+					w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
+					w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+					if app.config.cors.maxAge > 0 {
+						w.Header().Set("Access-Control-Max-Age", strconv.Itoa(app.config.cors.maxAge))
 					}
+					// Write the header and return, stopping the middleware chain
+					// https://stackoverflow.com/questions/46026409/what-are-proper-status-codes-for-cors-preflight-requests/58794243#58794243
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		},
+	)
+}
+
+/***
+** Idempotency
+***/
+
+// idempotent replays the stored response for mutating requests that repeat
+// an Idempotency-Key header already used by the same user, instead of running
+// the handler again. Reusing a key for a different method, path or body gets a
+// 422. Server errors and panics aren't stored, so those requests can be
+// retried with the same key.
+func (app *application) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Idempotency-Key")
+			user := app.contextGetUser(r)
+
+			switch {
+			case key == "", user.IsAnonymous():
+				next.ServeHTTP(w, r)
+				return
+			case r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch && r.Method != http.MethodDelete:
+				next.ServeHTTP(w, r)
+				return
+			case len(key) > 255:
+				app.badRequestResponse(w, r, errors.New("the Idempotency-Key header must not be more than 255 bytes long"))
+				return
+			}
+
+			// The body is read up to one byte past the limit readJSON
+			// enforces, so that it still rejects bodies that are too large.
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxJSONBytes+1))
+			if err != nil {
+				app.badRequestResponse(w, r, err)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			stored, err := app.models.Idempotency.Reserve(user.ID, key, idempotentRequestHash(r, body), app.config.idempotencyTTL)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrIdempotencyKeyInUse):
+					app.idempotencyKeyInUseResponse(w, r)
+				case errors.Is(err, data.ErrIdempotencyKeyMismatch):
+					app.idempotencyKeyMismatchResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			if stored != nil {
+				for k, v := range stored.Headers {
+					w.Header()[k] = v
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.Status)
+				w.Write(stored.Body)
+				return
+			}
+
+			// If the handler panics, the key is released on the way out to
+			// recoverPanic.
+			completed := false
+			defer func() {
+				if !completed {
+					err := app.models.Idempotency.Release(user.ID, key)
+					if err != nil {
+						app.logError(r, err)
+					}
+				}
+			}()
+
+			rw := newRecordingResponseWriter(w)
+			next.ServeHTTP(rw, r)
+
+			if rw.statusCode < http.StatusInternalServerError {
+				err = app.models.Idempotency.Complete(user.ID, key, &data.IdempotentResponse{
+					Status:  rw.statusCode,
+					Headers: storedIdempotentHeaders(rw.header),
+					Body:    rw.body.Bytes(),
+				})
+				if err != nil {
+					app.logError(r, err)
+				}
+				completed = true
+			}
+		},
+	)
+}
+
+// idempotentRequestHash identifies a request by its method, path and body, so
+// that a reused Idempotency-Key can be told apart from a retry.
+func idempotentRequestHash(r *http.Request, body []byte) []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.Path)
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// storedIdempotentHeaders returns the response headers worth replaying. The
+// request ID belongs to the original request, and a replay has its own.
+func storedIdempotentHeaders(header http.Header) http.Header {
+	header = header.Clone()
+	header.Del("X-Request-ID")
+	return header
+}
+
+// recordingResponseWriter keeps a copy of the status, headers and body that
+// pass through it.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	header     http.Header
+	body       bytes.Buffer
+}
+
+func newRecordingResponseWriter(w http.ResponseWriter) *recordingResponseWriter {
+	return &recordingResponseWriter{
+		ResponseWriter: w,
+		statusCode:     http.StatusOK,
+	}
+}
+
+func (rw *recordingResponseWriter) WriteHeader(statusCode int) {
+	if rw.header == nil {
+		rw.statusCode = statusCode
+		rw.header = rw.ResponseWriter.Header().Clone()
+	}
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rw *recordingResponseWriter) Write(b []byte) (int, error) {
+	if rw.header == nil {
+		rw.WriteHeader(http.StatusOK)
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+/***
+** Conflict retries
+***/
+
+// maxConflictAttempts is the number of times withConflictRetry runs a handler.
+const maxConflictAttempts = 3
+
+type conflictRetry struct {
+	lastAttempt bool
+	conflicted  bool
+}
+
+// withConflictRetry runs next again, up to maxConflictAttempts times in all,
+// while it reports an edit conflict with retryEditConflictResponse. Each
+// attempt reads the request body from a copy held in memory, so the whole
+// body, up to the maxJSONBytes that readJSON accepts, is buffered before the
+// first attempt. Bodies larger than that are rejected up front.
+func (app *application) withConflictRetry(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxJSONBytes))
+			if err != nil {
+				var maxBytesError *http.MaxBytesError
+				if errors.As(err, &maxBytesError) {
+					app.badRequestResponse(w, r, i18n.Errorf("body must not be larger than %d bytes", maxJSONBytes))
+					return
+				}
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			for attempt := 1; ; attempt++ {
+				retry := &conflictRetry{lastAttempt: attempt == maxConflictAttempts}
+				attemptRequest := app.contextSetConflictRetry(r, retry)
+				attemptRequest.Body = io.NopCloser(bytes.NewReader(body))
+
+				next.ServeHTTP(w, attemptRequest)
+				if !retry.conflicted {
+					return
+				}
+			}
+		},
+	)
+}
+
+// retryEditConflictResponse asks withConflictRetry to run the handler again,
+// or sends editConflictResponse if the handler isn't wrapped or this was its
+// last attempt. The handler must not have written anything else already.
+func (app *application) retryEditConflictResponse(w http.ResponseWriter, r *http.Request) {
+	retry := app.contextGetConflictRetry(r)
+	if retry == nil || retry.lastAttempt {
+		app.editConflictResponse(w, r)
+		return
+	}
+	retry.conflicted = true
+}
+
+/***
+** Debug endpoints
+***/
+
+const (
+	metricsAuthPermission = "permission"
+	metricsAuthToken      = "token"
+	metricsAuthNone       = "none"
+)
+
+func (app *application) usesMetricsToken(r *http.Request) bool {
+	return app.config.metrics.auth == metricsAuthToken && strings.HasPrefix(r.URL.Path, app.rootPath("/debug/"))
+}
+
+// protectDebug guards the /debug endpoints, which expose internal details of
+// the running server, according to -metrics-auth and -metrics-localhost-only.
+func (app *application) protectDebug(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if app.config.metrics.localhostOnly {
+			addr, err := netip.ParseAddrPort(r.RemoteAddr)
+			if err != nil || !addr.Addr().IsLoopback() {
+				app.notFoundResponse(w, r)
+				return
+			}
+		}
+
+		switch app.config.metrics.auth {
+		case metricsAuthPermission:
+			app.requirePermission(data.PermissionMetricsRead, next.ServeHTTP)(w, r)
+		case metricsAuthToken:
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found || subtle.ConstantTimeCompare([]byte(token), []byte(app.config.metrics.token)) != 1 {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	}
+}
+
+/***
+** HEAD requests
+***/
+
+// head answers HEAD requests with the GET handler next. The body is counted
+// and discarded, so the response has the same status and headers as the GET
+// response, including Content-Length.
+func (app *application) head(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hw := &headResponseWriter{ResponseWriter: w}
+
+		next(hw, r)
+
+		if hw.statusCode == 0 {
+			hw.statusCode = http.StatusOK
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(hw.length))
+		w.WriteHeader(hw.statusCode)
+	}
+}
+
+// headResponseWriter holds back the status code until the handler is done,
+// since the Content-Length isn't known before then.
+type headResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	length     int
+}
+
+func (hw *headResponseWriter) WriteHeader(statusCode int) {
+	if hw.statusCode == 0 {
+		hw.statusCode = statusCode
+	}
+}
+
+func (hw *headResponseWriter) Write(b []byte) (int, error) {
+	if hw.statusCode == 0 {
+		hw.statusCode = http.StatusOK
+	}
+	hw.length += len(b)
+	return len(b), nil
+}
+
+// Flush is a no-op so that flushing handlers don't send the headers early.
+func (hw *headResponseWriter) Flush() {}
+
+func (hw *headResponseWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+/***
+** API versioning
+***/
+
+var vendorMediaTypeRX = regexp.MustCompile(`^application/vnd\.greenlight\.v(\d+)\+json$`)
+
+const latestAPIVersion = 2
+
+// negotiateVersion selects the API version from a vendor media type in the
+// Accept header, e.g. application/vnd.greenlight.v2+json. The path prefix
+// (/v1) only selects the set of routes; when the Accept header names a version
+// it takes precedence and decides the representation of the response. Without
+// one, version 1 is used. Requests for an unknown version get a 406. The JSON
+// naming is negotiated at the same time, and a ?pretty or X-Pretty value that
+// isn't a boolean gets a 422.
+func (app *application) negotiateVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept")
+
+			for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+				accepted, _, _ = strings.Cut(accepted, ";")
+				matches := vendorMediaTypeRX.FindStringSubmatch(strings.ToLower(strings.TrimSpace(accepted)))
+				if matches == nil {
+					continue
+				}
+
+				version, err := strconv.Atoi(matches[1])
+				if err != nil || version < 1 || version > latestAPIVersion {
+					app.notAcceptableResponse(w, r)
+					return
+				}
+
+				w.Header().Set("Content-Type", fmt.Sprintf("application/vnd.greenlight.v%d+json", version))
+				r = app.contextSetAPIVersion(r, version)
+				break
+			}
+
+			r = app.negotiateNaming(w, r)
+
+			if pretty := prettyValue(r); pretty != "" {
+				if _, err := strconv.ParseBool(pretty); err != nil {
+					v := validator.New()
+					v.AddError("pretty", validator.CodeInvalidFormat, "must be a boolean value")
+					app.failedValidationResponse(w, r, v)
+					return
 				}
 			}
 
@@ -199,6 +820,87 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 	)
 }
 
+/***
+** Content negotiation
+***/
+
+// negotiateContentType answers a 406 when the Accept header rules out every
+// media type the route can respond with. Every route can respond with JSON,
+// and so also with a +json type; a few can send other types as well. With
+// -strict-accept=false any Accept header is let through, and gets JSON.
+func (app *application) negotiateContentType(next http.Handler) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if app.config.strictAccept && !acceptsAny(r.Header.Get("Accept"), app.offeredMediaTypes(r)) {
+				app.notAcceptableResponse(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		},
+	)
+}
+
+// offeredMediaTypes returns the media types the request's route can respond
+// with, or nil for routes outside the API that aren't negotiated.
+func (app *application) offeredMediaTypes(r *http.Request) []string {
+	offers := []string{"application/json"}
+
+	switch path := r.URL.Path; {
+	case strings.HasPrefix(path, app.rootPath("/debug/")):
+		return nil
+	case path == app.apiPath("/movies"), strings.HasPrefix(path, app.apiPath("/genres/")):
+		offers = append(offers, "application/x-ndjson", "application/xml")
+	case path == app.apiPath("/movies/search"):
+		offers = append(offers, "application/x-ndjson")
+	case path == app.apiPath("/movies/events"):
+		offers = append(offers, "text/event-stream")
+	case path == app.apiPath("/movies/trending"), path == app.apiPath("/movies/count"):
+		// JSON only, unlike the movie that the pattern below would take it for.
+	case strings.HasPrefix(path, app.apiPath("/movies/")) && !strings.Contains(strings.TrimPrefix(path, app.apiPath("/movies/")), "/"):
+		offers = append(offers, "application/xml")
+	case path == app.apiPath("/admin/export"):
+		offers = append(offers, "application/gzip")
+	case path == app.apiPath("/docs"):
+		offers = append(offers, "text/html")
+	}
+	return offers
+}
+
+// acceptsAny reports whether an Accept header allows any of the offered media
+// types, honouring wildcards and q=0. A missing header, or nil offers, allows
+// anything.
+func acceptsAny(header string, offers []string) bool {
+	if strings.TrimSpace(header) == "" || offers == nil {
+		return true
+	}
+
+	for _, accepted := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q <= 0 {
+			continue
+		}
+
+		if mediaType == "*/*" {
+			return true
+		}
+
+		prefix, isWildcard := strings.CutSuffix(mediaType, "*")
+		for _, offer := range offers {
+			switch {
+			case mediaType == offer, isWildcard && strings.HasPrefix(offer, prefix):
+				return true
+			case offer == "application/json" && strings.HasSuffix(mediaType, "+json"):
+				return true
+			}
+		}
+	}
+	return false
+}
+
 /***
 ** Metrics
 ***/
@@ -207,28 +909,43 @@ type metricsResponseWriter struct {
 	http.ResponseWriter // embed the ResponseWriter with its methods
 	statusCode          int
 	headerWritten       bool
+	start               time.Time
+	timeHeader          bool // set X-Response-Time-Ms when the header is written
 }
 
-func newMetricsResponseWriter(w http.ResponseWriter) *metricsResponseWriter {
+func newMetricsResponseWriter(w http.ResponseWriter, start time.Time, timeHeader bool) *metricsResponseWriter {
 	return &metricsResponseWriter{
 		ResponseWriter: w,
 		statusCode:     http.StatusOK,
+		start:          start,
+		timeHeader:     timeHeader,
 	}
 }
 
 func (mw *metricsResponseWriter) WriteHeader(statusCode int) {
 	mw.statusCode = statusCode
+	mw.headerWritten = true
+	mw.setTimeHeader()
 	mw.ResponseWriter.WriteHeader(statusCode)
 }
 
 func (mw *metricsResponseWriter) Write(b []byte) (int, error) {
 	if !mw.headerWritten {
 		mw.headerWritten = true
+		mw.setTimeHeader()
 		mw.ResponseWriter.WriteHeader(http.StatusOK)
 	}
 	return mw.ResponseWriter.Write(b)
 }
 
+// setTimeHeader sets X-Response-Time-Ms to the time taken until the response
+// header is written, as it can't be changed afterwards.
+func (mw *metricsResponseWriter) setTimeHeader() {
+	if mw.timeHeader {
+		mw.Header().Set("X-Response-Time-Ms", strconv.FormatInt(time.Since(mw.start).Milliseconds(), 10))
+	}
+}
+
 func (mw *metricsResponseWriter) Unwrap() http.ResponseWriter {
 	return mw.ResponseWriter
 }
@@ -244,7 +961,7 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
 			totalRequestsReceived.Add(1)
-			mw := newMetricsResponseWriter(w)
+			mw := newMetricsResponseWriter(w, start, app.config.responseTimeHeader)
 
 			next.ServeHTTP(mw, r)
 			totalResponsesSent.Add(1)
@@ -253,8 +970,139 @@ func (app *application) metrics(next http.Handler) http.Handler {
 				1,
 			)
 
-			duration := time.Since(start).Microseconds()
-			totalProcessingTimeMicros.Add(duration)
+			duration := time.Since(start)
+			totalProcessingTimeMicros.Add(duration.Microseconds())
+
+			if threshold := app.config.slowResponse; threshold > 0 && duration >= threshold {
+				app.logger.Warn("slow response", "method", r.Method, "uri", r.URL.RequestURI(), "request_id", app.contextGetRequestID(r), "status", mw.statusCode, "duration", duration)
+			}
 		},
 	)
 }
+
+// bodyLogWriter passes a response through while keeping a copy of up to max
+// bytes of its body for logBodies.
+type bodyLogWriter struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+	max        int
+	truncated  bool
+}
+
+func (bw *bodyLogWriter) WriteHeader(statusCode int) {
+	bw.statusCode = statusCode
+	bw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (bw *bodyLogWriter) Write(b []byte) (int, error) {
+	bw.body.Write(capBytes(b, bw.max-bw.body.Len(), &bw.truncated))
+	return bw.ResponseWriter.Write(b)
+}
+
+func (bw *bodyLogWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
+
+// bodyLogReader tees a request body into a buffer of up to max bytes as the
+// handler reads it.
+type bodyLogReader struct {
+	io.ReadCloser
+	body      bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (br *bodyLogReader) Read(p []byte) (int, error) {
+	n, err := br.ReadCloser.Read(p)
+	br.body.Write(capBytes(p[:n], br.max-br.body.Len(), &br.truncated))
+	return n, err
+}
+
+// capBytes returns at most room bytes of b, setting *truncated if any were
+// dropped.
+func capBytes(b []byte, room int, truncated *bool) []byte {
+	if room < 0 {
+		room = 0
+	}
+	if len(b) > room {
+		*truncated = true
+		return b[:room]
+	}
+	return b
+}
+
+// redactionRegexp matches the values of the given JSON keys, in both their
+// snake_case and camelCase forms. A string value cut off by the size cap is
+// still matched.
+func redactionRegexp(keys []string) *regexp.Regexp {
+	var names []string
+	for _, key := range keys {
+		names = append(names, regexp.QuoteMeta(key))
+		if camel := snakeToCamel(key); camel != key {
+			names = append(names, regexp.QuoteMeta(camel))
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return regexp.MustCompile(`(?i)("(?:` + strings.Join(names, "|") + `)"\s*:\s*)(?:"(?:[^"\\]|\\.)*"?|[^,}\]\s]+)`)
+}
+
+// secretValueRegexp matches a JSON string holding a secret= parameter, such as
+// an otpauth:// URI, which logBodies redacts whatever its key.
+var secretValueRegexp = regexp.MustCompile(`(?i)"(?:[^"\\]|\\.)*secret=(?:[^"\\]|\\.)*"?`)
+
+// logBodies logs the request and response bodies of routes under the
+// -log-bodies path prefixes, for debugging. The request body is copied as the
+// handler reads it, so the handler still sees all of it. Values of the
+// -log-bodies-redact keys, and strings with a secret= parameter, are replaced
+// before logging.
+func (app *application) logBodies(next http.Handler) http.Handler {
+	cfg := app.config.logBodies
+	if len(cfg.routes) == 0 {
+		return next
+	}
+
+	redact := redactionRegexp(strings.Fields(cfg.redact))
+	clean := func(b []byte) string {
+		if redact != nil {
+			b = redact.ReplaceAll(b, []byte(`${1}"[REDACTED]"`))
+		}
+		b = secretValueRegexp.ReplaceAll(b, []byte(`"[REDACTED]"`))
+		return string(b)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logged := false
+		for _, prefix := range cfg.routes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				logged = true
+				break
+			}
+		}
+		if !logged {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		br := &bodyLogReader{ReadCloser: r.Body, max: cfg.maxSize}
+		r.Body = br
+		bw := &bodyLogWriter{ResponseWriter: w, statusCode: http.StatusOK, max: cfg.maxSize}
+
+		defer func() {
+			app.logger.Info("request body log",
+				"method", r.Method,
+				"uri", r.URL.RequestURI(),
+				"request_id", app.contextGetRequestID(r),
+				"status", bw.statusCode,
+				"request_body", clean(br.body.Bytes()),
+				"request_body_truncated", br.truncated,
+				"response_body", clean(bw.body.Bytes()),
+				"response_body_truncated", bw.truncated,
+			)
+		}()
+
+		next.ServeHTTP(bw, r)
+	})
+}
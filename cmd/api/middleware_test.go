@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mathiasb/greenlight/internal/data"
+)
+
+func TestIdempotentRequestHash(t *testing.T) {
+	base := idempotentRequestHash(httptest.NewRequest(http.MethodPost, "/v1/movies", nil), []byte(`{"title":"Moana"}`))
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		same   bool
+	}{
+		{"retry", http.MethodPost, "/v1/movies", `{"title":"Moana"}`, true},
+		{"query string ignored", http.MethodPost, "/v1/movies?allow_duplicate=true", `{"title":"Moana"}`, true},
+		{"different body", http.MethodPost, "/v1/movies", `{"title":"Moana 2"}`, false},
+		{"different path", http.MethodPost, "/v1/movies/1", `{"title":"Moana"}`, false},
+		{"different method", http.MethodPut, "/v1/movies", `{"title":"Moana"}`, false},
+		{"no body", http.MethodPost, "/v1/movies", ``, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := idempotentRequestHash(httptest.NewRequest(tt.method, tt.target, nil), []byte(tt.body))
+			if bytes.Equal(got, base) != tt.same {
+				t.Errorf("got same hash %t; want %t", !tt.same, tt.same)
+			}
+		})
+	}
+}
+
+func TestStoredIdempotentHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("Location", "/v1/movies/1")
+	header.Set("X-Request-ID", "original")
+
+	stored := storedIdempotentHeaders(header)
+
+	if stored.Get("X-Request-ID") != "" {
+		t.Error("want the request ID left out")
+	}
+	if stored.Get("Location") != "/v1/movies/1" || stored.Get("Content-Type") != "application/json" {
+		t.Errorf("want the other headers kept; got %v", stored)
+	}
+	if header.Get("X-Request-ID") != "original" {
+		t.Error("want the response's own headers unchanged")
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	var logs bytes.Buffer
+
+	app := newTestApplication(t)
+	app.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+
+	var hooked any
+	app.panicHook = func(value any, stack []byte, r *http.Request) {
+		hooked = value
+	}
+
+	handler := app.recoverPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil))
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d; want %d", rr.Code, http.StatusInternalServerError)
+	}
+	if rr.Header().Get("Connection") != "close" {
+		t.Error("want the connection closed")
+	}
+	if strings.Contains(rr.Body.String(), "boom") {
+		t.Errorf("the panic value leaked into the response: %s", rr.Body)
+	}
+	if hooked != "boom" {
+		t.Errorf("panic hook got %v; want %q", hooked, "boom")
+	}
+
+	var entry struct {
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+		Panic string `json:"panic"`
+		Stack string `json:"stack"`
+		Path  string `json:"path"`
+	}
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("unable to parse log %q: %v", logs.String(), err)
+	}
+	if entry.Level != "ERROR" || entry.Panic != "boom" || entry.Path != "/v1/movies/1" {
+		t.Errorf("got log entry %+v", entry)
+	}
+	// The stack starts from the deferred recover, so it shows the handler
+	// that panicked.
+	if !strings.Contains(entry.Stack, "TestRecoverPanic") {
+		t.Errorf("stack doesn't show the panicking handler:\n%s", entry.Stack)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.requestTimeout = 20 * time.Millisecond
+
+	release := make(chan struct{})
+	lateWrite := make(chan error, 1)
+
+	handler := app.timeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		_, err := w.Write([]byte("too late"))
+		lateWrite <- err
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil))
+
+	// The 503 is written while the handler is still blocked.
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d; want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if want := "the server took too long to process your request, please try again later"; body.Error != want {
+		t.Errorf("got error %q; want %q", body.Error, want)
+	}
+
+	close(release)
+	if err := <-lateWrite; !errors.Is(err, http.ErrHandlerTimeout) {
+		t.Errorf("got late write error %v; want http.ErrHandlerTimeout", err)
+	}
+	if strings.Contains(rr.Body.String(), "too late") {
+		t.Error("the handler's late write reached the client")
+	}
+}
+
+func TestTimeoutInTime(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.requestTimeout = time.Second
+
+	handler := app.timeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+		w.Header().Set("Location", "/v1/movies/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"movie":{}}`))
+	}))
+
+	rr := httptest.NewRecorder()
+	rr.Header().Set("Vary", "Origin")
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/movies", nil))
+
+	if rr.Code != http.StatusCreated {
+		t.Errorf("got status %d; want %d", rr.Code, http.StatusCreated)
+	}
+	if got := rr.Header().Values("Vary"); strings.Join(got, ", ") != "Origin, Authorization" {
+		t.Errorf("got Vary %q; want both the middleware's and the handler's", got)
+	}
+	if got := rr.Header().Get("Location"); got != "/v1/movies/1" {
+		t.Errorf("got Location %q; want %q", got, "/v1/movies/1")
+	}
+	if got := rr.Body.String(); got != `{"movie":{}}` {
+		t.Errorf("got body %q", got)
+	}
+}
+
+func TestTimeoutPanic(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.requestTimeout = time.Second
+
+	var stack []byte
+	app.panicHook = func(value any, s []byte, r *http.Request) {
+		stack = s
+	}
+
+	handler := app.recoverPanic(app.timeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil))
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d; want %d", rr.Code, http.StatusInternalServerError)
+	}
+	// The handler ran on its own goroutine, but the stack is from there.
+	if !strings.Contains(string(stack), "TestTimeoutPanic") {
+		t.Errorf("stack doesn't show the panicking handler:\n%s", stack)
+	}
+}
+
+func TestRateLimitExempt(t *testing.T) {
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		wantLimited  bool
+	}{
+		{"exempt address", "10.1.2.3:1234", "", false},
+		{"exempt single address", "192.0.2.7:1234", "", false},
+		{"other address", "203.0.113.9:1234", "", true},
+		// Behind a trusted proxy the forwarded client IP is what's checked.
+		{"exempt client behind proxy", "172.16.0.1:1234", "10.9.9.9", false},
+		{"other client behind proxy", "172.16.0.1:1234", "203.0.113.9", true},
+		// An untrusted client can't claim an exempt address.
+		{"spoofed forwarded address", "203.0.113.9:1234", "10.1.2.3", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.limiter.enabled = true
+			app.config.limiter.rps = 1
+			app.config.limiter.burst = 1
+			app.config.limiter.warmup = 0
+			app.config.limiter.exempt, _ = parsePrefixes("10.0.0.0/8 192.0.2.7")
+			app.config.trustedProxies, _ = parsePrefixes("172.16.0.0/12")
+			app.live.set(app.config)
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			handler := app.rateLimit(next)
+
+			limited := false
+			for range 3 {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.RemoteAddr = tt.remoteAddr
+				if tt.forwardedFor != "" {
+					r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+				}
+
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, r)
+				if rr.Code == http.StatusTooManyRequests {
+					limited = true
+				}
+			}
+
+			if limited != tt.wantLimited {
+				t.Errorf("got limited %t; want %t", limited, tt.wantLimited)
+			}
+		})
+	}
+}
+
+func TestLogBodiesRedaction(t *testing.T) {
+	tests := []struct {
+		name         string
+		requestBody  string
+		responseBody string
+		wantRequest  string
+		wantResponse string
+	}{
+		{
+			"redacted keys",
+			`{"email":"alice@example.com","password":"pa55word"}`,
+			`{"authentication_token":{"token":"ABCDEFGHIJKLMNOPQRSTUVWXYZ","expiry":"2024-01-01T00:00:00Z"}}`,
+			`{"email":"alice@example.com","password":"[REDACTED]"}`,
+			`{"authentication_token":{"token":"[REDACTED]","expiry":"2024-01-01T00:00:00Z"}}`,
+		},
+		{
+			"camelCase keys",
+			`{"totpCode":"123456"}`,
+			`{}`,
+			`{"totpCode":"[REDACTED]"}`,
+			`{}`,
+		},
+		{
+			"non-string values",
+			`{"password":12345678,"name":"Alice"}`,
+			`{}`,
+			`{"password":"[REDACTED]","name":"Alice"}`,
+			`{}`,
+		},
+		{
+			"otpauth URI",
+			`{}`,
+			`{"otpauth_uri":"otpauth://totp/Greenlight:alice@example.com?algorithm=SHA1&issuer=Greenlight&secret=JBSWY3DPEHPK3PXP"}`,
+			`{}`,
+			`{"otpauth_uri":"[REDACTED]"}`,
+		},
+		{
+			"secret parameter under another key",
+			`{"note":"see otpauth://totp/x?secret=JBSWY3DPEHPK3PXP"}`,
+			`{"message":"ok"}`,
+			`{"note":"[REDACTED]"}`,
+			`{"message":"ok"}`,
+		},
+		{
+			"escaped quote before the secret",
+			`{"note":"say \"hi\" secret=JBSWY3DP","name":"Alice"}`,
+			`{}`,
+			`{"note":"[REDACTED]","name":"Alice"}`,
+			`{}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+
+			app := newTestApplication(t)
+			app.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+			app.config.logBodies.routes = []string{"/v1/"}
+			app.config.logBodies.maxSize = 4096
+			// -log-bodies-redact is left at its default.
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// The handler still gets the whole, unredacted body.
+				body := new(bytes.Buffer)
+				body.ReadFrom(r.Body)
+				if body.String() != tt.requestBody {
+					t.Errorf("handler got body %s; want %s", body, tt.requestBody)
+				}
+				w.Write([]byte(tt.responseBody))
+			})
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/tokens/authentication", strings.NewReader(tt.requestBody))
+			app.logBodies(next).ServeHTTP(httptest.NewRecorder(), r)
+
+			var entry struct {
+				RequestBody  string `json:"request_body"`
+				ResponseBody string `json:"response_body"`
+			}
+			if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+				t.Fatal(err)
+			}
+			if entry.RequestBody != tt.wantRequest {
+				t.Errorf("got request body %s; want %s", entry.RequestBody, tt.wantRequest)
+			}
+			if entry.ResponseBody != tt.wantResponse {
+				t.Errorf("got response body %s; want %s", entry.ResponseBody, tt.wantResponse)
+			}
+		})
+	}
+}
+
+func TestRequireUnscopedToken(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions data.Permissions
+		wantStatus  int
+	}{
+		{"full token", nil, http.StatusOK},
+		{"scoped token", data.Permissions{data.PermissionRead}, http.StatusForbidden},
+		{"scoped token with every permission", data.AllPermissions, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/users/me", nil)
+			r = app.contextSetUser(r, &data.User{ID: 1, Activated: true, TokenPermissions: tt.permissions})
+
+			rr := httptest.NewRecorder()
+			app.requireAuthenticatedUser(app.requireUnscopedToken(next)).ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("got status %d; want %d", rr.Code, tt.wantStatus)
+			}
+		})
+	}
+}
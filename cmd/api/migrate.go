@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/mathiasb/greenlight/migrations"
+)
+
+const (
+	migrateUp      = "up"
+	migrateDown    = "down"
+	migrateVersion = "version"
+)
+
+// migrateLogger passes golang-migrate's messages, one per applied migration,
+// on to the application's logger.
+type migrateLogger struct {
+	logger *slog.Logger
+}
+
+func (l migrateLogger) Printf(format string, v ...any) {
+	l.logger.Info("migration applied", "migration", fmt.Sprintf(format, v...))
+}
+
+func (l migrateLogger) Verbose() bool {
+	return false
+}
+
+// runMigrations applies the embedded migrations. "up" applies all pending
+// migrations, "down" rolls back the newest one, and "version" only logs the
+// current version. It uses its own connection, as golang-migrate closes the
+// database when it's done.
+func runMigrations(dsn, mode string, logger *slog.Logger) error {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+
+	driver, err := postgres.WithInstance(db, &postgres.Config{})
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	source, err := iofs.New(migrations.FS, ".")
+	if err != nil {
+		driver.Close()
+		return err
+	}
+
+	m, err := migrate.NewWithInstance("iofs", source, "postgres", driver)
+	if err != nil {
+		driver.Close()
+		return err
+	}
+	defer m.Close()
+
+	m.Log = migrateLogger{logger: logger}
+
+	switch mode {
+	case migrateUp:
+		err = m.Up()
+	case migrateDown:
+		err = m.Steps(-1)
+	}
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+
+	version, dirty, err := m.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return err
+	}
+
+	logger.Info("database schema", "version", version, "dirty", dirty, "latest", migrations.Latest())
+	return nil
+}
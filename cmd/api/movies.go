@@ -1,21 +1,97 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
 	"net/http"
+	"slices"
 	"strconv"
+	"time"
 
+	"github.com/julienschmidt/httprouter"
 	"github.com/mathiasb/greenlight/internal/data"
 	"github.com/mathiasb/greenlight/internal/validator"
 )
 
+// movieV2 is the version 2 representation of a movie, which adds the
+// timestamps.
+type movieV2 struct {
+	*data.Movie
+	CreatedAt time.Time `json:"created_at" xml:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" xml:"updated_at"`
+}
+
+const (
+	movieIDsInt  = "int"
+	movieIDsUUID = "uuid"
+)
+
+// uuidMovie and uuidMovieV2 replace the integer ID with the movie's UUID when
+// -movie-ids=uuid.
+type uuidMovie struct {
+	*data.Movie
+	ID string `json:"id" xml:"id"`
+}
+
+type uuidMovieV2 struct {
+	movieV2
+	ID string `json:"id" xml:"id"`
+}
+
+// movieResponse returns the representation of the movie for the API version
+// negotiated for the request.
+func (app *application) movieResponse(r *http.Request, movie *data.Movie) any {
+	v2 := app.contextGetAPIVersion(r) >= 2
+	uuids := app.config.movieIDs == movieIDsUUID
+
+	switch {
+	case v2 && uuids:
+		return uuidMovieV2{movieV2: movieV2{Movie: movie, CreatedAt: movie.CreatedAt, UpdatedAt: movie.UpdatedAt}, ID: movie.UUID}
+	case v2:
+		return movieV2{Movie: movie, CreatedAt: movie.CreatedAt, UpdatedAt: movie.UpdatedAt}
+	case uuids:
+		return uuidMovie{Movie: movie, ID: movie.UUID}
+	}
+	return movie
+}
+
+func (app *application) moviesResponse(r *http.Request, movies []*data.Movie) any {
+	if app.contextGetAPIVersion(r) >= 2 || app.config.movieIDs == movieIDsUUID {
+		response := make([]any, len(movies))
+		for i, movie := range movies {
+			response[i] = app.movieResponse(r, movie)
+		}
+		return response
+	}
+	return movies
+}
+
+const duplicateMovieMessage = "a movie with this title and year already exists; use ?allow_duplicate=true if this is a different movie"
+
+// addDuplicateMovieError adds the field error for a movie the database
+// rejected as a duplicate of another, reporting whether err was one.
+func addDuplicateMovieError(v *validator.Validator, err error) bool {
+	switch {
+	case errors.Is(err, data.ErrDuplicateMovie):
+		v.AddError("title", validator.CodeAlreadyExists, duplicateMovieMessage)
+	case errors.Is(err, data.ErrDuplicateIMDbID):
+		v.AddError("imdb_id", validator.CodeAlreadyExists, "a movie with this IMDb ID already exists")
+	default:
+		return false
+	}
+	return true
+}
+
 func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Title   string       `json:"title"`
 		Year    int32        `json:"year"`
 		Runtime data.Runtime `json:"runtime"`
 		Genres  []string     `json:"genres"`
+		Summary *string      `json:"summary"`
+		IMDbID  *string      `json:"imdb_id"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -25,28 +101,42 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	v := validator.New()
+	createdBy := app.contextGetUser(r).ID
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:            input.Title,
+		Year:             input.Year,
+		Runtime:          input.Runtime,
+		Genres:           input.Genres,
+		Summary:          input.Summary,
+		IMDbID:           input.IMDbID,
+		DuplicateAllowed: app.readBool(r.URL.Query(), "allow_duplicate", false, v),
+		CreatedBy:        &createdBy,
 	}
 
-	if data.ValidateMovie(v, movie); !v.Valid() {
-		app.failedValidationResponse(w, r, v.FieldErrors)
+	if data.ValidateMovie(v, movie, app.models.Clock.Now(), app.config.movieRules); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
 	err = app.models.Movies.Insert(movie)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		if addDuplicateMovieError(v, err) {
+			app.failedValidationResponse(w, r, v)
+		} else {
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
+	app.publishMovieEvent(movieCreated, movie)
+	app.audit(r, movieCreated, fmt.Sprintf("movie:%s", app.movieIDParam(movie)))
+
+	self := app.movieURL(r, movie)
+
 	headers := make(http.Header)
-	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+	headers.Set("Location", self)
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"movie": movie}, headers)
+	err = app.writeJSON(w, r, http.StatusCreated, envelope{"movie": app.movieResponse(r, movie), "links": map[string]string{"self": self}}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -55,14 +145,103 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidIDParam), errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	movie, found := app.movieCache.get(id)
+	if !found {
+		generation := app.movieCache.generation()
+
+		movie, err = app.models.Movies.Get(id)
+		if err != nil {
+			switch err {
+			case data.ErrRecordNotFound:
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		app.movieCache.add(movie, generation)
+	}
+
+	if r.Method == http.MethodGet {
+		app.views.add(movie.ID)
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", app.movieETag(r, movie))
+
+	if app.accepts(r, "application/xml") {
+		err = app.writeCacheableXML(w, r, app.config.cacheControl.show, "movie", app.movieResponse(r, movie), headers)
+	} else {
+		err = app.writeCacheableJSON(w, r, app.config.cacheControl.show, envelope{"movie": app.movieResponse(r, movie)}, headers)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showMovieByIMDbIDHandler looks a movie up by its IMDb ID, for matching
+// movies against external catalogues.
+func (app *application) showMovieByIMDbIDHandler(w http.ResponseWriter, r *http.Request) {
+	imdbID := httprouter.ParamsFromContext(r.Context()).ByName("item")
+	if !data.ValidIMDbID(imdbID) {
 		app.notFoundResponse(w, r)
 		return
 	}
 
+	movie, err := app.models.Movies.GetByIMDbID(r.Context(), imdbID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"movie": app.movieResponse(r, movie)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listRelatedMoviesHandler lists the movies that share the most genres with
+// the one in the path.
+func (app *application) listRelatedMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidIDParam), errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+	limit := app.readInt(r.URL.Query(), "limit", 10, v)
+	v.Check(limit >= 1 && limit <= 100, "limit", validator.CodeOutOfRange, "must be between 1 and 100")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
 	movie, err := app.models.Movies.Get(id)
 	if err != nil {
-		switch err {
-		case data.ErrRecordNotFound:
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -70,49 +249,503 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	movies, err := app.models.Movies.GetRelated(r.Context(), movie, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeCacheableJSON(w, r, app.config.cacheControl.list, envelope{"movies": app.moviesResponse(r, movies)}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		Title  string
-		Genres []string
-		data.Filters
+	app.listMovies(w, r, app.readCSV(r.URL.Query(), "genres", []string{}))
+}
+
+// listMoviesByGenreHandler lists the movies in the genre given in the path.
+// httprouter matches against the decoded path, so the genre parameter is
+// already URL-unescaped.
+func (app *application) listMoviesByGenreHandler(w http.ResponseWriter, r *http.Request) {
+	genre := httprouter.ParamsFromContext(r.Context()).ByName("genre")
+
+	v := validator.New()
+	v.Check(validator.NotBlank(genre), "genre", validator.CodeRequired, "must be provided")
+	v.Check(validator.MaxRunes(genre, 100), "genre", validator.CodeTooLong, "must not be more than 100 characters long")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	app.listMovies(w, r, []string{genre})
+}
+
+// countMoviesHandler returns the number of movies matching the title, genres,
+// mine and as_of filters of listMoviesHandler, which is cheaper than fetching a
+// page for its metadata.
+func (app *application) countMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	title := app.readString(qs, "title", "")
+	genres := app.readCSV(qs, "genres", []string{})
+	maxYear := app.asOfYear(qs.Get("as_of"), v)
+	mine := app.readBool(qs, "mine", false, v)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	createdBy, ok := app.movieCreatorFilter(w, r, mine)
+	if !ok {
+		return
+	}
+
+	count, err := app.models.Movies.Count(r.Context(), title, genres, createdBy, maxYear)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"count": count}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// movieSortSafeList is the sort values accepted by the movie list and search.
+var movieSortSafeList = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+
+// movieListInput is the filters of a movie list, read from the query string
+// by listMovies or from the body by searchMoviesHandler.
+type movieListInput struct {
+	Title     string
+	Genres    []string
+	CreatedBy int64 // 0 for movies by anyone
+	MaxYear   int32 // 0 for movies from any year
+	data.Filters
+}
+
+// movieCreatorFilter returns the creator a movie list is limited to: the
+// caller if mine is set, or 0 for anyone. Anonymous callers have no movies of
+// their own, so asking for them gets a 401 and ok is false.
+func (app *application) movieCreatorFilter(w http.ResponseWriter, r *http.Request, mine bool) (createdBy int64, ok bool) {
+	if !mine {
+		return 0, true
 	}
 
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		app.authenticationRequiredResponse(w, r)
+		return 0, false
+	}
+	return user.ID, true
+}
+
+// listMovies writes the page of movies that have all of the given genres,
+// reading the title, mine and as_of filters, pagination and sort order from
+// the query string.
+func (app *application) listMovies(w http.ResponseWriter, r *http.Request, genres []string) {
+	var (
+		input movieListInput
+		ok    bool
+	)
+
 	v := validator.New()
 	qs := r.URL.Query()
 	input.Title = app.readString(qs, "title", "")
-	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.Genres = genres
+	input.MaxYear = app.asOfYear(qs.Get("as_of"), v)
+
+	input.CreatedBy, ok = app.movieCreatorFilter(w, r, app.readBool(qs, "mine", false, v))
+	if !ok {
+		return
+	}
+
 	input.Page = app.readInt(qs, "page", 1, v)
 	input.PageSize = app.readInt(qs, "page_size", 20, v)
-	input.Sort = app.readString(qs, "sort", "id")
-	input.SortSafeList = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	input.Sort = app.readString(qs, "sort", app.config.defaultMovieSort)
+	input.SortSafeList = movieSortSafeList
+
+	if app.readBool(qs, "explain", false, v) {
+		app.explainMovieList(w, r, input, v)
+		return
+	}
+
+	app.writeMovieList(w, r, input, v)
+}
+
+// explainMovieList writes the query plan for a movie list instead of the
+// movies, for debugging slow filters. It needs the admin:debug permission, and
+// -allow-explain in production, as the query is run to time it.
+func (app *application) explainMovieList(w http.ResponseWriter, r *http.Request, input movieListInput, v *validator.Validator) {
+	if app.config.env == "production" && !app.config.allowExplain {
+		v.AddError("explain", validator.CodeNotPermitted, "is disabled on this server")
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		app.authenticationRequiredResponse(w, r)
+		return
+	}
+
+	permissions, err := app.permissionsFor(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !permissions.Include(data.PermissionAdminDebug) {
+		app.notPermittedResponse(w, r)
+		return
+	}
 
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
-		app.failedValidationResponse(w, r, v.FieldErrors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	plan, err := app.models.Movies.ExplainGetAll(r.Context(), input.Title, input.Genres, input.CreatedBy, input.MaxYear, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"metadata": metadata, "movies": movies}, nil)
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"plan": plan}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+// searchMoviesHandler is listMoviesHandler with the filters in a JSON body,
+// for filter sets too long for a URL.
+func (app *application) searchMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	input := struct {
+		Title    string   `json:"title"`
+		Genres   []string `json:"genres"`
+		Mine     bool     `json:"mine"`
+		AsOf     string   `json:"as_of"`
+		Page     int      `json:"page"`
+		PageSize int      `json:"page_size"`
+		Sort     string   `json:"sort"`
+	}{
+		Genres:   []string{},
+		Page:     1,
+		PageSize: 20,
+		Sort:     app.config.defaultMovieSort,
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Genres == nil {
+		input.Genres = []string{}
+	}
+
+	createdBy, ok := app.movieCreatorFilter(w, r, input.Mine)
+	if !ok {
+		return
+	}
+
+	v := validator.New()
+	app.writeMovieList(w, r, movieListInput{
+		Title:     input.Title,
+		Genres:    input.Genres,
+		CreatedBy: createdBy,
+		MaxYear:   app.asOfYear(input.AsOf, v),
+		Filters: data.Filters{
+			Page:         input.Page,
+			PageSize:     input.PageSize,
+			Sort:         input.Sort,
+			SortSafeList: movieSortSafeList,
+		},
+	}, v)
+}
+
+// writeMovieList validates the filters, adding to any errors already in v,
+// and writes the matching page of movies, or every match as NDJSON if the
+// client accepts it. Only GET responses get pagination links and an ETag, as
+// the other pages of a search can't be linked to.
+//
+// GET responses also get a Last-Modified of the latest updated_at among all
+// the matching movies, or of the last deletion of any movie if that's later,
+// and a request whose If-Modified-Since is no earlier gets 304 Not Modified
+// without the page being fetched.
+func (app *application) writeMovieList(w http.ResponseWriter, r *http.Request, input movieListInput, v *validator.Validator) {
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	// A list of the caller's own movies mustn't be kept by shared caches.
+	cacheControl := app.config.cacheControl.list
+	if input.CreatedBy != 0 {
+		cacheControl = "no-store"
+	}
+
+	if app.accepts(r, "application/x-ndjson") {
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		app.streamMovies(w, r, input)
+		return
+	}
+
+	if r.Context().Err() != nil {
+		app.clientGoneResponse(w, r, r.Context().Err())
+		return
+	}
+
+	var headers http.Header
+	if r.Method != http.MethodPost {
+		lastModified, err := app.models.Movies.LastModified(r.Context(), input.Title, input.Genres, input.CreatedBy, input.MaxYear)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !lastModified.IsZero() {
+			headers = http.Header{"Last-Modified": {lastModified.UTC().Format(http.TimeFormat)}}
+
+			if notModifiedSince(r, lastModified) {
+				if cacheControl != "" {
+					headers.Set("Cache-Control", cacheControl)
+				}
+				for k, v := range headers {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+
+	movies, metadata, err := app.models.Movies.GetAll(r.Context(), input.Title, input.Genres, input.CreatedBy, input.MaxYear, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if r.Context().Err() != nil {
+		app.clientGoneResponse(w, r, r.Context().Err())
+		return
+	}
+
+	switch {
+	case r.Method != http.MethodPost && app.accepts(r, "application/xml"):
+		err = app.writeCacheableXML(w, r, cacheControl, "movies", movieListXML{Metadata: metadata, Movies: app.moviesResponse(r, movies)}, headers)
+	case r.Method == http.MethodPost:
+		err = app.writeJSON(w, r, http.StatusOK, envelope{"metadata": metadata, "movies": app.moviesResponse(r, movies)}, nil)
+	default:
+		err = app.writeCacheableJSON(w, r, cacheControl, envelope{"metadata": metadata, "links": app.paginationLinks(r, metadata), "movies": app.moviesResponse(r, movies)}, headers)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// movieListXML is the XML form of a page of movies: a <metadata> element
+// followed by a <movie> element for each movie.
+type movieListXML struct {
+	Metadata data.Metadata `xml:"metadata"`
+	Movies   any           `xml:"movie"`
+}
+
+// streamMovies writes every matching movie as newline-delimited JSON, one
+// object per line, flushing as it goes. Pagination parameters are ignored.
+func (app *application) streamMovies(w http.ResponseWriter, r *http.Request, input movieListInput) {
+	rc := http.NewResponseController(w)
+
+	// Large catalogues can take longer to send than the server's write timeout.
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	count := 0
+
+	err = app.models.Movies.Each(r.Context(), input.Title, input.Genres, input.CreatedBy, input.MaxYear, input.Filters, func(movie *data.Movie) error {
+		if count == 0 {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+		}
+
+		err := enc.Encode(app.movieResponse(r, movie))
+		if err != nil {
+			return err
+		}
+
+		count++
+		if count%100 == 0 {
+			return rc.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		// Once the first line is written the status code can't be changed,
+		// so all that's left to do is log the error.
+		switch {
+		case count == 0:
+			app.serverErrorResponse(w, r, err)
+		case r.Context().Err() != nil:
+			app.clientGoneResponse(w, r, err)
+		default:
+			app.logError(r, err)
+		}
+		return
+	}
+
+	if count == 0 {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// movieURL returns the canonical absolute URL of the movie, as clients reach
+// it, including any -base-path.
+func (app *application) movieURL(r *http.Request, movie *data.Movie) string {
+	return app.externalURL(r, app.apiPath("/movies/%s", app.movieIDParam(movie)))
+}
+
+// maxMergeAttempts bounds how many times a PATCH with ?merge=true is retried
+// when it keeps running into concurrent edits.
+const maxMergeAttempts = 3
+
+// optional is a JSON field that records whether it was present in the input
+// and whether it was null. A plain pointer can't tell an omitted field from an
+// explicit null, which PATCH needs: omitted leaves the field unchanged, null
+// clears it and any other value replaces it.
+type optional[T any] struct {
+	Set   bool
+	Null  bool
+	Value T
+}
+
+// UnmarshalJSON is only called for fields that are present in the input,
+// including those that are null.
+func (o *optional[T]) UnmarshalJSON(b []byte) error {
+	o.Set = true
+	if string(b) == "null" {
+		o.Null = true
+		return nil
+	}
+	return json.Unmarshal(b, &o.Value)
+}
+
+// movieUpdateInput holds a partial update, sent either as plain JSON or as a
+// JSON Merge Patch, which share these semantics. Only the summary and IMDb ID
+// can be cleared; sending null for any other field fails validation.
+type movieUpdateInput struct {
+	Title   optional[string]       `json:"title"`
+	Year    optional[int32]        `json:"year"`
+	Runtime optional[data.Runtime] `json:"runtime"`
+	Genres  optional[[]string]     `json:"genres"`
+	Summary optional[string]       `json:"summary"`
+	IMDbID  optional[string]       `json:"imdb_id"`
+}
+
+func (input movieUpdateInput) validate(v *validator.Validator) {
+	v.Check(!input.Title.Null, "title", validator.CodeRequired, "must not be null")
+	v.Check(!input.Year.Null, "year", validator.CodeRequired, "must not be null")
+	v.Check(!input.Runtime.Null, "runtime", validator.CodeRequired, "must not be null")
+	v.Check(!input.Genres.Null, "genres", validator.CodeRequired, "must not be null")
+
+	v.CheckForm(input.Title.Set || input.Year.Set || input.Runtime.Set || input.Genres.Set || input.Summary.Set || input.IMDbID.Set,
+		"must contain at least one field to update")
+}
+
+func (input movieUpdateInput) apply(movie *data.Movie) {
+	if input.Title.Set {
+		movie.Title = input.Title.Value
+	}
+	if input.Year.Set {
+		movie.Year = input.Year.Value
+	}
+	if input.Runtime.Set {
+		movie.Runtime = input.Runtime.Value
+	}
+	if input.Genres.Set {
+		movie.Genres = input.Genres.Value
+	}
+	if input.Summary.Set {
+		movie.Summary = nil
+		if !input.Summary.Null {
+			summary := input.Summary.Value
+			movie.Summary = &summary
+		}
+	}
+	if input.IMDbID.Set {
+		movie.IMDbID = nil
+		if !input.IMDbID.Null {
+			imdbID := input.IMDbID.Value
+			movie.IMDbID = &imdbID
+		}
+	}
+}
+
+// overlaps reports whether any field sent by the client differs between the
+// before and after versions of the movie.
+func (input movieUpdateInput) overlaps(before, after *data.Movie) bool {
+	return (input.Title.Set && before.Title != after.Title) ||
+		(input.Year.Set && before.Year != after.Year) ||
+		(input.Runtime.Set && before.Runtime != after.Runtime) ||
+		(input.Genres.Set && !slices.Equal(before.Genres, after.Genres)) ||
+		(input.Summary.Set && !equalPtr(before.Summary, after.Summary)) ||
+		(input.IMDbID.Set && !equalPtr(before.IMDbID, after.IMDbID))
+}
+
+func equalPtr[T comparable](a, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// canChangeMovies reports whether the user may update or delete movies with
+// the given creators. With -movie-ownership that takes creating all of them,
+// or the admin:movies permission; movies with no recorded creator are left to
+// admins. Otherwise movies:write, which the routes require, is enough.
+func (app *application) canChangeMovies(user *data.User, creators ...*int64) (bool, error) {
+	if !app.config.movieOwnership {
+		return true, nil
+	}
+
+	owned := true
+	for _, createdBy := range creators {
+		if createdBy == nil || *createdBy != user.ID {
+			owned = false
+			break
+		}
+	}
+	if owned {
+		return true, nil
+	}
+
+	permissions, err := app.permissionsFor(user)
+	if err != nil {
+		return false, err
+	}
+	return permissions.Include(data.PermissionAdminMovies), nil
+}
+
 func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
-		app.notFoundResponse(w, r)
+		switch {
+		case errors.Is(err, errInvalidIDParam), errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -127,6 +760,16 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	ok, err := app.canChangeMovies(app.contextGetUser(r), movie.CreatedBy)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.notMovieOwnerResponse(w, r)
+		return
+	}
+
 	if r.Header.Get("X-Expected-Version") != "" {
 		if strconv.Itoa(int(movie.Version)) != r.Header.Get("X-Expected-Version") {
 			app.editConflictResponse(w, r)
@@ -134,51 +777,90 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
-	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"runtime"`
-		Genres  []string      `json:"genres"`
-	}
+	var input movieUpdateInput
 
-	err = app.readJSON(w, r, &input)
+	if hasMergePatchContentType(r) {
+		err = app.readMergePatch(w, r, &input)
+	} else {
+		err = app.readJSON(w, r, &input)
+	}
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	if input.Title != nil {
-		movie.Title = *input.Title
-	}
-	if input.Year != nil {
-		movie.Year = *input.Year
-	}
-	if input.Runtime != nil {
-		movie.Runtime = *input.Runtime
-	}
-	if input.Genres != nil {
-		movie.Genres = input.Genres
-	}
-
 	v := validator.New()
+	merge := app.readBool(r.URL.Query(), "merge", false, v)
+	allowDuplicate := app.readBool(r.URL.Query(), "allow_duplicate", false, v)
 
-	if data.ValidateMovie(v, movie); !v.Valid() {
-		app.failedValidationResponse(w, r, v.FieldErrors)
+	if input.validate(v); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
-	err = app.models.Movies.Update(movie)
-	if err != nil {
+	for attempt := 1; ; attempt++ {
+		original := *movie
+		input.apply(movie)
+		movie.DuplicateAllowed = movie.DuplicateAllowed || allowDuplicate
+
+		v = validator.New()
+
+		if data.ValidateMovie(v, movie, app.models.Clock.Now(), app.config.movieRules); !v.Valid() {
+			app.failedValidationResponse(w, r, v)
+			return
+		}
+
+		app.movieCache.invalidate(id)
+		err = app.models.Movies.Update(movie)
+		app.movieCache.invalidate(id)
+		if err == nil {
+			break
+		}
+
 		switch {
-		case errors.Is(err, data.ErrEditConflict):
-			app.editConflictResponse(w, r)
-		default:
+		case addDuplicateMovieError(v, err):
+			app.failedValidationResponse(w, r, v)
+			return
+		case !errors.Is(err, data.ErrEditConflict):
 			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// Without merge, withConflictRetry runs the whole handler again
+		// against the current row.
+		if !merge {
+			app.retryEditConflictResponse(w, r)
+			return
+		}
+
+		// In merge mode, re-apply the client's fields on top of the current
+		// row, as long as none of them were changed by the concurrent edit.
+		if attempt >= maxMergeAttempts {
+			app.editConflictResponse(w, r)
+			return
+		}
+
+		movie, err = app.models.Movies.Get(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if input.overlaps(&original, movie) {
+			app.editConflictResponse(w, r)
+			return
 		}
-		return
 	}
 
-	if err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil); err != nil {
+	app.publishMovieEvent(movieUpdated, movie)
+	app.audit(r, movieUpdated, fmt.Sprintf("movie:%s", app.movieIDParam(movie)))
+
+	if err = app.writeJSON(w, r, http.StatusOK, envelope{"movie": app.movieResponse(r, movie)}, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
@@ -186,11 +868,42 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
-		app.notFoundResponse(w, r)
+		switch {
+		case errors.Is(err, errInvalidIDParam), errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	if err = app.models.Movies.Delete(id); err != nil {
+	if app.config.movieOwnership {
+		movie, err := app.models.Movies.Get(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		ok, err := app.canChangeMovies(app.contextGetUser(r), movie.CreatedBy)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !ok {
+			app.notMovieOwnerResponse(w, r)
+			return
+		}
+	}
+
+	app.movieCache.invalidate(id)
+	uuid, err := app.models.Movies.Delete(id)
+	app.movieCache.invalidate(id)
+	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
@@ -200,8 +913,131 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
+	deleted := &data.Movie{ID: id, UUID: uuid}
+	app.publishMovieEvent(movieDeleted, deleted)
+	app.audit(r, movieDeleted, fmt.Sprintf("movie:%s", app.movieIDParam(deleted)))
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteMoviesHandler deletes the movies listed by ID, or by UUID with
+// -movie-ids=uuid, and lists those that didn't exist.
+func (app *application) deleteMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		IDs []int64 `json:"ids"`
+	}
+	var uuidInput struct {
+		IDs []string `json:"ids"`
+	}
+
+	uuids := app.config.movieIDs == movieIDsUUID
+
+	var err error
+	if uuids {
+		err = app.readJSON(w, r, &uuidInput)
+	} else {
+		err = app.readJSON(w, r, &input)
+	}
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if uuids {
+		validateMovieIDs(v, uuidInput.IDs, app.config.batchDeleteMax)
+		for _, uuid := range uuidInput.IDs {
+			v.Check(uuidRX.MatchString(uuid), "ids", validator.CodeInvalidFormat, "must only contain UUIDs")
+		}
+	} else {
+		validateMovieIDs(v, input.IDs, app.config.batchDeleteMax)
+		for _, id := range input.IDs {
+			v.Check(id > 0, "ids", validator.CodeOutOfRange, "must only contain positive integers")
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	// refs are the IDs as the client sent them, keyed by movie ID. UUIDs
+	// that match no movie go straight to the not_found list.
+	notFound := []any{}
+	refs := make(map[int64]any)
+	if uuids {
+		ids, err := app.models.Movies.GetIDsForUUIDs(r.Context(), uuidInput.IDs)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		for _, uuid := range uuidInput.IDs {
+			id, found := ids[uuid]
+			if !found {
+				notFound = append(notFound, uuid)
+				continue
+			}
+			input.IDs = append(input.IDs, id)
+			refs[id] = uuid
+		}
+	} else {
+		for _, id := range input.IDs {
+			refs[id] = id
+		}
+	}
+
+	// Movies that don't exist are left for the not_found list.
+	if app.config.movieOwnership {
+		creators, err := app.models.Movies.GetCreators(r.Context(), input.IDs)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		ok, err := app.canChangeMovies(app.contextGetUser(r), slices.Collect(maps.Values(creators))...)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !ok {
+			app.notMovieOwnerResponse(w, r)
+			return
+		}
+	}
+
+	app.movieCache.invalidate(input.IDs...)
+	deleted, err := app.models.Movies.DeleteMany(input.IDs)
+	app.movieCache.invalidate(input.IDs...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, id := range input.IDs {
+		uuid, found := deleted[id]
+		if !found {
+			notFound = append(notFound, refs[id])
+			continue
+		}
+
+		movie := &data.Movie{ID: id, UUID: uuid}
+		app.publishMovieEvent(movieDeleted, movie)
+		app.audit(r, movieDeleted, fmt.Sprintf("movie:%s", app.movieIDParam(movie)))
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"deleted": len(deleted), "not_found": notFound}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// validateMovieIDs checks the number of IDs in a batch and that there are no
+// duplicates.
+func validateMovieIDs[T comparable](v *validator.Validator, ids []T, max int) {
+	v.Check(len(ids) > 0, "ids", validator.CodeTooFew, "must contain at least 1 id")
+	v.Checkf(len(ids) <= max, "ids", validator.CodeTooMany, "must not contain more than %d ids", max)
+	v.Check(validator.Unique(ids), "ids", validator.CodeNotUnique, "must not contain duplicate values")
+}
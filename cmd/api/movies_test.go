@@ -0,0 +1,462 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mathiasb/greenlight/internal/data"
+	"github.com/mathiasb/greenlight/internal/validator"
+)
+
+func TestOptionalUnmarshal(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantSet  bool
+		wantNull bool
+		want     string
+	}{
+		{"omitted", `{}`, false, false, ""},
+		{"null", `{"summary":null}`, true, true, ""},
+		{"empty", `{"summary":""}`, true, false, ""},
+		{"value", `{"summary":"A girl sails"}`, true, false, "A girl sails"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var input struct {
+				Summary optional[string] `json:"summary"`
+			}
+			if err := json.Unmarshal([]byte(tt.body), &input); err != nil {
+				t.Fatal(err)
+			}
+
+			got := input.Summary
+			if got.Set != tt.wantSet || got.Null != tt.wantNull || got.Value != tt.want {
+				t.Errorf("got %+v; want {Set:%t Null:%t Value:%s}", got, tt.wantSet, tt.wantNull, tt.want)
+			}
+		})
+	}
+}
+
+func TestMovieUpdateInputApply(t *testing.T) {
+	ptr := func(s string) *string { return &s }
+
+	tests := []struct {
+		name        string
+		body        string
+		wantTitle   string
+		wantGenres  []string
+		wantSummary *string
+		wantIMDbID  *string
+	}{
+		{"omitted keeps", `{"year":2017}`, "Moana", []string{"animation"}, ptr("A girl sails"), ptr("tt3521164")},
+		{"null clears", `{"summary":null,"imdb_id":null}`, "Moana", []string{"animation"}, nil, nil},
+		{"value sets", `{"title":"Moana 2","genres":["adventure"],"summary":"She sails again"}`, "Moana 2", []string{"adventure"}, ptr("She sails again"), ptr("tt3521164")},
+		{"empty string sets", `{"summary":""}`, "Moana", []string{"animation"}, ptr(""), ptr("tt3521164")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movie := &data.Movie{
+				Title:   "Moana",
+				Year:    2016,
+				Runtime: 107,
+				Genres:  []string{"animation"},
+				Summary: ptr("A girl sails"),
+				IMDbID:  ptr("tt3521164"),
+			}
+
+			var input movieUpdateInput
+			if err := json.Unmarshal([]byte(tt.body), &input); err != nil {
+				t.Fatal(err)
+			}
+			input.apply(movie)
+
+			if movie.Title != tt.wantTitle {
+				t.Errorf("got title %q; want %q", movie.Title, tt.wantTitle)
+			}
+			if !slices.Equal(movie.Genres, tt.wantGenres) {
+				t.Errorf("got genres %v; want %v", movie.Genres, tt.wantGenres)
+			}
+			if !equalPtr(movie.Summary, tt.wantSummary) {
+				t.Errorf("got summary %v; want %v", movie.Summary, tt.wantSummary)
+			}
+			if !equalPtr(movie.IMDbID, tt.wantIMDbID) {
+				t.Errorf("got IMDb ID %v; want %v", movie.IMDbID, tt.wantIMDbID)
+			}
+			if movie.Runtime != 107 {
+				t.Errorf("got runtime %d; want it unchanged", movie.Runtime)
+			}
+		})
+	}
+}
+
+func TestMovieUpdateInputValidate(t *testing.T) {
+	tests := []struct {
+		name              string
+		body              string
+		wantFieldErrors   []string
+		wantNonFieldError bool
+	}{
+		{"one field", `{"title":"Moana"}`, nil, false},
+		{"clear summary", `{"summary":null}`, nil, false},
+		{"null title", `{"title":null}`, []string{"title"}, false},
+		{"null required fields", `{"year":null,"runtime":null,"genres":null}`, []string{"year", "runtime", "genres"}, false},
+		{"no fields", `{}`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var input movieUpdateInput
+			if err := json.Unmarshal([]byte(tt.body), &input); err != nil {
+				t.Fatal(err)
+			}
+
+			v := validator.New()
+			input.validate(v)
+
+			if len(v.FieldErrors) != len(tt.wantFieldErrors) {
+				t.Errorf("got field errors %v; want %v", v.FieldErrors, tt.wantFieldErrors)
+			}
+			for _, field := range tt.wantFieldErrors {
+				if _, ok := v.FieldErrors[field]; !ok {
+					t.Errorf("want an error for %q; got %v", field, v.FieldErrors)
+				}
+			}
+			if got := len(v.NonFieldErrors) > 0; got != tt.wantNonFieldError {
+				t.Errorf("got non-field errors %v; want some: %t", v.NonFieldErrors, tt.wantNonFieldError)
+			}
+		})
+	}
+}
+
+func TestMovieURL(t *testing.T) {
+	movie := &data.Movie{ID: 42, UUID: "0b9c7f9e-4f2a-4c8e-9a53-3f1a9f0c1d2e"}
+
+	tests := []struct {
+		name     string
+		basePath string
+		movieIDs string
+		proxy    bool
+		headers  map[string]string
+		want     string
+	}{
+		{"default", "", movieIDsInt, false, nil, "http://api.example.com/v1/movies/42"},
+		{"base path", "/api/v1", movieIDsInt, false, nil, "http://api.example.com/api/v1/movies/42"},
+		{"uuid", "", movieIDsUUID, false, nil, "http://api.example.com/v1/movies/0b9c7f9e-4f2a-4c8e-9a53-3f1a9f0c1d2e"},
+		{
+			"trusted proxy", "/api/v1", movieIDsInt, true,
+			map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "movies.example.org"},
+			"https://movies.example.org/api/v1/movies/42",
+		},
+		{
+			"untrusted proxy", "", movieIDsInt, false,
+			map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example.org"},
+			"http://api.example.com/v1/movies/42",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			if tt.basePath != "" {
+				app.config.basePath = tt.basePath
+			}
+			app.config.movieIDs = tt.movieIDs
+			if tt.proxy {
+				app.config.trustedProxies = []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")}
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/movies", nil)
+			r.Host = "api.example.com"
+			r.RemoteAddr = "192.0.2.1:1234"
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			if got := app.movieURL(r, movie); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCreateMovieLocation checks the Location header and self link written by
+// createMovieHandler, with the insert answered by a fake database.
+func TestCreateMovieLocation(t *testing.T) {
+	tests := []struct {
+		name     string
+		basePath string
+		movieIDs string
+		proxy    bool
+		want     string
+	}{
+		{"default", "", movieIDsInt, false, "http://api.example.com/v1/movies/42"},
+		{"base path", "/api/v1", movieIDsInt, false, "http://api.example.com/api/v1/movies/42"},
+		{"uuid", "", movieIDsUUID, false, "http://api.example.com/v1/movies/0b9c7f9e-4f2a-4c8e-9a53-3f1a9f0c1d2e"},
+		{"trusted proxy", "", movieIDsInt, true, "https://movies.example.org/v1/movies/42"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			if tt.basePath != "" {
+				app.config.basePath = tt.basePath
+			}
+			app.config.movieIDs = tt.movieIDs
+			if tt.proxy {
+				app.config.trustedProxies = []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")}
+			}
+
+			withFakeDB(t, app, func(query string, args []driver.Value) fakeResult {
+				if !strings.Contains(query, "INSERT INTO movies") {
+					return fakeResult{}
+				}
+				now := time.Now()
+				return fakeResult{
+					columns: []string{"id", "uuid", "created_at", "updated_at", "version"},
+					rows:    [][]driver.Value{{int64(42), "0b9c7f9e-4f2a-4c8e-9a53-3f1a9f0c1d2e", now, now, int64(1)}},
+				}
+			})
+
+			body := `{"title":"Moana","year":2016,"runtime":"107 mins","genres":["animation","adventure"]}`
+			r := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			r.Host = "api.example.com"
+			r.RemoteAddr = "192.0.2.1:1234"
+			r.Header.Set("X-Forwarded-Proto", "https")
+			r.Header.Set("X-Forwarded-Host", "movies.example.org")
+			r = app.contextSetUser(r, &data.User{ID: 7})
+			rr := httptest.NewRecorder()
+
+			app.createMovieHandler(rr, r)
+
+			if rr.Code != http.StatusCreated {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusCreated, rr.Body)
+			}
+			if got := rr.Header().Get("Location"); got != tt.want {
+				t.Errorf("got Location %q; want %q", got, tt.want)
+			}
+
+			var response struct {
+				Links map[string]string `json:"links"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if got := response.Links["self"]; got != tt.want {
+				t.Errorf("got self link %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateMovieIDs(t *testing.T) {
+	tests := []struct {
+		name  string
+		ids   []string
+		valid bool
+	}{
+		{"one", []string{"a"}, true},
+		{"at max", []string{"a", "b", "c"}, true},
+		{"none", []string{}, false},
+		{"over max", []string{"a", "b", "c", "d"}, false},
+		{"duplicates", []string{"a", "a"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			validateMovieIDs(v, tt.ids, 3)
+			if v.Valid() != tt.valid {
+				t.Errorf("got valid %t; want %t (%v)", v.Valid(), tt.valid, v.FieldErrors)
+			}
+		})
+	}
+}
+
+func TestAddDuplicateMovieError(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		want        bool
+		wantField   string
+		wantMessage string
+	}{
+		{"title and year", data.ErrDuplicateMovie, true, "title", duplicateMovieMessage},
+		{"wrapped", fmt.Errorf("import: %w", data.ErrDuplicateMovie), true, "title", duplicateMovieMessage},
+		{"IMDb ID", data.ErrDuplicateIMDbID, true, "imdb_id", "a movie with this IMDb ID already exists"},
+		{"edit conflict", data.ErrEditConflict, false, "", ""},
+		{"other", errors.New("connection refused"), false, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+
+			if got := addDuplicateMovieError(v, tt.err); got != tt.want {
+				t.Fatalf("got %t; want %t", got, tt.want)
+			}
+			if !tt.want {
+				if !v.Valid() {
+					t.Errorf("got errors %v; want none", v.FieldErrors)
+				}
+				return
+			}
+
+			if len(v.Errors) != 1 {
+				t.Fatalf("got %d errors; want 1", len(v.Errors))
+			}
+			e := v.Errors[0]
+			if e.Field != tt.wantField || e.Code != validator.CodeAlreadyExists || v.FieldErrors[tt.wantField] != tt.wantMessage {
+				t.Errorf("got %s %s %q; want %s %s %q", e.Field, e.Code, v.FieldErrors[e.Field], tt.wantField, validator.CodeAlreadyExists, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestDuplicateMovieResponse(t *testing.T) {
+	app := newTestApplication(t)
+
+	v := validator.New()
+	addDuplicateMovieError(v, data.ErrDuplicateMovie)
+
+	rr := httptest.NewRecorder()
+	app.failedValidationResponse(rr, httptest.NewRequest(http.MethodPost, "/v1/movies", nil), v)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+
+	var body struct {
+		Error      map[string]string `json:"error"`
+		ErrorCodes map[string]string `json:"error_codes"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if got := body.Error["title"]; got != duplicateMovieMessage {
+		t.Errorf("got message %q; want %q", got, duplicateMovieMessage)
+	}
+	if got := body.ErrorCodes["title"]; got != validator.CodeAlreadyExists {
+		t.Errorf("got code %q; want %q", got, validator.CodeAlreadyExists)
+	}
+}
+
+// TestInvalidAsOf checks that a malformed as_of is rejected by every movie
+// list before the database is queried.
+func TestInvalidAsOf(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(*application) http.HandlerFunc
+		method  string
+		target  string
+		body    string
+	}{
+		{"list", func(app *application) http.HandlerFunc { return app.listMoviesHandler }, http.MethodGet, "/v1/movies?as_of=yesterday", ""},
+		{"count", func(app *application) http.HandlerFunc { return app.countMoviesHandler }, http.MethodGet, "/v1/movies/count?as_of=yesterday", ""},
+		{"search", func(app *application) http.HandlerFunc { return app.searchMoviesHandler }, http.MethodPost, "/v1/movies/search", `{"as_of":"yesterday"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			r = app.contextSetUser(r, &data.User{ID: 7})
+			rr := httptest.NewRecorder()
+
+			tt.handler(app)(rr, r)
+
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+			}
+
+			var body struct {
+				ErrorCodes map[string]string `json:"error_codes"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if got := body.ErrorCodes["as_of"]; got != validator.CodeInvalidFormat {
+				t.Errorf("got code %q; want %q", got, validator.CodeInvalidFormat)
+			}
+		})
+	}
+}
+
+func TestMovieCreatorFilter(t *testing.T) {
+	tests := []struct {
+		name          string
+		user          *data.User
+		mine          bool
+		wantCreatedBy int64
+		wantOK        bool
+		wantStatus    int
+	}{
+		{"anyone", &data.User{ID: 7}, false, 0, true, http.StatusOK},
+		{"anonymous, anyone", data.AnonymousUser, false, 0, true, http.StatusOK},
+		{"mine", &data.User{ID: 7}, true, 7, true, http.StatusOK},
+		{"anonymous, mine", data.AnonymousUser, true, 0, false, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+
+			r := app.contextSetUser(httptest.NewRequest(http.MethodGet, "/v1/movies?mine=true", nil), tt.user)
+			rr := httptest.NewRecorder()
+
+			createdBy, ok := app.movieCreatorFilter(rr, r, tt.mine)
+			if createdBy != tt.wantCreatedBy || ok != tt.wantOK {
+				t.Errorf("got (%d, %t); want (%d, %t)", createdBy, ok, tt.wantCreatedBy, tt.wantOK)
+			}
+			if rr.Code != tt.wantStatus {
+				t.Errorf("got status %d; want %d", rr.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+// TestCanChangeMovies covers the cases decided without the database. A caller
+// who doesn't own every movie has their permissions looked up instead.
+func TestCanChangeMovies(t *testing.T) {
+	id := func(n int64) *int64 { return &n }
+
+	tests := []struct {
+		name      string
+		ownership bool
+		creators  []*int64
+	}{
+		{"ownership off, someone else's", false, []*int64{id(8)}},
+		{"ownership off, no creator", false, []*int64{nil}},
+		{"own movie", true, []*int64{id(7)}},
+		{"all own movies", true, []*int64{id(7), id(7)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.movieOwnership = tt.ownership
+
+			ok, err := app.canChangeMovies(&data.User{ID: 7}, tt.creators...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Error("got false; want true")
+			}
+		})
+	}
+}
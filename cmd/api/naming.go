@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// The struct tags use snake_case. With camelCase naming, the keys of every
+// JSON object are rewritten after marshalling, and before unmarshalling.
+const (
+	jsonNamingSnake = "snake"
+	jsonNamingCamel = "camel"
+)
+
+// negotiateNaming picks the JSON naming for the request: the profile parameter
+// of the Accept header if there is one (e.g. application/json; profile=camel),
+// otherwise -json-naming. The choice is recorded in the request context for
+// readJSON and writeJSON, and announced in the profile parameter of the
+// response's content type.
+func (app *application) negotiateNaming(w http.ResponseWriter, r *http.Request) *http.Request {
+	naming := app.config.jsonNaming
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		_, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		if profile := params["profile"]; profile == jsonNamingSnake || profile == jsonNamingCamel {
+			naming = profile
+			break
+		}
+	}
+
+	if naming == jsonNamingCamel {
+		contentType := w.Header().Get("Content-Type")
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		w.Header().Set("Content-Type", contentType+"; profile="+jsonNamingCamel)
+	}
+
+	return app.contextSetJSONNaming(r, naming)
+}
+
+// renameKeys rewrites the keys of every object in the JSON document js with
+// rename, leaving everything else, including the order of the keys, as is.
+// The result is compact.
+func renameKeys(js []byte, rename func(string) string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	// For each open object or array, the number of keys and values written
+	// to it so far.
+	type container struct {
+		object bool
+		count  int
+	}
+	var stack []*container
+	var buf bytes.Buffer
+
+	for {
+		token, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if delim, ok := token.(json.Delim); ok && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			buf.WriteRune(rune(delim))
+			continue
+		}
+
+		isKey := false
+		if len(stack) > 0 {
+			parent := stack[len(stack)-1]
+			isKey = parent.object && parent.count%2 == 0
+			// A value in an object follows its key's colon.
+			if parent.count > 0 && (!parent.object || isKey) {
+				buf.WriteByte(',')
+			}
+			parent.count++
+		}
+
+		switch token := token.(type) {
+		case json.Delim:
+			stack = append(stack, &container{object: token == '{'})
+			buf.WriteRune(rune(token))
+		case string:
+			if isKey {
+				token = rename(token)
+			}
+			b, err := json.Marshal(token)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(b)
+			if isKey {
+				buf.WriteByte(':')
+			}
+		default:
+			b, err := json.Marshal(token)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(b)
+		}
+	}
+
+	// Token returns io.EOF rather than an error for a truncated document.
+	if len(stack) > 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), nil
+}
+
+// snakeToCamel converts e.g. created_at to createdAt.
+func snakeToCamel(s string) string {
+	if !strings.Contains(s, "_") {
+		return s
+	}
+
+	var b strings.Builder
+	upper := false
+	for _, r := range s {
+		switch {
+		case r == '_':
+			upper = b.Len() > 0
+		case upper:
+			b.WriteString(strings.ToUpper(string(r)))
+			upper = false
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// camelToSnake converts e.g. createdAt to created_at.
+func camelToSnake(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if r >= 'A' && r <= 'Z' {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
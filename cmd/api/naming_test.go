@@ -0,0 +1,221 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSnakeToCamel(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"id", "id"},
+		{"created_at", "createdAt"},
+		{"imdb_id", "imdbId"},
+		{"total_requests_received", "totalRequestsReceived"},
+		{"_private", "private"},
+		{"trailing_", "trailing"},
+		{"already", "already"},
+	}
+
+	for _, tt := range tests {
+		if got := snakeToCamel(tt.in); got != tt.want {
+			t.Errorf("snakeToCamel(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCamelToSnake(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"id", "id"},
+		{"createdAt", "created_at"},
+		{"imdbId", "imdb_id"},
+		{"totalRequestsReceived", "total_requests_received"},
+		{"Title", "title"},
+		{"already_snake", "already_snake"},
+	}
+
+	for _, tt := range tests {
+		if got := camelToSnake(tt.in); got != tt.want {
+			t.Errorf("camelToSnake(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRenameKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		rename  func(string) string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "nested keys",
+			in:     `{"movie":{"created_at":"x","genres":["sci_fi"],"run_time":{"in_minutes":102}}}`,
+			rename: snakeToCamel,
+			// String values, including those in arrays, are left alone.
+			want: `{"movie":{"createdAt":"x","genres":["sci_fi"],"runTime":{"inMinutes":102}}}`,
+		},
+		{
+			name:   "objects in arrays",
+			in:     `[{"imdb_id":"tt1"},{"imdb_id":null}]`,
+			rename: snakeToCamel,
+			want:   `[{"imdbId":"tt1"},{"imdbId":null}]`,
+		},
+		{
+			name:   "back to snake case",
+			in:     `{"movie":{"createdAt":"x","runTime":{"inMinutes":102}}}`,
+			rename: camelToSnake,
+			want:   `{"movie":{"created_at":"x","run_time":{"in_minutes":102}}}`,
+		},
+		{
+			name:   "large numbers are kept",
+			in:     `{"view_count":9007199254740993}`,
+			rename: snakeToCamel,
+			want:   `{"viewCount":9007199254740993}`,
+		},
+		{
+			name:    "truncated",
+			in:      `{"created_at":`,
+			rename:  snakeToCamel,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renameKeys([]byte(tt.in), tt.rename)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %s; want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s; want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiateNaming(t *testing.T) {
+	tests := []struct {
+		name            string
+		defaultNaming   string
+		accept          string
+		wantNaming      string
+		wantContentType string
+	}{
+		{"default snake", jsonNamingSnake, "", jsonNamingSnake, ""},
+		{"default camel", jsonNamingCamel, "", jsonNamingCamel, "application/json; profile=camel"},
+		{"camel profile", jsonNamingSnake, "application/json; profile=camel", jsonNamingCamel, "application/json; profile=camel"},
+		{"snake profile", jsonNamingCamel, "application/json; profile=snake", jsonNamingSnake, ""},
+		{"unknown profile", jsonNamingSnake, "application/json; profile=kebab", jsonNamingSnake, ""},
+		{"second media type", jsonNamingSnake, "text/html, application/json; profile=camel", jsonNamingCamel, "application/json; profile=camel"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.jsonNaming = tt.defaultNaming
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			rr := httptest.NewRecorder()
+
+			r = app.negotiateNaming(rr, r)
+
+			if got := app.contextGetJSONNaming(r); got != tt.wantNaming {
+				t.Errorf("got naming %q; want %q", got, tt.wantNaming)
+			}
+			if got := rr.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("got Content-Type %q; want %q", got, tt.wantContentType)
+			}
+		})
+	}
+}
+
+func TestMarshalJSONNaming(t *testing.T) {
+	app := newTestApplication(t)
+	data := envelope{"movie": map[string]any{"created_at": "x", "run_time": 102}}
+
+	tests := []struct {
+		naming string
+		want   string
+	}{
+		{jsonNamingSnake, `{"movie":{"created_at":"x","run_time":102}}` + "\n"},
+		{jsonNamingCamel, `{"movie":{"createdAt":"x","runTime":102}}` + "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.naming, func(t *testing.T) {
+			r := app.contextSetJSONNaming(httptest.NewRequest(http.MethodGet, "/", nil), tt.naming)
+
+			got, err := app.marshalJSON(r, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s; want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadJSONNaming(t *testing.T) {
+	type input struct {
+		Title     string `json:"title"`
+		CreatedAt string `json:"created_at"`
+	}
+
+	tests := []struct {
+		name    string
+		naming  string
+		body    string
+		want    input
+		wantErr string
+	}{
+		{"snake", jsonNamingSnake, `{"title":"Up","created_at":"x"}`, input{"Up", "x"}, ""},
+		{"camel", jsonNamingCamel, `{"title":"Up","createdAt":"x"}`, input{"Up", "x"}, ""},
+		// A snake_case key in a camelCase body is still accepted.
+		{"snake in camel", jsonNamingCamel, `{"created_at":"x"}`, input{CreatedAt: "x"}, ""},
+		// A camelCase key in a snake_case body is unknown.
+		{"camel in snake", jsonNamingSnake, `{"createdAt":"x"}`, input{}, `body contains unknown key "createdAt"`},
+		// Unknown keys are reported by their snake_case names.
+		{"unknown camel", jsonNamingCamel, `{"runTime":1}`, input{}, `body contains unknown key "run_time"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			r = app.contextSetJSONNaming(r, tt.naming)
+
+			var got input
+			err := app.readJSON(httptest.NewRecorder(), r, &got)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Fatalf("got error %v; want %q", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
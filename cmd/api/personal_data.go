@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mathiasb/greenlight/internal/data"
+)
+
+// userDataExported is audited when a user downloads their personal data.
+const userDataExported = "user.data_exported"
+
+// personalDataSection is one key of a personal data export. Its each func
+// passes the section's value to emit or, for a list, each of its elements in
+// turn, so that long lists are written as they are read.
+type personalDataSection struct {
+	name string
+	list bool
+	each func(ctx context.Context, app *application, user *data.User, emit func(any) error) error
+}
+
+// personalDataSections is everything a user's personal data export holds, in
+// order. Data a user owns goes here when it's added.
+var personalDataSections = []personalDataSection{
+	{
+		// The stored user, as the context user may only carry JWT claims.
+		// Its password hash and TOTP secret are never serialized.
+		name: "user",
+		each: func(ctx context.Context, app *application, user *data.User, emit func(any) error) error {
+			stored, err := app.models.Users.Get(user.ID)
+			if err != nil {
+				return err
+			}
+			return emit(stored)
+		},
+	},
+	{
+		name: "permissions",
+		each: func(ctx context.Context, app *application, user *data.User, emit func(any) error) error {
+			permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+			if err != nil {
+				return err
+			}
+			return emit(permissions)
+		},
+	},
+	{
+		name: "sessions",
+		list: true,
+		each: func(ctx context.Context, app *application, user *data.User, emit func(any) error) error {
+			sessions, err := app.models.Tokens.GetSessionsForUser(user.ID)
+			if err != nil {
+				return err
+			}
+			for _, session := range sessions {
+				if err := emit(session); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		// Movies are written as in API version 2, with their timestamps.
+		name: "movies",
+		list: true,
+		each: func(ctx context.Context, app *application, user *data.User, emit func(any) error) error {
+			filters := data.Filters{Sort: "id", SortSafeList: []string{"id"}}
+			return app.models.Movies.Each(ctx, "", []string{}, user.ID, 0, filters, func(movie *data.Movie) error {
+				v2 := movieV2{Movie: movie, CreatedAt: movie.CreatedAt, UpdatedAt: movie.UpdatedAt}
+				if app.config.movieIDs == movieIDsUUID {
+					return emit(uuidMovieV2{movieV2: v2, ID: movie.UUID})
+				}
+				return emit(v2)
+			})
+		},
+	},
+	{
+		name: "ratings",
+		list: true,
+		each: func(ctx context.Context, app *application, user *data.User, emit func(any) error) error {
+			return app.models.Ratings.EachForUser(ctx, user.ID, func(rating *data.Rating) error {
+				return emit(struct {
+					MovieID any `json:"movie_id"`
+					*data.Rating
+				}{app.movieRef(rating.MovieID, rating.MovieUUID), rating})
+			})
+		},
+	},
+	{
+		name: "audit_log",
+		list: true,
+		each: func(ctx context.Context, app *application, user *data.User, emit func(any) error) error {
+			return app.models.Audit.EachForUser(ctx, user.ID, func(entry *data.AuditEntry) error {
+				return emit(entry)
+			})
+		},
+	},
+}
+
+// exportPersonalDataHandler streams everything held about the caller as a
+// single JSON object, one key per personalDataSection, for download. Each
+// user may export once per -limiter-export-interval.
+func (app *application) exportPersonalDataHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	if app.config.limiter.enabled && app.config.limiter.exportInterval > 0 {
+		wait := app.personalDataExports.wait(user.ID, app.config.limiter.exportInterval)
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			app.rateLimitExceededResponse(w, r)
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	exportedAt := time.Now().UTC()
+
+	write := func(s string, v any) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append([]byte(s), b...))
+		return err
+	}
+
+	// As in exportMoviesHandler, the headers wait for the first value, so
+	// that a failed query can still get a normal error response.
+	started := false
+	start := func() error {
+		filename := fmt.Sprintf("personal-data-%s.json", exportedAt.Format("20060102T150405Z"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		w.WriteHeader(http.StatusOK)
+		started = true
+		return write(`{"exported_at":`, exportedAt)
+	}
+
+	for _, section := range personalDataSections {
+		n := 0
+		err = section.each(r.Context(), app, user, func(v any) error {
+			if !started {
+				if err := start(); err != nil {
+					return err
+				}
+			}
+
+			prefix := ","
+			switch {
+			case n == 0 && section.list:
+				prefix = fmt.Sprintf(`,%q:[`, section.name)
+			case n == 0:
+				prefix = fmt.Sprintf(`,%q:`, section.name)
+			}
+			n++
+
+			return write(prefix, v)
+		})
+		switch {
+		case err != nil || !section.list:
+		case n > 0:
+			_, err = w.Write([]byte("]"))
+		case !started:
+			if err = start(); err == nil {
+				err = write(fmt.Sprintf(`,%q:`, section.name), []any{})
+			}
+		default:
+			err = write(fmt.Sprintf(`,%q:`, section.name), []any{})
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			switch {
+			case !started && errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			case !started:
+				app.serverErrorResponse(w, r, err)
+			case r.Context().Err() != nil:
+				app.clientGoneResponse(w, r, err)
+			default:
+				app.logError(r, err)
+			}
+			return
+		}
+	}
+
+	_, err = w.Write([]byte("}\n"))
+	if err != nil {
+		app.logError(r, err)
+		return
+	}
+
+	app.audit(r, userDataExported, fmt.Sprintf("user:%d", user.ID))
+}
+
+// exportLimiter remembers when each user last exported their personal data.
+type exportLimiter struct {
+	mu   sync.Mutex
+	last map[int64]time.Time
+}
+
+func newExportLimiter() *exportLimiter {
+	return &exportLimiter{last: make(map[int64]time.Time)}
+}
+
+// wait returns how long the user has to wait before their next export, or
+// zero if they may export now, in which case the export is recorded.
+func (l *exportLimiter) wait(userID int64, interval time.Duration) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for id, last := range l.last {
+		if now.Sub(last) >= interval {
+			delete(l.last, id)
+		}
+	}
+
+	if last, found := l.last[userID]; found {
+		return interval - now.Sub(last)
+	}
+	l.last[userID] = now
+	return 0
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExportLimiterWait(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous map[int64]time.Duration
+		userID   int64
+		wantWait bool
+	}{
+		{"first export", nil, 1, false},
+		{"within the interval", map[int64]time.Duration{1: time.Minute}, 1, true},
+		{"interval passed", map[int64]time.Duration{1: 2 * time.Hour}, 1, false},
+		{"another user exported", map[int64]time.Duration{2: time.Minute}, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newExportLimiter()
+			for id, ago := range tt.previous {
+				l.last[id] = time.Now().Add(-ago)
+			}
+
+			wait := l.wait(tt.userID, time.Hour)
+			if got := wait > 0; got != tt.wantWait {
+				t.Fatalf("got wait %s; want a wait: %t", wait, tt.wantWait)
+			}
+			if wait > time.Hour {
+				t.Errorf("got wait %s; want at most the interval", wait)
+			}
+
+			// An export that was allowed is recorded, so the next one waits.
+			if !tt.wantWait && l.wait(tt.userID, time.Hour) <= 0 {
+				t.Error("want the export to be recorded")
+			}
+		})
+	}
+}
+
+func TestExportLimiterWaitForgetsExpired(t *testing.T) {
+	l := newExportLimiter()
+	l.last[1] = time.Now().Add(-2 * time.Hour)
+	l.last[2] = time.Now().Add(-time.Minute)
+
+	l.wait(3, time.Hour)
+
+	if _, found := l.last[1]; found {
+		t.Error("want the expired export to be forgotten")
+	}
+	if _, found := l.last[2]; !found {
+		t.Error("want the recent export to be kept")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// pprofHandler serves the net/http/pprof profiles under /debug/pprof/. The
+// pprof handlers are dispatched by hand because pprof.Index only recognises
+// profile names under the fixed /debug/pprof/ path, which doesn't hold when
+// -base-path moves the debug routes.
+func (app *application) pprofHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(httprouter.ParamsFromContext(r.Context()).ByName("item"), "/")
+
+	switch name {
+	case "":
+		pprof.Index(w, r)
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "profile", "trace":
+		// These run for ?seconds=N (30 by default for profile), which is
+		// longer than the server's write timeout.
+		err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if name == "profile" {
+			pprof.Profile(w, r)
+		} else {
+			pprof.Trace(w, r)
+		}
+	default:
+		pprof.Handler(name).ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+)
+
+// reloadableFlags are the settings picked up by a SIGHUP. Changes to any other
+// setting only take effect after a restart.
+var reloadableFlags = []string{"limiter-rps", "limiter-burst", "log-level", "cors-trusted-origins"}
+
+// liveConfig holds the settings that can change while the server is running.
+// Middleware must read them through its methods on every request rather than
+// from app.config.
+type liveConfig struct {
+	mu             sync.RWMutex
+	limiterRPS     float64
+	limiterBurst   int
+	trustedOrigins []string
+}
+
+func (lc *liveConfig) set(cfg config) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.limiterRPS = cfg.limiter.rps
+	lc.limiterBurst = cfg.limiter.burst
+	lc.trustedOrigins = cfg.cors.trustedOrigins
+}
+
+func (lc *liveConfig) limiter() (float64, int) {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+
+	return lc.limiterRPS, lc.limiterBurst
+}
+
+func (lc *liveConfig) isTrustedOrigin(origin string) bool {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+
+	return slices.Contains(lc.trustedOrigins, origin)
+}
+
+// listenForReloadSignal reloads the config from the command line, environment
+// and config file each time the process receives SIGHUP.
+func (app *application) listenForReloadSignal() {
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	go func() {
+		for range reload {
+			app.reloadConfig()
+		}
+	}()
+}
+
+func (app *application) reloadConfig() {
+	var cfg config
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	defineFlags(fs, &cfg)
+
+	err := fs.Parse(os.Args[1:])
+	if err == nil {
+		err = loadConfig(fs, cfg.configFile)
+	}
+	if err == nil {
+		err = cfg.validate()
+	}
+	if err != nil {
+		app.logger.Error("config reload failed, keeping current settings", "error", err.Error())
+		return
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if slices.Contains(reloadableFlags, f.Name) {
+			return
+		}
+		if current := flag.Lookup(f.Name); current != nil && current.Value.String() != f.Value.String() {
+			app.logger.Warn("ignoring change to setting that requires a restart", "setting", f.Name)
+		}
+	})
+
+	app.live.set(cfg)
+	app.logLevel.Set(cfg.logLevel)
+
+	rps, burst := app.live.limiter()
+	app.logger.Info("config reloaded", "limiter_rps", rps, "limiter_burst", burst, "log_level", cfg.logLevel.String(), "cors_trusted_origins", cfg.cors.trustedOrigins)
+}
@@ -2,7 +2,11 @@ package main
 
 import (
 	"expvar"
+	"fmt"
 	"net/http"
+	"path"
+	"slices"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/mathiasb/greenlight/internal/data"
@@ -11,31 +15,200 @@ import (
 func (app *application) routes() http.Handler {
 	router := httprouter.New()
 
+	base := app.config.basePath
+
+	router.HandlerFunc(http.MethodGet, base+"/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, base+"/healthcheck/ready", app.readyHandler)
+	router.HandlerFunc(http.MethodGet, base+"/openapi.json", app.openAPIHandler)
+	router.HandlerFunc(http.MethodGet, base+"/docs", app.docsHandler)
+
+	movieRoutes := namedRoutes{
+		"events":   {http.MethodGet: app.requirePermission(data.PermissionRead, app.movieEventsHandler)},
+		"trending": {http.MethodGet: app.requirePermission(data.PermissionRead, app.listTrendingMoviesHandler)},
+		"count":    {http.MethodGet: app.requirePermission(data.PermissionRead, app.countMoviesHandler)},
+		"search":   {http.MethodPost: app.requirePermission(data.PermissionRead, app.searchMoviesHandler)},
+	}
+	movieLookupRoutes := namedRoutes{
+		"by-imdb": {http.MethodGet: app.requirePermission(data.PermissionRead, app.showMovieByIMDbIDHandler)},
+	}
+	// POST /movies/:id is only registered for named routes such as search, as
+	// httprouter won't let /movies/search share a position with
+	// /movies/:id/ratings.
+	movieNamedOnly := []string{http.MethodPost}
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
-	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+	router.MethodNotAllowed = app.withNamedRoutesAllow(router, base+"/movies/", movieRoutes, movieNamedOnly, app.methodNotAllowedResponse)
+	router.GlobalOPTIONS = app.withNamedRoutesAllow(router, base+"/movies/", movieRoutes, movieNamedOnly, app.optionsHandler)
+
+	router.HandlerFunc(http.MethodGet, base+"/movies", app.requirePermission(data.PermissionRead, app.listMoviesHandler))
+	router.HandlerFunc(http.MethodHead, base+"/movies", app.requirePermission(data.PermissionRead, app.head(app.listMoviesHandler)))
+	router.HandlerFunc(http.MethodPost, base+"/movies", app.requirePermission(data.PermissionWrite, app.idempotent(app.createMovieHandler)))
+	router.HandlerFunc(http.MethodPost, base+"/movies/:id", app.withNamedRoutes(movieRoutes, router.MethodNotAllowed.ServeHTTP))
+	router.HandlerFunc(http.MethodDelete, base+"/movies", app.requirePermission(data.PermissionWrite, app.deleteMoviesHandler))
+	router.HandlerFunc(http.MethodGet, base+"/movies/:id", app.withNamedRoutes(movieRoutes, app.requirePermission(data.PermissionRead, app.showMovieHandler)))
+	router.HandlerFunc(http.MethodGet, base+"/movies/:id/:item", app.withNamedRoutes(movieLookupRoutes, app.withMovieItem("related", app.requirePermission(data.PermissionRead, app.listRelatedMoviesHandler))))
+	// Ratings belong to a user, so they need one even with -public-reads.
+	router.HandlerFunc(http.MethodGet, base+"/movies/:id/:item/me", app.withMovieItem("ratings", app.requireActivatedUser(app.requirePermission(data.PermissionRead, app.showMyRatingHandler))))
+	router.HandlerFunc(http.MethodPost, base+"/movies/:id/:item", app.withMovieItem("ratings", app.requireActivatedUser(app.requirePermission(data.PermissionRead, app.rateMovieHandler))))
+	router.HandlerFunc(http.MethodHead, base+"/movies/:id", app.withNamedRoutes(movieRoutes, app.requirePermission(data.PermissionRead, app.head(app.showMovieHandler))))
+	router.HandlerFunc(http.MethodPatch, base+"/movies/:id", app.withNamedRoutes(movieRoutes, app.requirePermission(data.PermissionWrite, app.withConflictRetry(app.updateMovieHandler))))
+	router.HandlerFunc(http.MethodDelete, base+"/movies/:id", app.withNamedRoutes(movieRoutes, app.requirePermission(data.PermissionWrite, app.deleteMovieHandler)))
 
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, base+"/genres/:genre/movies", app.requirePermission(data.PermissionRead, app.listMoviesByGenreHandler))
 
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission(data.PermissionRead, app.listMoviesHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission(data.PermissionWrite, app.createMovieHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission(data.PermissionRead, app.showMovieHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission(data.PermissionWrite, app.updateMovieHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission(data.PermissionWrite, app.deleteMovieHandler))
+	router.HandlerFunc(http.MethodPost, base+"/users", app.registerUserHandler)
+	router.HandlerFunc(http.MethodPut, base+"/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPost, base+"/users/mfa", app.requireActivatedUser(app.requireUnscopedToken(app.enrollMFAHandler)))
+	router.HandlerFunc(http.MethodPut, base+"/users/mfa/activated", app.requireActivatedUser(app.requireUnscopedToken(app.activateMFAHandler)))
+	router.HandlerFunc(http.MethodGet, base+"/users/me", app.requireAuthenticatedUser(app.requireUnscopedToken(app.showCurrentUserHandler)))
+	router.HandlerFunc(http.MethodDelete, base+"/users/me", app.requireAuthenticatedUser(app.requireUnscopedToken(app.deleteCurrentUserHandler)))
+	router.HandlerFunc(http.MethodGet, base+"/users/me/export", app.requireAuthenticatedUser(app.requireUnscopedToken(app.exportPersonalDataHandler)))
+	router.HandlerFunc(http.MethodGet, base+"/users/me/tokens", app.requireAuthenticatedUser(app.requireUnscopedToken(app.listUserSessionsHandler)))
+	router.HandlerFunc(http.MethodDelete, base+"/users/me/tokens/:hash_prefix", app.requireAuthenticatedUser(app.requireUnscopedToken(app.deleteUserSessionHandler)))
 
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
-	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodGet, base+"/permissions/me", app.showCurrentPermissionsHandler)
 
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodGet, base+"/password-policy", app.showPasswordPolicyHandler)
 
-	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	router.HandlerFunc(http.MethodPost, base+"/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, base+"/tokens/scoped", app.requireActivatedUser(app.createScopedTokenHandler))
+	router.HandlerFunc(http.MethodGet, base+"/tokens/authentication/verify", app.requireAuthenticatedUser(app.verifyAuthenticationTokenHandler))
 
-	return app.metrics(
-		app.recoverPanic(
-			app.enableCORS(
-				app.rateLimit(
-					app.authenticate(router),
+	router.HandlerFunc(http.MethodGet, base+"/admin/audit", app.requirePermission(data.PermissionAdminAudit, app.listAuditLogHandler))
+	router.HandlerFunc(http.MethodGet, base+"/admin/maintenance", app.requirePermission(data.PermissionAdminMaintenance, app.showMaintenanceHandler))
+	router.HandlerFunc(http.MethodPut, base+"/admin/maintenance", app.requirePermission(data.PermissionAdminMaintenance, app.updateMaintenanceHandler))
+	router.HandlerFunc(http.MethodGet, base+"/admin/export", app.requirePermission(data.PermissionAdminExport, app.exportMoviesHandler))
+	router.HandlerFunc(http.MethodPost, base+"/admin/import", app.requirePermission(data.PermissionAdminImport, app.importMoviesHandler))
+	router.HandlerFunc(http.MethodPost, base+"/admin/invites", app.requirePermission(data.PermissionAdminInvite, app.createInviteHandler))
+	router.HandlerFunc(http.MethodPost, base+"/admin/users/:id/activate", app.requirePermission(data.PermissionAdminUsers, app.forceActivateUserHandler))
+
+	router.HandlerFunc(http.MethodGet, app.rootPath("/debug/vars"), app.protectDebug(expvar.Handler()))
+	if app.config.enablePprof {
+		router.HandlerFunc(http.MethodGet, app.rootPath("/debug/pprof/*item"), app.protectDebug(http.HandlerFunc(app.pprofHandler)))
+		router.HandlerFunc(http.MethodPost, app.rootPath("/debug/pprof/*item"), app.protectDebug(http.HandlerFunc(app.pprofHandler)))
+	}
+
+	return app.requestID(
+		app.logBodies(
+			app.secureHeaders(
+				app.metrics(
+					app.recoverPanic(
+						app.enableCORS(
+							app.maintenanceMode(
+								app.rateLimit(
+									app.timeout(
+										app.authenticate(
+											app.negotiateVersion(
+												app.negotiateContentType(router),
+											),
+										),
+									),
+								),
+							),
+						),
+					),
 				),
 			),
 		),
 	)
 }
+
+// optionsHandler answers OPTIONS requests for any route. httprouter looks up
+// the methods registered for the path and sets the Allow header before calling
+// it. CORS preflight requests are answered earlier, by enableCORS.
+func (app *application) optionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// httprouter doesn't allow a static segment such as /v1/movies/events to share
+// a position with the :id wildcard, so those routes are dispatched by name from
+// the wildcard route instead. namedRoutes maps each name to its handler for
+// each method.
+type namedRoutes map[string]map[string]http.HandlerFunc
+
+func (app *application) withNamedRoutes(routes namedRoutes, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := httprouter.ParamsFromContext(r.Context()).ByName("id")
+		if methods, ok := routes[name]; ok {
+			if route, ok := methods[r.Method]; ok {
+				route(w, r)
+				return
+			}
+			w.Header().Set("Allow", routes.allow(name))
+			app.methodNotAllowedResponse(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// withMovieItem serves the /movies/:id/:item route for a single item, such as
+// related, and answers 404 for any other. The item is a wildcard so that
+// named routes like /movies/by-imdb/:imdb_id can share the position.
+func (app *application) withMovieItem(item string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if httprouter.ParamsFromContext(r.Context()).ByName("item") != item {
+			app.notFoundResponse(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// withNamedRoutesAllow corrects the Allow header that httprouter sets for a
+// named route under prefix, which otherwise lists the wildcard route's methods.
+// For any other name it leaves out the namedOnly methods, which the wildcard
+// route only takes for named routes.
+func (app *application) withNamedRoutesAllow(router *httprouter.Router, prefix string, routes namedRoutes, namedOnly []string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, ok := strings.CutPrefix(r.URL.Path, prefix)
+		if _, named := routes[name]; ok && named {
+			w.Header().Set("Allow", routes.allow(name))
+		} else if ok && name != "" && !strings.Contains(name, "/") {
+			w.Header().Set("Allow", allowedMethods(router, r.URL.Path, namedOnly))
+		}
+		next(w, r)
+	}
+}
+
+// allowedMethods returns the Allow header for a path in the same form as
+// httprouter's, leaving out the skipped methods.
+func allowedMethods(router *httprouter.Router, path string, skip []string) string {
+	methods := []string{http.MethodOptions}
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		if slices.Contains(skip, method) {
+			continue
+		}
+		if handle, _, _ := router.Lookup(method, path); handle != nil {
+			methods = append(methods, method)
+		}
+	}
+	slices.Sort(methods)
+	return strings.Join(methods, ", ")
+}
+
+// allow returns the Allow header for a named route, in the same form as
+// httprouter's.
+func (routes namedRoutes) allow(name string) string {
+	methods := []string{http.MethodOptions}
+	for method := range routes[name] {
+		methods = append(methods, method)
+	}
+	slices.Sort(methods)
+	return strings.Join(methods, ", ")
+}
+
+// apiPath returns the path of a versioned API resource, under the configured
+// base path.
+func (app *application) apiPath(format string, args ...any) string {
+	return app.config.basePath + fmt.Sprintf(format, args...)
+}
+
+// rootPath returns the path of a route that lives outside the versioned API,
+// such as /debug/vars. These are mounted relative to the parent of the base
+// path, so -base-path=/api/v1 serves them under /api.
+func (app *application) rootPath(p string) string {
+	if app.config.basePath == "" {
+		return p
+	}
+	return strings.TrimSuffix(path.Dir(app.config.basePath), "/") + p
+}
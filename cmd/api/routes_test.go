@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOptionsAllow(t *testing.T) {
+	routes := newTestRoutes(t)
+
+	tests := []struct {
+		name      string
+		path      string
+		wantAllow string
+	}{
+		{"movie", "/v1/movies/1", "DELETE, GET, HEAD, OPTIONS, PATCH"},
+		{"movies", "/v1/movies", "DELETE, GET, HEAD, OPTIONS, POST"},
+		{"named movie route", "/v1/movies/search", "OPTIONS, POST"},
+		{"current user", "/v1/users/me", "DELETE, GET, OPTIONS"},
+		{"healthcheck", "/v1/healthcheck", "GET, OPTIONS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			routes.ServeHTTP(rr, httptest.NewRequest(http.MethodOptions, tt.path, nil))
+
+			if rr.Code != http.StatusNoContent {
+				t.Errorf("got status %d; want %d", rr.Code, http.StatusNoContent)
+			}
+			if got := rr.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("got Allow %q; want %q", got, tt.wantAllow)
+			}
+		})
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	routes := newTestRoutes(t)
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		wantAllow string
+	}{
+		{"movie", http.MethodPut, "/v1/movies/1", "DELETE, GET, HEAD, OPTIONS, PATCH"},
+		{"movies", http.MethodPut, "/v1/movies", "DELETE, GET, HEAD, OPTIONS, POST"},
+		{"named movie route", http.MethodGet, "/v1/movies/search", "OPTIONS, POST"},
+		{"healthcheck", http.MethodPost, "/v1/healthcheck", "GET, OPTIONS"},
+		{"readiness", http.MethodDelete, "/v1/healthcheck/ready", "GET, OPTIONS"},
+		// POST /movies/:id is only registered for named routes, so it's
+		// left out for a movie ID.
+		{"post to movie", http.MethodPost, "/v1/movies/1", "DELETE, GET, HEAD, OPTIONS, PATCH"},
+		{"get-only named movie route", http.MethodPost, "/v1/movies/events", "GET, OPTIONS"},
+		{"get-only named movie route with delete", http.MethodDelete, "/v1/movies/trending", "GET, OPTIONS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			routes.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if rr.Code != http.StatusMethodNotAllowed {
+				t.Errorf("got status %d; want %d", rr.Code, http.StatusMethodNotAllowed)
+			}
+			if got := rr.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("got Allow %q; want %q", got, tt.wantAllow)
+			}
+
+			var body struct {
+				Error string `json:"error"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if want := "the method is not supported for this resource"; body.Error != want {
+				t.Errorf("got error %q; want %q", body.Error, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/mathiasb/greenlight/internal/data"
+	"github.com/mathiasb/greenlight/internal/validator"
+)
+
+// seedMovies are inserted by -seed for development.
+var seedMovies = []data.Movie{
+	{Title: "Casablanca", Year: 1942, Runtime: 102, Genres: []string{"drama", "romance", "war"}},
+	{Title: "Seven Samurai", Year: 1954, Runtime: 207, Genres: []string{"action", "drama"}},
+	{Title: "Alien", Year: 1979, Runtime: 117, Genres: []string{"horror", "sci-fi"}},
+	{Title: "The Princess Bride", Year: 1987, Runtime: 98, Genres: []string{"adventure", "comedy", "fantasy"}},
+	{Title: "Spirited Away", Year: 2001, Runtime: 125, Genres: []string{"animation", "fantasy"}},
+	{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure", "comedy"}},
+}
+
+// seed creates an activated admin user with every permission and a few sample
+// movies, printing the admin's generated password. Records that already exist
+// are left alone, so it's safe to run more than once.
+func (app *application) seed() error {
+	admin, password, err := app.seedAdmin(app.config.seed.adminEmail)
+	switch {
+	case errors.Is(err, data.ErrDuplicateEmail):
+		fmt.Printf("Admin user %s already exists\n", app.config.seed.adminEmail)
+	case err != nil:
+		return err
+	default:
+		fmt.Printf("Created admin user:\n\temail:\t\t%s\n\tpassword:\t%s\n", admin.Email, password)
+	}
+
+	created := 0
+	for _, movie := range seedMovies {
+		err := app.models.Movies.Insert(&movie)
+		switch {
+		case errors.Is(err, data.ErrDuplicateMovie):
+			continue
+		case err != nil:
+			return err
+		}
+		created++
+	}
+	fmt.Printf("Created %d of %d sample movies\n", created, len(seedMovies))
+
+	return nil
+}
+
+func (app *application) seedAdmin(email string) (*data.User, string, error) {
+	user := &data.User{
+		Name:      "Admin",
+		Email:     email,
+		Activated: true,
+	}
+
+	// A random password almost always meets the policy on the first try, but
+	// it might not contain every required class of character.
+	var password string
+	for attempt := 0; ; attempt++ {
+		if attempt == 10 {
+			return nil, "", errors.New("unable to generate an admin password that meets the password policy")
+		}
+
+		b := make([]byte, 18)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, "", err
+		}
+		password = base64.RawURLEncoding.EncodeToString(b)
+
+		err = user.Password.Set(password, app.models.Users.Hasher)
+		if err != nil {
+			return nil, "", err
+		}
+
+		v := validator.New()
+		data.ValidateUser(v, user, app.models.Users.Hasher, app.models.Users.PasswordPolicy)
+		if v.Valid() {
+			break
+		}
+		if _, ok := v.FieldErrors["password"]; !ok {
+			return nil, "", fmt.Errorf("invalid admin user: %v", v.FieldErrors)
+		}
+	}
+
+	err := app.models.Users.Insert(user)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = app.models.Permissions.AddForUser(user.ID, data.AllPermissions...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return user, password, nil
+}
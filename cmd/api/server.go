@@ -23,6 +23,16 @@ func (app *application) serve() error {
 		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
 	}
 
+	srv.RegisterOnShutdown(app.events.close)
+	srv.RegisterOnShutdown(app.views.close)
+
+	app.background(func() {
+		app.flushViews(app.config.viewFlushInterval)
+	})
+
+	app.listenForMaintenanceSignal()
+	app.listenForReloadSignal()
+
 	shutdownError := make(chan error)
 	go func() {
 		// Create a 'quit' channel that takes os.Signal values
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// newTestApplication returns an application configured with the flag
+// defaults, which tests can adjust, and a logger that discards its output.
+// The rate limiter is disabled, as every test request comes from the same
+// address. It has no database, so only code paths that don't reach the
+// models can be exercised.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	var cfg config
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	defineFlags(fs, &cfg)
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	cfg.limiter.enabled = false
+
+	app := &application{
+		config:              cfg,
+		logger:              slog.New(slog.NewTextHandler(io.Discard, nil)),
+		events:              newMovieEventHub(),
+		views:               newViewCounter(),
+		personalDataExports: newExportLimiter(),
+	}
+	app.live.set(cfg)
+
+	return app
+}
+
+var (
+	testRoutesOnce sync.Once
+	testRoutes     http.Handler
+)
+
+// newTestRoutes returns the routes of an application from
+// newTestApplication. It's built once and shared, as routes publishes the
+// request metrics, which can only be published once per process.
+func newTestRoutes(t *testing.T) http.Handler {
+	t.Helper()
+
+	testRoutesOnce.Do(func() {
+		testRoutes = newTestApplication(t).routes()
+	})
+	return testRoutes
+}
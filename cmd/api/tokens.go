@@ -1,18 +1,47 @@
 package main
 
 import (
+	"encoding/hex"
 	"errors"
 	"net/http"
+	"regexp"
+	"strconv"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/julienschmidt/httprouter"
 	"github.com/mathiasb/greenlight/internal/data"
 	"github.com/mathiasb/greenlight/internal/validator"
 )
 
+const (
+	tokenModeStateful = "stateful"
+	tokenModeJWT      = "jwt"
+)
+
+const maxDeviceLabelLength = 200
+
+var errInvalidJWT = errors.New("invalid jwt")
+
+var hashPrefixRX = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// jwtClaims are the claims carried by stateless authentication tokens. The
+// activation status is included so that requireActivatedUser can be enforced
+// without a database lookup, and the permissions of a scoped token so that
+// permissionsFor can limit it.
+type jwtClaims struct {
+	Scope       string           `json:"scope"`
+	Activated   bool             `json:"activated"`
+	Permissions data.Permissions `json:"permissions,omitempty"`
+	jwt.RegisteredClaims
+}
+
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email       string `json:"email"`
+		Password    string `json:"password"`
+		TOTPCode    string `json:"totp_code"`
+		DeviceLabel string `json:"device_label"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -24,10 +53,11 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	v := validator.New()
 
 	data.ValidateEmail(v, input.Email)
-	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidatePasswordPlaintext(v, input.Password, app.models.Users.Hasher)
+	v.Check(validator.MaxRunes(input.DeviceLabel, maxDeviceLabelLength), "device_label", validator.CodeTooLong, "must not be more than 200 characters long")
 
 	if !v.Valid() {
-		app.failedValidationResponse(w, r, v.FieldErrors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
@@ -35,6 +65,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			app.models.Users.MatchesDummyPassword(input.Password)
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -53,13 +84,266 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	if user.MFAEnabled {
+		if data.ValidateTOTPCode(v, input.TOTPCode); !v.Valid() {
+			app.failedValidationResponse(w, r, v)
+			return
+		}
+
+		ok, err := app.models.Users.ConsumeTOTP(user, input.TOTPCode)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !ok {
+			app.invalidCredentialsResponse(w, r)
+			return
+		}
+	}
+
+	if user.Password.NeedsRehash(app.models.Users.Hasher) {
+		err = user.Password.Set(input.Password, app.models.Users.Hasher)
+		if err == nil {
+			err = app.models.Users.Update(user)
+		}
+		// A password too long for the new scheme keeps its old hash.
+		if err != nil && !errors.Is(err, data.ErrPasswordTooLong) {
+			app.logger.Error("unable to upgrade password hash", "error", err, "user_id", user.ID)
+		}
+	}
+
+	err = app.models.Users.RecordLogin(user, app.clientIP(r))
+	if err != nil {
+		app.logger.Error("unable to record login", "error", err, "user_id", user.ID)
+	}
+
+	deviceLabel := input.DeviceLabel
+	if deviceLabel == "" {
+		deviceLabel = truncateRunes(r.UserAgent(), maxDeviceLabelLength)
+	}
+
+	token, err := app.newAuthenticationToken(user, deviceLabel, app.clientIP(r), nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createScopedTokenHandler issues the authenticated user a token limited to
+// the requested permissions, for single-purpose integrations. Only
+// permissions the caller holds can be requested, so a scoped token can't mint
+// a wider one. Permissions later removed from the user are dropped from the
+// token too, as requests are checked against both.
+func (app *application) createScopedTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Permissions data.Permissions `json:"permissions"`
+		DeviceLabel string           `json:"device_label"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	granted, err := app.permissionsFor(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPermissions(v, input.Permissions)
+	for _, code := range input.Permissions {
+		if data.AllPermissions.Include(code) {
+			v.Check(granted.Include(code), "permissions", validator.CodeNotPermitted, "must only contain permissions you hold")
+		}
+	}
+	v.Check(validator.MaxRunes(input.DeviceLabel, maxDeviceLabelLength), "device_label", validator.CodeTooLong, "must not be more than 200 characters long")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	deviceLabel := input.DeviceLabel
+	if deviceLabel == "" {
+		deviceLabel = truncateRunes(r.UserAgent(), maxDeviceLabelLength)
+	}
+
+	token, err := app.newAuthenticationToken(user, deviceLabel, app.clientIP(r), input.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusCreated, envelope{"authentication_token": token}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// newAuthenticationToken issues the user an authentication token of the kind
+// set by -token-mode, scoped to permissions unless they're nil.
+func (app *application) newAuthenticationToken(user *data.User, deviceLabel, ip string, permissions data.Permissions) (*data.Token, error) {
+	if app.config.token.mode == tokenModeJWT {
+		return app.newJWT(user, 24*time.Hour, deviceLabel, ip, permissions)
+	}
+	return app.models.Tokens.NewAuthentication(user.ID, 24*time.Hour, deviceLabel, ip, permissions)
+}
+
+// newJWT issues a signed authentication token for the user. When revocation
+// checks are enabled a matching row is also stored in the tokens table, keyed
+// by the JWT ID, so that the token can be revoked before it expires. The ID is
+// the stored token's hex SHA-256 hash rather than its plaintext, as anyone
+// holding the JWT can read its claims.
+func (app *application) newJWT(user *data.User, ttl time.Duration, deviceLabel, ip string, permissions data.Permissions) (*data.Token, error) {
+	now := time.Now()
+
+	claims := jwtClaims{
+		Scope:       data.ScopeAuthentication,
+		Activated:   user.Activated,
+		Permissions: permissions,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatInt(user.ID, 10),
+			Issuer:    "greenlight",
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+
+	if app.config.token.jwtRevocationCheck {
+		stored, err := app.models.Tokens.NewAuthentication(user.ID, ttl, deviceLabel, ip, permissions)
+		if err != nil {
+			return nil, err
+		}
+		claims.ID = hex.EncodeToString(stored.Hash)
+	}
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(app.config.token.jwtSecret))
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.Token{
+		Plaintext:   signed,
+		UserID:      user.ID,
+		Expiry:      claims.ExpiresAt.Time,
+		Scope:       data.ScopeAuthentication,
+		Permissions: permissions,
+	}, nil
+}
+
+// userForJWT verifies a stateless authentication token and returns the user
+// it was issued to. Unless revocation checks are enabled the returned user
+// only carries the ID and activation status from the claims.
+func (app *application) userForJWT(tokenString string) (*data.User, error) {
+	var claims jwtClaims
+
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(t *jwt.Token) (any, error) {
+		return []byte(app.config.token.jwtSecret), nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}),
+		jwt.WithIssuer("greenlight"),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil || claims.Scope != data.ScopeAuthentication {
+		return nil, errInvalidJWT
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return nil, errInvalidJWT
+	}
+
+	if app.config.token.jwtRevocationCheck {
+		tokenHash, err := hex.DecodeString(claims.ID)
+		if err != nil {
+			return nil, errInvalidJWT
+		}
+
+		user, err := app.models.Users.GetForTokenHash(data.ScopeAuthentication, tokenHash)
+		if err != nil {
+			return nil, err
+		}
+		if user.ID != userID {
+			return nil, errInvalidJWT
+		}
+		return user, nil
+	}
+
+	return &data.User{ID: userID, Activated: claims.Activated, TokenExpiry: claims.ExpiresAt.Time, TokenPermissions: claims.Permissions}, nil
+}
+
+// verifyAuthenticationTokenHandler describes the token the request was
+// authenticated with, so clients can check it without side effects. Invalid
+// tokens never get this far, as authenticate answers them with 401.
+func (app *application) verifyAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	token := map[string]any{
+		"user_id":    user.ID,
+		"expiry":     user.TokenExpiry,
+		"expires_in": int64(time.Until(user.TokenExpiry).Seconds()),
+	}
+	if user.TokenPermissions != nil {
+		token["permissions"] = user.TokenPermissions
+	}
+
+	err := app.writeJSON(w, r, http.StatusOK, envelope{"token": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listUserSessionsHandler lists the authenticated user's active sessions. In
+// JWT mode tokens are only stored, and so listed, when revocation checks are
+// enabled.
+func (app *application) listUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteUserSessionHandler(w http.ResponseWriter, r *http.Request) {
+	hashPrefix := httprouter.ParamsFromContext(r.Context()).ByName("hash_prefix")
+	if !hashPrefixRX.MatchString(hashPrefix) {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err := app.models.Tokens.DeleteSessionForUser(user.ID, hashPrefix)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
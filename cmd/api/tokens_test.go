@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mathiasb/greenlight/internal/data"
+)
+
+func TestUserForJWT(t *testing.T) {
+	const secret = "0123456789abcdef0123456789abcdef"
+
+	sign := func(t *testing.T, id, key string) string {
+		now := time.Now()
+		claims := jwtClaims{
+			Scope:     data.ScopeAuthentication,
+			Activated: true,
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        id,
+				Subject:   strconv.FormatInt(42, 10),
+				Issuer:    "greenlight",
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+			},
+		}
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	tests := []struct {
+		name            string
+		revocationCheck bool
+		token           func(t *testing.T) string
+		wantErr         error
+		wantUserID      int64
+		wantActivated   bool
+	}{
+		{
+			name:          "stateless",
+			token:         func(t *testing.T) string { return sign(t, "", secret) },
+			wantUserID:    42,
+			wantActivated: true,
+		},
+		{
+			name:    "wrong key",
+			token:   func(t *testing.T) string { return sign(t, "", "another secret") },
+			wantErr: errInvalidJWT,
+		},
+		{
+			// A plaintext token ID, as issued before the ID became the
+			// token's hash, is rejected without a lookup.
+			name:            "ID is not a hash",
+			revocationCheck: true,
+			token:           func(t *testing.T) string { return sign(t, "ABCDEFGHIJKLMNOPQRSTUVWXYZ", secret) },
+			wantErr:         errInvalidJWT,
+		},
+		{
+			name:    "garbage",
+			token:   func(t *testing.T) string { return "not.a.jwt" },
+			wantErr: errInvalidJWT,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.token.jwtSecret = secret
+			app.config.token.jwtRevocationCheck = tt.revocationCheck
+
+			user, err := app.userForJWT(tt.token(t))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if user.ID != tt.wantUserID || user.Activated != tt.wantActivated {
+				t.Errorf("got user %d (activated %t); want %d (activated %t)", user.ID, user.Activated, tt.wantUserID, tt.wantActivated)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mathiasb/greenlight/internal/data"
+)
+
+// trendingTTL is how long the trending list is served from memory. View counts
+// are only flushed every -view-flush-interval anyway.
+const trendingTTL = 30 * time.Second
+
+type trendingCache struct {
+	mu      sync.Mutex
+	movies  []*data.Movie
+	expires time.Time
+}
+
+// listTrendingMoviesHandler lists the -trending-limit most viewed movies.
+func (app *application) listTrendingMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	app.trending.mu.Lock()
+	movies := app.trending.movies
+	fresh := time.Now().Before(app.trending.expires)
+	app.trending.mu.Unlock()
+
+	if !fresh {
+		var err error
+		movies, err = app.models.Movies.GetMostViewed(r.Context(), app.config.trendingLimit)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.trending.mu.Lock()
+		app.trending.movies = movies
+		app.trending.expires = time.Now().Add(trendingTTL)
+		app.trending.mu.Unlock()
+	}
+
+	err := app.writeCacheableJSON(w, r, app.config.cacheControl.list, envelope{"movies": app.moviesResponse(r, movies)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
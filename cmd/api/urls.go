@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mathiasb/greenlight/internal/data"
+)
+
+// fromTrustedProxy reports whether the request came directly from one of the
+// proxies configured with -trusted-proxies. Forwarding headers are only
+// honoured for these, since anyone else can set them to anything.
+func (app *application) fromTrustedProxy(r *http.Request) bool {
+	addr, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	return app.isTrustedProxy(addr.Addr())
+}
+
+// clientIP returns the IP address of the client that made the request. Behind
+// a trusted proxy it's the last address in X-Forwarded-For that isn't itself a
+// trusted proxy.
+func (app *application) clientIP(r *http.Request) string {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+
+	if !app.fromTrustedProxy(r) {
+		return remoteIP
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		if !app.isTrustedProxy(addr) {
+			return addr.String()
+		}
+	}
+
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		return realIP
+	}
+	return remoteIP
+}
+
+func (app *application) isTrustedProxy(addr netip.Addr) bool {
+	return containsAddr(app.config.trustedProxies, addr)
+}
+
+// containsAddr reports whether any of the prefixes contains addr.
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefixes parses a space separated list of IP addresses and CIDR
+// ranges, treating each address as a range holding only itself.
+func parsePrefixes(val string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Fields(val) {
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(field)
+			if addrErr != nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR range", field)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// externalScheme returns the scheme the client used to reach this server,
+// taken from X-Forwarded-Proto when the request came through a trusted proxy.
+func (app *application) externalScheme(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	if app.fromTrustedProxy(r) {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+	}
+	return scheme
+}
+
+// externalURL returns the absolute URL that clients use to reach path on this
+// server. The scheme and host come from X-Forwarded-Proto and X-Forwarded-Host
+// when the request came through a trusted proxy, and from the request itself
+// otherwise.
+func (app *application) externalURL(r *http.Request, path string) string {
+	scheme := app.externalScheme(r)
+	host := r.Host
+
+	if app.fromTrustedProxy(r) {
+		if forwardedHost := r.Header.Get("X-Forwarded-Host"); forwardedHost != "" {
+			host = strings.TrimSpace(strings.Split(forwardedHost, ",")[0])
+		}
+	}
+
+	return fmt.Sprintf("%s://%s%s", scheme, host, path)
+}
+
+// paginationLinks returns absolute links to the first, previous, next and last
+// pages of the current listing, keeping all other query string parameters.
+func (app *application) paginationLinks(r *http.Request, metadata data.Metadata) map[string]string {
+	links := map[string]string{}
+	if metadata.TotalRecords == 0 {
+		return links
+	}
+
+	link := func(page int) string {
+		qs := r.URL.Query()
+		qs.Set("page", strconv.Itoa(page))
+		u := url.URL{Path: r.URL.Path, RawQuery: qs.Encode()}
+		return app.externalURL(r, u.RequestURI())
+	}
+
+	links["first"] = link(metadata.FirstPage)
+	links["last"] = link(metadata.LastPage)
+	if metadata.CurrentPage > metadata.FirstPage {
+		links["prev"] = link(metadata.CurrentPage - 1)
+	}
+	if metadata.CurrentPage < metadata.LastPage {
+		links["next"] = link(metadata.CurrentPage + 1)
+	}
+	return links
+}
@@ -1,19 +1,35 @@
 package main
 
 import (
+	"database/sql"
 	"errors"
+	"fmt"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/mathiasb/greenlight/internal/data"
 	"github.com/mathiasb/greenlight/internal/validator"
 )
 
+// userActivated is audited when an operator activates a user.
+const userActivated = "user.activated"
+
+// userDeleted is audited when a user deletes their account.
+const userDeleted = "user.deleted"
+
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
+	if app.config.registration == registrationClosed {
+		app.registrationClosedResponse(w, r)
+		return
+	}
+
 	var input struct {
-		Name     string `json:"name"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Name        string `json:"name"`
+		Email       string `json:"email"`
+		Password    string `json:"password"`
+		InviteToken string `json:"invite_token"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -22,40 +38,91 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// Without -require-activation, there's nothing for the user to confirm.
 	user := &data.User{
 		Name:      input.Name,
 		Email:     input.Email,
-		Activated: false,
+		Activated: !app.config.requireActivation,
 	}
 
-	err = user.Password.Set(input.Password)
-	if err != nil {
+	err = user.Password.Set(input.Password, app.models.Users.Hasher)
+	if err != nil && !errors.Is(err, data.ErrPasswordTooLong) {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
 	v := validator.New()
 
-	if data.ValidateUser(v, user); !v.Valid() {
-		app.failedValidationResponse(w, r, v.FieldErrors)
+	if app.config.registration == registrationInvite {
+		v.Check(input.InviteToken != "", "invite_token", validator.CodeRequired, "must be provided")
+	}
+
+	if data.ValidateUser(v, user, app.models.Users.Hasher, app.models.Users.PasswordPolicy); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
-	err = app.models.Users.Insert(user)
+	// The invite is redeemed in the transaction that inserts the user, so that
+	// it can only be used once, and is kept if the registration fails.
+	var invite *data.Invite
+	permissions := data.Permissions{data.PermissionRead}
+
+	err = app.withTx(r.Context(), func(tx *sql.Tx) error {
+		var err error
+
+		if app.config.registration == registrationInvite {
+			invite, err = app.models.Invites.RedeemTx(tx, input.InviteToken)
+			if err != nil {
+				return err
+			}
+
+			if invite.Email != "" && !strings.EqualFold(invite.Email, user.Email) {
+				return errInviteEmailMismatch
+			}
+
+			for _, code := range invite.Permissions {
+				if !permissions.Include(code) {
+					permissions = append(permissions, code)
+				}
+			}
+		}
+
+		err = app.models.Users.InsertTx(tx, user)
+		if err != nil {
+			return err
+		}
+
+		return app.models.Permissions.AddForUserTx(tx, user.ID, permissions...)
+	})
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("invite_token", validator.CodeInvalid, "invalid or expired invite token")
+			app.failedValidationResponse(w, r, v)
+		case errors.Is(err, errInviteEmailMismatch):
+			v.AddError("invite_token", validator.CodeInvalid, "was issued for a different email address")
+			app.failedValidationResponse(w, r, v)
 		case errors.Is(err, data.ErrDuplicateEmail):
-			v.AddError("email", "a user with this email address already exists")
-			app.failedValidationResponse(w, r, v.FieldErrors)
+			v.AddError("email", validator.CodeAlreadyExists, "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
+	for _, code := range permissions {
+		app.audit(r, "permission.granted", fmt.Sprintf("user:%d:%s", user.ID, code))
+	}
+	if invite != nil {
+		app.audit(r, inviteRedeemed, fmt.Sprintf("user:%d", user.ID))
+	}
 
-	err = app.models.Permissions.AddForUser(user.ID, data.PermissionRead)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
+	if user.Activated {
+		err = app.writeJSON(w, r, http.StatusCreated, envelope{"user": user}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
 
 	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
@@ -75,7 +142,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		}
 	})
 
-	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
+	err = app.writeJSON(w, r, http.StatusAccepted, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -94,7 +161,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	v := validator.New()
 
 	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
-		app.failedValidationResponse(w, r, v.FieldErrors)
+		app.failedValidationResponse(w, r, v)
 		return
 	}
 
@@ -102,15 +169,105 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("token", "invalid or expired activation token")
-			app.failedValidationResponse(w, r, v.FieldErrors) // not like in the book on in chapter 14.4 ...
+			v.AddError("token", validator.CodeInvalid, "invalid or expired activation token")
+			app.failedValidationResponse(w, r, v) // not like in the book on in chapter 14.4 ...
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
+
+	err = app.activateUser(r, user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// activateUser marks the user as activated and deletes their activation
+// tokens, in one transaction so that neither happens without the other.
+func (app *application) activateUser(r *http.Request, user *data.User) error {
 	user.Activated = true
 
+	return app.withTx(r.Context(), func(tx *sql.Tx) error {
+		err := app.models.Users.UpdateTx(tx, user)
+		if err != nil {
+			return err
+		}
+
+		return app.models.Tokens.DeleteAllForUserTx(tx, data.ScopeActivation, user.ID)
+	})
+}
+
+// forceActivateUserHandler lets an operator activate a user without the
+// activation token, for when the email carrying it never arrives.
+func (app *application) forceActivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readUserIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.activateUser(r, user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, userActivated, fmt.Sprintf("user:%d", user.ID))
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) enrollMFAHandler(w http.ResponseWriter, r *http.Request) {
+	// Load the full record rather than relying on the request context, which
+	// only holds the claims when stateless tokens are in use.
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user.MFAEnabled {
+		app.badRequestResponse(w, r, errors.New("multi-factor authentication is already enabled"))
+		return
+	}
+
+	uri, err := user.GenerateTOTP("Greenlight")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	err = app.models.Users.Update(user)
 	if err != nil {
 		switch {
@@ -122,13 +279,235 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"otpauth_uri": uri}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) activateMFAHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TOTPCode string `json:"totp_code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTOTPCode(v, input.TOTPCode); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user.TOTPSecret == "" {
+		app.badRequestResponse(w, r, errors.New("multi-factor authentication must be enrolled first"))
+		return
+	}
+
+	ok, err := app.models.Users.ConsumeTOTP(user, input.TOTPCode)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	if !ok {
+		v.AddError("totp_code", validator.CodeInvalid, "invalid or expired code")
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+	user.MFAEnabled = true
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	// In JWT mode the context user only carries what's in the claims.
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteCurrentUserHandler deletes the caller's account and everything they
+// own, once they've re-entered their password, and their TOTP code if they
+// use MFA. Movies they created and audit log entries are kept, no longer
+// linked to the user. In JWT mode without -jwt-revocation-check, tokens
+// already issued stay valid until they expire, but carry no permissions.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+		TOTPCode string `json:"totp_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidatePasswordPlaintext(v, input.Password, app.models.Users.Hasher); !v.Valid() {
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		v.AddError("password", validator.CodeInvalid, "is incorrect")
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	if user.MFAEnabled {
+		if data.ValidateTOTPCode(v, input.TOTPCode); !v.Valid() {
+			app.failedValidationResponse(w, r, v)
+			return
+		}
+
+		ok, err := app.models.Users.ConsumeTOTP(user, input.TOTPCode)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !ok {
+			v.AddError("totp_code", validator.CodeInvalid, "invalid or expired code")
+			app.failedValidationResponse(w, r, v)
+			return
+		}
+	}
+
+	var ratedMovieIDs []int64
+
+	err = app.withTx(r.Context(), func(tx *sql.Tx) error {
+		ratedMovieIDs, err = app.models.Ratings.DeleteAllForUserTx(tx, user.ID)
+		if err != nil {
+			return err
+		}
+
+		return app.models.Users.DeleteTx(tx, user)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Cached movies would otherwise keep showing averages with their ratings.
+	app.movieCache.invalidate(ratedMovieIDs...)
+
+	// The entry can't reference a user that no longer exists.
+	app.audit(app.contextSetUser(r, data.AnonymousUser), userDeleted, fmt.Sprintf("user:%d", user.ID))
+
+	app.background(func() {
+		data := map[string]any{
+			"name": user.Name,
+		}
+		err := app.mailer.Send(user.Email, "user_deleted.tmpl", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	err = app.writeJSON(w, r, http.StatusOK, envelope{"message": "account successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showCurrentPermissionsHandler lists the permissions that requirePermission
+// would grant the caller, so that clients can hide actions they can't take.
+// Anonymous users, and unactivated ones while -require-activation is on, hold
+// none, apart from movies:read with -public-reads.
+func (app *application) showCurrentPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	permissions := data.Permissions{}
+	if !user.IsAnonymous() && (user.Activated || !app.config.requireActivation) {
+		granted, err := app.permissionsFor(user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		permissions = append(permissions, granted...)
+	}
+
+	if app.config.publicReads && !permissions.Include(data.PermissionRead) {
+		permissions = append(permissions, data.PermissionRead)
+	}
+	slices.Sort(permissions)
+
+	err := app.writeJSON(w, r, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showPasswordPolicyHandler describes the rules for new passwords so that
+// clients can show them before the user submits a form.
+func (app *application) showPasswordPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	policy := struct {
+		data.PasswordPolicy
+		RejectsCompromised bool `json:"rejects_compromised"`
+	}{
+		PasswordPolicy:     app.models.Users.PasswordPolicy,
+		RejectsCompromised: app.models.Users.PasswordPolicy.Checker != nil,
+	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	err := app.writeJSON(w, r, http.StatusOK, envelope{"password_policy": policy}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
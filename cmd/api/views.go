@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// viewCounter tallies movie views in memory so that showMovieHandler doesn't
+// wait on a database write. The tallies are written out every
+// -view-flush-interval by flushViews, and once more on shutdown.
+type viewCounter struct {
+	mu     sync.Mutex
+	counts map[int64]int64
+	done   chan struct{}
+}
+
+func newViewCounter() *viewCounter {
+	return &viewCounter{counts: make(map[int64]int64), done: make(chan struct{})}
+}
+
+func (c *viewCounter) add(id int64) {
+	c.mu.Lock()
+	c.counts[id]++
+	c.mu.Unlock()
+}
+
+// take returns the views counted since the last call and starts a new tally.
+func (c *viewCounter) take() map[int64]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := c.counts
+	c.counts = make(map[int64]int64)
+	return counts
+}
+
+// restore adds back views that couldn't be written, so they're retried on the
+// next flush.
+func (c *viewCounter) restore(counts map[int64]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, n := range counts {
+		c.counts[id] += n
+	}
+}
+
+// close stops flushViews after a final flush. It's registered to run when the
+// server shuts down.
+func (c *viewCounter) close() {
+	close(c.done)
+}
+
+// flushViews writes the tallied views to the database until the view counter
+// is closed.
+func (app *application) flushViews(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			app.flushViewsOnce()
+		case <-app.views.done:
+			app.flushViewsOnce()
+			return
+		}
+	}
+}
+
+func (app *application) flushViewsOnce() {
+	counts := app.views.take()
+	if len(counts) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	failed, err := app.models.Movies.AddViews(ctx, counts)
+	if err != nil {
+		app.logger.Error("unable to record movie views", "error", err.Error(), "movies", len(failed))
+		app.views.restore(failed)
+	}
+
+	for id := range failed {
+		delete(counts, id)
+	}
+	app.movieCache.addViews(counts)
+}
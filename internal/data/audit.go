@@ -0,0 +1,118 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID    *int64    `json:"user_id"`
+	Action    string    `json:"action"`
+	Resource  string    `json:"resource"`
+	RequestID string    `json:"request_id"`
+}
+
+type AuditModel struct {
+	DB *DB
+}
+
+func (m AuditModel) Insert(entry *AuditEntry) error {
+	query := `
+	INSERT INTO audit_log (user_id, action, resource, request_id)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id, created_at`
+
+	args := []any{entry.UserID, entry.Action, entry.Resource, entry.RequestID}
+
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&entry.ID, &entry.CreatedAt)
+}
+
+func (m AuditModel) GetAll(action string, filters Filters) ([]*AuditEntry, Metadata, error) {
+	query := fmt.Sprintf(`
+	SELECT count(*) OVER(), id, created_at, user_id, action, resource, request_id
+	FROM audit_log
+	WHERE (action = $1 OR $1 = '')
+	ORDER BY %s %s, id ASC
+	LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, action, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := []*AuditEntry{}
+
+	for rows.Next() {
+		var entry AuditEntry
+
+		err = rows.Scan(
+			&totalRecords,
+			&entry.ID,
+			&entry.CreatedAt,
+			&entry.UserID,
+			&entry.Action,
+			&entry.Resource,
+			&entry.RequestID)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return entries, metadata, nil
+}
+
+// EachForUser calls fn for every audit entry recording an action by the user,
+// oldest first, as the rows are read from the database. Iteration stops at
+// the first error returned by fn, or when ctx is cancelled.
+func (m AuditModel) EachForUser(ctx context.Context, userID int64, fn func(*AuditEntry) error) error {
+	query := `
+	SELECT id, created_at, user_id, action, resource, request_id
+	FROM audit_log
+	WHERE user_id = $1
+	ORDER BY id ASC`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry AuditEntry
+
+		err = rows.Scan(
+			&entry.ID,
+			&entry.CreatedAt,
+			&entry.UserID,
+			&entry.Action,
+			&entry.Resource,
+			&entry.RequestID)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
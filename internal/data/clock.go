@@ -0,0 +1,16 @@
+package data
+
+import "time"
+
+// Clock tells the current time. Models hold one so that the time validation
+// is checked against, such as the latest allowed movie year, can be pinned.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock that reads the system time.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
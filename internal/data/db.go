@@ -0,0 +1,162 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// preparedQueries are run on nearly every request, so they're prepared once by
+// Prepare rather than parsed by PostgreSQL each time. Queries whose SQL varies,
+// such as the filtered listings, don't belong here.
+var preparedQueries = []string{
+	getMovieQuery,
+	getPermissionsForUserQuery,
+	getUserForTokenQuery,
+}
+
+// DB wraps a connection pool to log queries that take longer than
+// SlowQueryThreshold, and to run the preparedQueries as prepared statements.
+// Timing a query costs two clock reads; the caller is only looked up for
+// queries that are actually slow.
+type DB struct {
+	*sql.DB
+	Logger             *slog.Logger
+	SlowQueryThreshold time.Duration
+	// QueryTimeout bounds each query, including any wait for a free
+	// connection, so that requests fail rather than queue when the pool is
+	// saturated.
+	QueryTimeout time.Duration
+	// RequestID returns the ID of the request a query's context belongs to,
+	// if any, so slow queries can be matched up with requests.
+	RequestID func(ctx context.Context) string
+
+	// stmts is only written by Prepare, before the DB is shared.
+	stmts map[string]*sql.Stmt
+}
+
+// Querier runs queries. Both *DB and *sql.Tx are Queriers, so model methods
+// that take one can run inside a transaction or outside of one.
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// IsConnectionError reports whether err comes from losing, or failing to make,
+// the connection to PostgreSQL rather than from the query itself, as happens
+// while the database restarts. The pool reconnects by itself once it's back.
+func IsConnectionError(err error) bool {
+	var netErr net.Error
+	var pqErr *pq.Error
+
+	switch {
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.As(err, &netErr):
+		return true
+	case errors.As(err, &pqErr):
+		// Class 08 is connection exceptions; 57P01-57P03 are sent when the
+		// server shuts down or is still starting up.
+		return pqErr.Code.Class() == "08" || pqErr.Code == "57P01" || pqErr.Code == "57P02" || pqErr.Code == "57P03"
+	}
+	return false
+}
+
+func NewDB(db *sql.DB, logger *slog.Logger, slowQueryThreshold, queryTimeout time.Duration) *DB {
+	return &DB{DB: db, Logger: logger, SlowQueryThreshold: slowQueryThreshold, QueryTimeout: queryTimeout}
+}
+
+// withQueryTimeout returns ctx limited to the QueryTimeout, for a model method
+// to run its queries with.
+func (db *DB) withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, db.QueryTimeout)
+}
+
+// Prepare creates the prepared statements for the preparedQueries. It must be
+// called before the DB is used by more than one goroutine.
+func (db *DB) Prepare(ctx context.Context) error {
+	db.stmts = make(map[string]*sql.Stmt, len(preparedQueries))
+
+	for _, query := range preparedQueries {
+		stmt, err := db.DB.PrepareContext(ctx, query)
+		if err != nil {
+			db.closeStmts()
+			return err
+		}
+		db.stmts[query] = stmt
+	}
+	return nil
+}
+
+// Close closes the prepared statements and then the connection pool.
+func (db *DB) Close() error {
+	db.closeStmts()
+	return db.DB.Close()
+}
+
+func (db *DB) closeStmts() {
+	for _, stmt := range db.stmts {
+		stmt.Close()
+	}
+	db.stmts = nil
+}
+
+func (db *DB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	defer db.logIfSlow(ctx, time.Now())
+	if stmt, ok := db.stmts[query]; ok {
+		return stmt.QueryContext(ctx, args...)
+	}
+	return db.DB.QueryContext(ctx, query, args...)
+}
+
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	defer db.logIfSlow(ctx, time.Now())
+	if stmt, ok := db.stmts[query]; ok {
+		return stmt.QueryRowContext(ctx, args...)
+	}
+	return db.DB.QueryRowContext(ctx, query, args...)
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	defer db.logIfSlow(ctx, time.Now())
+	return db.DB.ExecContext(ctx, query, args...)
+}
+
+func (db *DB) logIfSlow(ctx context.Context, start time.Time) {
+	duration := time.Since(start)
+	if db.SlowQueryThreshold <= 0 || duration < db.SlowQueryThreshold || db.Logger == nil {
+		return
+	}
+
+	attrs := []any{"query", queryLabel(), "duration", duration}
+	if db.RequestID != nil {
+		if requestID := db.RequestID(ctx); requestID != "" {
+			attrs = append(attrs, "request_id", requestID)
+		}
+	}
+	db.Logger.Warn("slow query", attrs...)
+}
+
+// queryLabel names the model method that ran the query, e.g. MovieModel.Get.
+func queryLabel() string {
+	// Skip queryLabel, logIfSlow and the QueryContext-style wrapper.
+	pc, _, _, ok := runtime.Caller(3)
+	if !ok {
+		return "unknown"
+	}
+
+	name := runtime.FuncForPC(pc).Name()
+	name = name[strings.LastIndex(name, "/")+1:]
+	name = strings.TrimPrefix(name, "data.")
+	return strings.NewReplacer("(", "", ")", "", "*", "").Replace(name)
+}
@@ -15,19 +15,19 @@ type Filters struct {
 }
 
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int `json:"current_page,omitempty" xml:"current_page,omitempty"`
+	PageSize     int `json:"page_size,omitempty" xml:"page_size,omitempty"`
+	FirstPage    int `json:"first_page,omitempty" xml:"first_page,omitempty"`
+	LastPage     int `json:"last_page,omitempty" xml:"last_page,omitempty"`
+	TotalRecords int `json:"total_records,omitempty" xml:"total_records,omitempty"`
 }
 
 func ValidateFilters(v *validator.Validator, f Filters) {
-	v.Check(f.Page > 0, "page", "must be greater than zero")
-	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
-	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
-	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
-	v.Check(validator.PermittedValue(f.Sort, f.SortSafeList...), "sort", "invalid sort value")
+	v.Check(f.Page > 0, "page", validator.CodeTooSmall, "must be greater than zero")
+	v.Check(f.Page <= 10_000_000, "page", validator.CodeTooLarge, "must be a maximum of 10 million")
+	v.Check(f.PageSize > 0, "page_size", validator.CodeTooSmall, "must be greater than zero")
+	v.Check(f.PageSize <= 100, "page_size", validator.CodeTooLarge, "must be a maximum of 100")
+	v.Check(validator.PermittedValue(f.Sort, f.SortSafeList...), "sort", validator.CodeNotPermitted, "invalid sort value")
 }
 
 func (f Filters) sortColumn() string {
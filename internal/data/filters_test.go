@@ -0,0 +1,36 @@
+package data
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/mathiasb/greenlight/internal/validator"
+)
+
+func TestValidateFiltersCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters Filters
+		want    map[string]string
+	}{
+		{"valid", Filters{Page: 1, PageSize: 20, Sort: "id"}, map[string]string{}},
+		{"page zero", Filters{Page: 0, PageSize: 20, Sort: "id"}, map[string]string{"page": validator.CodeTooSmall}},
+		{"page too large", Filters{Page: 10_000_001, PageSize: 20, Sort: "id"}, map[string]string{"page": validator.CodeTooLarge}},
+		{"page size zero", Filters{Page: 1, PageSize: 0, Sort: "id"}, map[string]string{"page_size": validator.CodeTooSmall}},
+		{"page size too large", Filters{Page: 1, PageSize: 101, Sort: "id"}, map[string]string{"page_size": validator.CodeTooLarge}},
+		{"unknown sort", Filters{Page: 1, PageSize: 20, Sort: "password"}, map[string]string{"sort": validator.CodeNotPermitted}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.filters.SortSafeList = []string{"id", "-id"}
+
+			v := validator.New()
+			ValidateFilters(v, tt.filters)
+
+			if got := fieldCodes(v); !maps.Equal(got, tt.want) {
+				t.Errorf("got codes %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
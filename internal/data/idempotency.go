@@ -0,0 +1,130 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var (
+	ErrIdempotencyKeyInUse    = errors.New("idempotency key in use")
+	ErrIdempotencyKeyMismatch = errors.New("idempotency key used for a different request")
+)
+
+// IdempotentResponse is a stored response for a request made with an
+// Idempotency-Key header. A zero Status means the original request is still
+// being processed.
+type IdempotentResponse struct {
+	Status  int
+	Headers map[string][]string
+	Body    []byte
+}
+
+type IdempotencyModel struct {
+	DB *DB
+}
+
+// Reserve claims the key for the user until expiry, for the request with the
+// given hash. If the key has already been used, the stored response is
+// returned instead; ErrIdempotencyKeyInUse is returned while the original
+// request is still in flight, and ErrIdempotencyKeyMismatch if the key was
+// used for a request with a different hash.
+func (m IdempotencyModel) Reserve(userID int64, key string, requestHash []byte, ttl time.Duration) (*IdempotentResponse, error) {
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+	DELETE FROM idempotency_keys
+	WHERE user_id = $1 AND key = $2 AND expiry < NOW()`, userID, key)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := m.DB.ExecContext(ctx, `
+	INSERT INTO idempotency_keys (user_id, key, request_hash, expiry)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT DO NOTHING`, userID, key, requestHash, time.Now().Add(ttl))
+	if err != nil {
+		return nil, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if rowsAffected == 1 {
+		return nil, nil
+	}
+
+	var (
+		response     IdempotentResponse
+		headers      []byte
+		reservedHash []byte
+	)
+
+	err = m.DB.QueryRowContext(ctx, `
+	SELECT status, headers, body, request_hash
+	FROM idempotency_keys
+	WHERE user_id = $1 AND key = $2`, userID, key).Scan(&response.Status, &headers, &response.Body, &reservedHash)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrIdempotencyKeyInUse
+		default:
+			return nil, err
+		}
+	}
+
+	if !bytes.Equal(reservedHash, requestHash) {
+		return nil, ErrIdempotencyKeyMismatch
+	}
+
+	if response.Status == 0 {
+		return nil, ErrIdempotencyKeyInUse
+	}
+
+	err = json.Unmarshal(headers, &response.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &response, nil
+}
+
+func (m IdempotencyModel) Complete(userID int64, key string, response *IdempotentResponse) error {
+	headers, err := json.Marshal(response.Headers)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	UPDATE idempotency_keys
+	SET status = $1, headers = $2, body = $3
+	WHERE user_id = $4 AND key = $5`
+
+	args := []any{response.Status, headers, response.Body, userID, key}
+
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Release frees a reserved key so that the request can be retried, e.g. after
+// a server error.
+func (m IdempotencyModel) Release(userID int64, key string) error {
+	query := `
+	DELETE FROM idempotency_keys
+	WHERE user_id = $1 AND key = $2`
+
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, key)
+	return err
+}
@@ -0,0 +1,125 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/mathiasb/greenlight/internal/validator"
+)
+
+// Invite is an invite token, stored in the tokens table with ScopeInvite and
+// recorded against the admin who created it, along with what it grants. If
+// Email is set, only that address can register with it.
+type Invite struct {
+	Token       *Token      `json:"invite_token"`
+	Email       string      `json:"email,omitempty"`
+	Permissions Permissions `json:"permissions"`
+}
+
+// ValidateInvite checks an invite made by a user holding the granted
+// permissions, which are all it can pass on.
+func ValidateInvite(v *validator.Validator, invite *Invite, granted Permissions) {
+	if invite.Email != "" {
+		ValidateEmail(v, invite.Email)
+	}
+
+	v.Check(validator.Unique(invite.Permissions), "permissions", validator.CodeNotUnique, "must not contain duplicate values")
+	for _, code := range invite.Permissions {
+		v.Check(validator.PermittedValue(code, AllPermissions...), "permissions", validator.CodeNotPermitted, "must only contain known permission codes")
+		if AllPermissions.Include(code) {
+			v.Check(granted.Include(code), "permissions", validator.CodeNotPermitted, "must only contain permissions you hold")
+		}
+	}
+}
+
+type InviteModel struct {
+	DB *DB
+}
+
+// New creates an invite token that expires after ttl.
+func (m InviteModel) New(createdBy int64, ttl time.Duration, email string, permissions Permissions) (*Invite, error) {
+	token, err := generateToken(createdBy, ttl, ScopeInvite)
+	if err != nil {
+		return nil, err
+	}
+
+	invite := &Invite{Token: token, Email: email, Permissions: permissions}
+	err = m.Insert(invite)
+	return invite, err
+}
+
+// Insert stores the invite's token and details together.
+func (m InviteModel) Insert(invite *Invite) error {
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	token := invite.Token
+	_, err = tx.ExecContext(ctx, `
+	INSERT INTO tokens (hash, user_id, expiry, scope, device_label, ip)
+	VALUES ($1, $2, $3, $4, $5, $6)`,
+		token.Hash, token.UserID, token.Expiry, token.Scope, token.DeviceLabel, token.IP)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	INSERT INTO invites (hash, email, permissions)
+	VALUES ($1, $2, $3)`,
+		token.Hash, invite.Email, invite.Permissions)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RedeemTx deletes an unexpired invite and returns it, run with q, usually the
+// transaction that registers the user, so that the invite is kept if the
+// registration fails. Deleting it up front means it can't be used twice, even
+// by concurrent registrations.
+func (m InviteModel) RedeemTx(q Querier, tokenPlaintext string) (*Invite, error) {
+	// Both parts of the statement see the invite row from before the
+	// cascading delete.
+	query := `
+	WITH redeemed AS (
+		DELETE FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3
+		RETURNING hash, user_id, expiry
+	)
+	SELECT redeemed.user_id, redeemed.expiry, coalesce(invites.email, ''), coalesce(invites.permissions, '{}')
+	FROM redeemed
+	LEFT JOIN invites ON invites.hash = redeemed.hash`
+
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	invite := &Invite{
+		Token: &Token{Plaintext: tokenPlaintext, Hash: hash[:], Scope: ScopeInvite},
+	}
+
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
+	defer cancel()
+
+	err := q.QueryRowContext(ctx, query, invite.Token.Hash, ScopeInvite, time.Now()).Scan(
+		&invite.Token.UserID,
+		&invite.Token.Expiry,
+		&invite.Email,
+		&invite.Permissions,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return invite, nil
+}
@@ -0,0 +1,97 @@
+package data
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mathiasb/greenlight/internal/validator"
+)
+
+func TestValidateInvite(t *testing.T) {
+	granted := Permissions{PermissionRead, "admin:invite"}
+
+	tests := []struct {
+		name   string
+		invite Invite
+		want   map[string]string
+	}{
+		{"no permissions", Invite{Permissions: Permissions{}}, map[string]string{}},
+		{"held permissions", Invite{Permissions: Permissions{PermissionRead, "admin:invite"}}, map[string]string{}},
+		{"unheld permission", Invite{Permissions: Permissions{"admin:users"}}, map[string]string{"permissions": validator.CodeNotPermitted}},
+		{"unknown permission", Invite{Permissions: Permissions{"admin:everything"}}, map[string]string{"permissions": validator.CodeNotPermitted}},
+		{"duplicate permissions", Invite{Permissions: Permissions{PermissionRead, PermissionRead}}, map[string]string{"permissions": validator.CodeNotUnique}},
+		{"bad email", Invite{Email: "alice", Permissions: Permissions{}}, map[string]string{"email": validator.CodeInvalidFormat}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateInvite(v, &tt.invite, granted)
+
+			if got := fieldCodes(v); !maps.Equal(got, tt.want) {
+				t.Errorf("got codes %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateInviteUnheldMessage(t *testing.T) {
+	v := validator.New()
+	ValidateInvite(v, &Invite{Permissions: Permissions{"admin:users"}}, Permissions{PermissionRead})
+
+	want := "must only contain permissions you hold"
+	if got := v.FieldErrors["permissions"]; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestRedeemInviteWithPermissions(t *testing.T) {
+	models := newTestModels(t)
+	admin := insertTestUser(t, models)
+
+	permissions := Permissions{PermissionWrite, PermissionAdminExport}
+	created, err := models.Invites.New(admin.ID, time.Hour, "", permissions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redeem := func() (*Invite, error) {
+		tx, err := models.DB.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Commit()
+
+		return models.Invites.RedeemTx(tx, created.Token.Plaintext)
+	}
+
+	// A rolled back redemption leaves the invite to be used again.
+	tx, err := models.DB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := models.Invites.RedeemTx(tx, created.Token.Plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	invite, err := redeem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invite.Token.UserID != admin.ID {
+		t.Errorf("got user %d; want %d", invite.Token.UserID, admin.ID)
+	}
+	if !slices.Equal(invite.Permissions, permissions) {
+		t.Errorf("got permissions %#v; want %#v", invite.Permissions, permissions)
+	}
+
+	if _, err := redeem(); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("got error %v redeeming twice; want ErrRecordNotFound", err)
+	}
+}
@@ -1,7 +1,6 @@
 package data
 
 import (
-	"database/sql"
 	"errors"
 )
 
@@ -11,17 +10,35 @@ var (
 )
 
 type Models struct {
+	DB          *DB
+	Clock       Clock
+	Audit       AuditModel
+	Idempotency IdempotencyModel
+	Invites     InviteModel
 	Movies      MovieModel
 	Permissions PermissionModel
+	Ratings     RatingModel
+	Schema      SchemaModel
 	Tokens      TokenModel
 	Users       UserModel
 }
 
-func NewModels(db *sql.DB) Models {
+func NewModels(db *DB, hasher PasswordHasher, policy PasswordPolicy) Models {
+	// The dummy hash is made up front, so that the first login attempt for an
+	// unknown email doesn't take longer than the rest.
+	dummyPasswordHash(hasher)
+
 	return Models{
+		DB:          db,
+		Clock:       SystemClock{},
+		Audit:       AuditModel{DB: db},
+		Idempotency: IdempotencyModel{DB: db},
+		Invites:     InviteModel{DB: db},
 		Movies:      MovieModel{DB: db},
 		Permissions: PermissionModel{DB: db},
+		Ratings:     RatingModel{DB: db},
+		Schema:      SchemaModel{DB: db},
 		Tokens:      TokenModel{DB: db},
-		Users:       UserModel{DB: db},
+		Users:       UserModel{DB: db, Hasher: hasher, PasswordPolicy: policy},
 	}
 }
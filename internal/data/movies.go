@@ -3,56 +3,100 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
 	"github.com/mathiasb/greenlight/internal/validator"
 )
 
+var (
+	ErrDuplicateMovie  = errors.New("duplicate movie")
+	ErrDuplicateIMDbID = errors.New("duplicate imdb id")
+)
+
+// movieConstraintError maps a unique violation on the movies table to
+// ErrDuplicateMovie or ErrDuplicateIMDbID, and returns any other error as is.
+func movieConstraintError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+		return err
+	}
+
+	switch pqErr.Constraint {
+	case "movies_title_year_key":
+		return ErrDuplicateMovie
+	case "movies_imdb_id_key":
+		return ErrDuplicateIMDbID
+	default:
+		return err
+	}
+}
+
 type MovieModel struct {
-	DB *sql.DB
+	DB *DB
 }
 
 func (m MovieModel) Insert(movie *Movie) error {
+	movie.Genres = NormalizeGenres(movie.Genres)
+
 	query := `
-	INSERT INTO movies (title, year, runtime, genres)
-	VALUES ($1, $2, $3, $4)
-	RETURNING id, created_at, version`
-	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	INSERT INTO movies (title, year, runtime, genres, summary, imdb_id, duplicate_allowed, created_by)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	RETURNING id, uuid, created_at, updated_at, version`
+	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.Summary, movie.IMDbID, movie.DuplicateAllowed, movie.CreatedBy}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
 		&movie.ID,
+		&movie.UUID,
 		&movie.CreatedAt,
+		&movie.UpdatedAt,
 		&movie.Version)
+	if err != nil {
+		return movieConstraintError(err)
+	}
+	return nil
 }
 
+const getMovieQuery = `
+	SELECT id, uuid, created_at, updated_at, title, year, runtime, genres, summary, imdb_id, duplicate_allowed, view_count, rating_average, rating_count, created_by, version
+	FROM movies
+	WHERE id = $1`
+
 func (m MovieModel) Get(id int64) (*Movie, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
-	query := `
-	SELECT id, created_at, title, year, runtime, genres, version
-	FROM movies
-	WHERE id = $1`
-
 	var movie Movie
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.DB.QueryRowContext(ctx, getMovieQuery, id).Scan(
 		&movie.ID,
+		&movie.UUID,
 		&movie.CreatedAt,
+		&movie.UpdatedAt,
 		&movie.Title,
 		&movie.Year,
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
+		&movie.Summary,
+		&movie.IMDbID,
+		&movie.DuplicateAllowed,
+		&movie.ViewCount,
+		&movie.RatingAverage,
+		&movie.RatingCount,
+		&movie.CreatedBy,
 		&movie.Version,
 	)
 
@@ -68,80 +112,408 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
+// GetByIMDbID returns the movie with the given IMDb ID.
+func (m MovieModel) GetByIMDbID(ctx context.Context, imdbID string) (*Movie, error) {
+	query := `
+	SELECT id, uuid, created_at, updated_at, title, year, runtime, genres, summary, imdb_id, duplicate_allowed, view_count, rating_average, rating_count, created_by, version
+	FROM movies
+	WHERE imdb_id = $1`
+
+	ctx, cancel := m.DB.withQueryTimeout(ctx)
+	defer cancel()
+
+	var movie Movie
+
+	err := m.DB.QueryRowContext(ctx, query, imdbID).Scan(
+		&movie.ID,
+		&movie.UUID,
+		&movie.CreatedAt,
+		&movie.UpdatedAt,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		&movie.Summary,
+		&movie.IMDbID,
+		&movie.DuplicateAllowed,
+		&movie.ViewCount,
+		&movie.RatingAverage,
+		&movie.RatingCount,
+		&movie.CreatedBy,
+		&movie.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &movie, nil
+}
+
+// GetIDForUUID returns the ID of the movie with the given UUID, which must be
+// well-formed.
+func (m MovieModel) GetIDForUUID(ctx context.Context, uuid string) (int64, error) {
+	query := `
+	SELECT id
+	FROM movies
+	WHERE uuid = $1`
+
+	ctx, cancel := m.DB.withQueryTimeout(ctx)
+	defer cancel()
+
+	var id int64
+	err := m.DB.QueryRowContext(ctx, query, uuid).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	return id, nil
+}
+
+// GetIDsForUUIDs returns the IDs of the movies with the given UUIDs, which
+// must be well-formed, keyed by UUID as given. UUIDs that match no movie are
+// left out.
+func (m MovieModel) GetIDsForUUIDs(ctx context.Context, uuids []string) (map[string]int64, error) {
+	query := `
+	SELECT given, movies.id
+	FROM unnest($1::text[]) AS given
+	INNER JOIN movies ON movies.uuid = given::uuid`
+
+	ctx, cancel := m.DB.withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(uuids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make(map[string]int64, len(uuids))
+
+	for rows.Next() {
+		var (
+			uuid string
+			id   int64
+		)
+
+		err = rows.Scan(&uuid, &id)
+		if err != nil {
+			return nil, err
+		}
+		ids[uuid] = id
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
 func (m MovieModel) Update(movie *Movie) error {
+	movie.Genres = NormalizeGenres(movie.Genres)
+
 	query := `
 	UPDATE movies
-	SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-	WHERE id = $5 AND version = $6
-	RETURNING version`
+	SET title = $1, year = $2, runtime = $3, genres = $4, summary = $5, imdb_id = $6, duplicate_allowed = $7, updated_at = NOW(),
+		version = version + 1
+	WHERE id = $8 AND version = $9
+	RETURNING updated_at, version`
 
 	args := []any{
 		movie.Title,
 		movie.Year,
 		movie.Runtime,
 		pq.Array(movie.Genres),
+		movie.Summary,
+		movie.IMDbID,
+		movie.DuplicateAllowed,
 		movie.ID,
 		movie.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.UpdatedAt, &movie.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 		default:
-			return err
+			return movieConstraintError(err)
 		}
 	}
 
 	return nil
 }
 
-func (m MovieModel) Delete(id int64) error {
+// AddViews adds the given number of views to each movie, with one UPDATE per
+// movie. It doesn't count as an edit, so the version is left alone. On error
+// it returns the views that weren't recorded.
+func (m MovieModel) AddViews(ctx context.Context, views map[int64]int64) (map[int64]int64, error) {
+	query := `
+	UPDATE movies
+	SET view_count = view_count + $1
+	WHERE id = $2`
+
+	remaining := maps.Clone(views)
+
+	for id, n := range views {
+		_, err := m.DB.ExecContext(ctx, query, n, id)
+		if err != nil {
+			return remaining, err
+		}
+		delete(remaining, id)
+	}
+
+	return nil, nil
+}
+
+// Delete deletes the movie with the given ID, returning its UUID. The time is
+// recorded for LastModified.
+func (m MovieModel) Delete(id int64) (string, error) {
 	if id < 1 {
-		return ErrRecordNotFound
+		return "", ErrRecordNotFound
 	}
 
 	query := `
-	DELETE FROM movies
-	WHERE id = $1`
+	WITH deleted AS (
+		DELETE FROM movies
+		WHERE id = $1
+		RETURNING uuid
+	), recorded AS (
+		UPDATE movie_deletions
+		SET last_deleted_at = NOW()
+		WHERE EXISTS (SELECT 1 FROM deleted)
+	)
+	SELECT uuid FROM deleted`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
 	defer cancel()
 
-	result, err := m.DB.ExecContext(ctx, query, id)
+	var uuid string
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&uuid)
 	if err != nil {
-		return err
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	return uuid, nil
+}
+
+// GetCreators returns the creators of the movies with the given IDs that
+// exist, keyed by movie ID. A movie with no recorded creator maps to nil.
+func (m MovieModel) GetCreators(ctx context.Context, ids []int64) (map[int64]*int64, error) {
+	query := `
+	SELECT id, created_by
+	FROM movies
+	WHERE id = ANY($1)`
+
+	ctx, cancel := m.DB.withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(ids))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
+
+	creators := make(map[int64]*int64, len(ids))
 
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	for rows.Next() {
+		var (
+			id        int64
+			createdBy *int64
+		)
+
+		err = rows.Scan(&id, &createdBy)
+		if err != nil {
+			return nil, err
+		}
+		creators[id] = createdBy
 	}
 
-	return nil
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return creators, nil
 }
 
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
-	query := fmt.Sprintf(`
-	SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
-	FROM movies
-	WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-	AND (genres @> $2 OR $2 = '{}')
-	ORDER BY %s %s, id ASC
-	LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+// DeleteMany deletes all of the movies with the given IDs in a single
+// statement, returning the UUIDs of those that were deleted, keyed by ID. As
+// with Delete, the time is recorded for LastModified.
+func (m MovieModel) DeleteMany(ids []int64) (map[int64]string, error) {
+	query := `
+	WITH deleted AS (
+		DELETE FROM movies
+		WHERE id = ANY($1)
+		RETURNING id, uuid
+	), recorded AS (
+		UPDATE movie_deletions
+		SET last_deleted_at = NOW()
+		WHERE EXISTS (SELECT 1 FROM deleted)
+	)
+	SELECT id, uuid FROM deleted`
+
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deleted := make(map[int64]string, len(ids))
+
+	for rows.Next() {
+		var (
+			id   int64
+			uuid string
+		)
+
+		err = rows.Scan(&id, &uuid)
+		if err != nil {
+			return nil, err
+		}
+		deleted[id] = uuid
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// ImportResult counts what Import did with each of the movies. Failed holds
+// the index of each movie that clashed with another movie's title and year or
+// IMDb ID, with ErrDuplicateMovie or ErrDuplicateIMDbID.
+type ImportResult struct {
+	Inserted int
+	Updated  int
+	Skipped  int
+	Failed   map[int]error
+}
+
+// Import upserts movies by ID in a single transaction, keeping their IDs,
+// timestamps and versions. A movie that already exists is only overwritten
+// if the imported version is newer; otherwise it's skipped. Each movie is
+// upserted under its own savepoint, so that one that clashes with another
+// movie fails alone rather than aborting the rest. The movies must already be
+// valid.
+func (m MovieModel) Import(ctx context.Context, movies []*Movie) (*ImportResult, error) {
+	query := `
+	INSERT INTO movies (id, uuid, created_at, updated_at, title, year, runtime, genres, summary, imdb_id, duplicate_allowed, view_count, version)
+	VALUES ($1, coalesce(nullif($2, '')::uuid, gen_random_uuid()), $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+	ON CONFLICT (id) DO UPDATE
+	SET uuid = EXCLUDED.uuid, created_at = EXCLUDED.created_at, updated_at = EXCLUDED.updated_at, title = EXCLUDED.title,
+		year = EXCLUDED.year, runtime = EXCLUDED.runtime, genres = EXCLUDED.genres,
+		summary = EXCLUDED.summary, imdb_id = EXCLUDED.imdb_id, duplicate_allowed = EXCLUDED.duplicate_allowed,
+		view_count = EXCLUDED.view_count, version = EXCLUDED.version
+	WHERE movies.version < EXCLUDED.version
+	RETURNING xmax = 0`
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result := &ImportResult{Failed: map[int]error{}}
+
+	for i, movie := range movies {
+		_, err = tx.ExecContext(ctx, "SAVEPOINT import_movie")
+		if err != nil {
+			return nil, err
+		}
+
+		movie.Genres = NormalizeGenres(movie.Genres)
+		args := []any{
+			movie.ID,
+			movie.UUID,
+			movie.CreatedAt,
+			movie.UpdatedAt,
+			movie.Title,
+			movie.Year,
+			movie.Runtime,
+			pq.Array(movie.Genres),
+			movie.Summary,
+			movie.IMDbID,
+			movie.DuplicateAllowed,
+			movie.ViewCount,
+			movie.Version,
+		}
+
+		// xmax is only zero for a freshly inserted row.
+		var wasInserted bool
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&wasInserted)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			result.Skipped++
+		case err != nil:
+			err = movieConstraintError(err)
+			if !errors.Is(err, ErrDuplicateMovie) && !errors.Is(err, ErrDuplicateIMDbID) {
+				return nil, err
+			}
+			result.Failed[i] = err
+
+			_, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT import_movie")
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case wasInserted:
+			result.Inserted++
+		default:
+			result.Updated++
+		}
+
+		_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT import_movie")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Inserting explicit IDs doesn't advance the sequence, so move it past
+	// them to keep new movies from colliding.
+	_, err = tx.ExecContext(ctx, `SELECT setval(pg_get_serial_sequence('movies', 'id'), coalesce(max(id), 0) + 1, false) FROM movies`)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetAll returns a page of the movies matching the filters, limited to those
+// created by the user with ID createdBy unless it's 0, and to those released
+// in or before maxYear unless it's 0. The query is abandoned
+// when ctx is cancelled, e.g. because the client disconnected.
+func (m MovieModel) GetAll(ctx context.Context, title string, genres []string, createdBy int64, maxYear int32, filters Filters) ([]*Movie, Metadata, error) {
+	query, args := getAllMoviesQuery(title, genres, createdBy, maxYear, filters)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.DB.withQueryTimeout(ctx)
 	defer cancel()
 
-	args := []any{title, pq.Array(genres), filters.limit(), filters.offset()}
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
@@ -157,11 +529,20 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 		err = rows.Scan(
 			&totalRecords,
 			&movie.ID,
+			&movie.UUID,
 			&movie.CreatedAt,
+			&movie.UpdatedAt,
 			&movie.Title,
 			&movie.Year,
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
+			&movie.Summary,
+			&movie.IMDbID,
+			&movie.DuplicateAllowed,
+			&movie.ViewCount,
+			&movie.RatingAverage,
+			&movie.RatingCount,
+			&movie.CreatedBy,
 			&movie.Version)
 		if err != nil {
 			return nil, Metadata{}, err
@@ -177,29 +558,330 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	return movies, metadata, nil
 }
 
+// ExplainGetAll runs the query GetAll would with EXPLAIN (ANALYZE, FORMAT JSON)
+// and returns the plan. The query really is run, to time it.
+func (m MovieModel) ExplainGetAll(ctx context.Context, title string, genres []string, createdBy int64, maxYear int32, filters Filters) (json.RawMessage, error) {
+	query, args := getAllMoviesQuery(title, genres, createdBy, maxYear, filters)
+
+	ctx, cancel := m.DB.withQueryTimeout(ctx)
+	defer cancel()
+
+	var plan []byte
+	err := m.DB.QueryRowContext(ctx, "EXPLAIN (ANALYZE, FORMAT JSON) "+query, args...).Scan(&plan)
+	if err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// Count returns the number of movies matching the title, genre, creator and
+// year filters of GetAll, without fetching them.
+func (m MovieModel) Count(ctx context.Context, title string, genres []string, createdBy int64, maxYear int32) (int, error) {
+	query := `
+	SELECT count(*)
+	FROM movies
+	WHERE (to_tsvector('simple', title || ' ' || coalesce(summary, '')) @@ plainto_tsquery('simple', $1) OR $1 = '')
+	AND (genres @> $2 OR $2 = '{}')
+	AND (created_by = $3 OR $3 = 0)
+	AND (year <= $4 OR $4 = 0)`
+
+	ctx, cancel := m.DB.withQueryTimeout(ctx)
+	defer cancel()
+
+	var count int
+	err := m.DB.QueryRowContext(ctx, query, title, pq.Array(genres), createdBy, maxYear).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// LastModified returns the latest updated_at of the movies matching the title,
+// genre, creator and year filters of GetAll, or the time a movie was last
+// deleted if that's later, as the deleted movie may have matched.
+func (m MovieModel) LastModified(ctx context.Context, title string, genres []string, createdBy int64, maxYear int32) (time.Time, error) {
+	query := `
+	SELECT greatest(max(updated_at), (SELECT last_deleted_at FROM movie_deletions))
+	FROM movies
+	WHERE (to_tsvector('simple', title || ' ' || coalesce(summary, '')) @@ plainto_tsquery('simple', $1) OR $1 = '')
+	AND (genres @> $2 OR $2 = '{}')
+	AND (created_by = $3 OR $3 = 0)
+	AND (year <= $4 OR $4 = 0)`
+
+	ctx, cancel := m.DB.withQueryTimeout(ctx)
+	defer cancel()
+
+	var lastModified sql.NullTime
+	err := m.DB.QueryRowContext(ctx, query, title, pq.Array(genres), createdBy, maxYear).Scan(&lastModified)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return lastModified.Time, nil
+}
+
+// getAllMoviesQuery builds the query and arguments for GetAll.
+func getAllMoviesQuery(title string, genres []string, createdBy int64, maxYear int32, filters Filters) (string, []any) {
+	query := fmt.Sprintf(`
+	SELECT count(*) OVER(), id, uuid, created_at, updated_at, title, year, runtime, genres, summary, imdb_id, duplicate_allowed, view_count, rating_average, rating_count, created_by, version
+	FROM movies
+	WHERE (to_tsvector('simple', title || ' ' || coalesce(summary, '')) @@ plainto_tsquery('simple', $1) OR $1 = '')
+	AND (genres @> $2 OR $2 = '{}')
+	AND (created_by = $3 OR $3 = 0)
+	AND (year <= $4 OR $4 = 0)
+	ORDER BY %s %s, id ASC
+	LIMIT $5 OFFSET $6`, filters.sortColumn(), filters.sortDirection())
+
+	return query, []any{title, pq.Array(genres), createdBy, maxYear, filters.limit(), filters.offset()}
+}
+
+// GetMostViewed returns the limit movies with the most views, most viewed
+// first.
+func (m MovieModel) GetMostViewed(ctx context.Context, limit int) ([]*Movie, error) {
+	query := `
+	SELECT id, uuid, created_at, updated_at, title, year, runtime, genres, summary, imdb_id, duplicate_allowed, view_count, rating_average, rating_count, created_by, version
+	FROM movies
+	ORDER BY view_count DESC, id ASC
+	LIMIT $1`
+
+	ctx, cancel := m.DB.withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err = rows.Scan(
+			&movie.ID,
+			&movie.UUID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Summary,
+			&movie.IMDbID,
+			&movie.DuplicateAllowed,
+			&movie.ViewCount,
+			&movie.RatingAverage,
+			&movie.RatingCount,
+			&movie.CreatedBy,
+			&movie.Version)
+		if err != nil {
+			return nil, err
+		}
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return movies, nil
+}
+
+// GetRelated returns up to limit other movies that share genres with movie,
+// those sharing the most genres first.
+func (m MovieModel) GetRelated(ctx context.Context, movie *Movie, limit int) ([]*Movie, error) {
+	query := `
+	SELECT id, uuid, created_at, updated_at, title, year, runtime, genres, summary, imdb_id, duplicate_allowed, view_count, rating_average, rating_count, created_by, version
+	FROM movies
+	WHERE genres && $2 AND id <> $1
+	ORDER BY cardinality(ARRAY(SELECT unnest(genres) INTERSECT SELECT unnest($2::text[]))) DESC, id ASC
+	LIMIT $3`
+
+	ctx, cancel := m.DB.withQueryTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movie.ID, pq.Array(movie.Genres), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err = rows.Scan(
+			&movie.ID,
+			&movie.UUID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Summary,
+			&movie.IMDbID,
+			&movie.DuplicateAllowed,
+			&movie.ViewCount,
+			&movie.RatingAverage,
+			&movie.RatingCount,
+			&movie.CreatedBy,
+			&movie.Version)
+		if err != nil {
+			return nil, err
+		}
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return movies, nil
+}
+
+// Each calls fn for every movie matching the filters, in the requested sort
+// order, as the rows are read from the database. Unlike GetAll it ignores
+// pagination and doesn't hold the results in memory, so it is suitable for
+// exporting the whole catalogue. Iteration stops at the first error returned
+// by fn, or when ctx is cancelled.
+func (m MovieModel) Each(ctx context.Context, title string, genres []string, createdBy int64, maxYear int32, filters Filters, fn func(*Movie) error) error {
+	query := fmt.Sprintf(`
+	SELECT id, uuid, created_at, updated_at, title, year, runtime, genres, summary, imdb_id, duplicate_allowed, view_count, rating_average, rating_count, created_by, version
+	FROM movies
+	WHERE (to_tsvector('simple', title || ' ' || coalesce(summary, '')) @@ plainto_tsquery('simple', $1) OR $1 = '')
+	AND (genres @> $2 OR $2 = '{}')
+	AND (created_by = $3 OR $3 = 0)
+	AND (year <= $4 OR $4 = 0)
+	ORDER BY %s %s, id ASC`, filters.sortColumn(), filters.sortDirection())
+
+	rows, err := m.DB.QueryContext(ctx, query, title, pq.Array(genres), createdBy, maxYear)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var movie Movie
+
+		err = rows.Scan(
+			&movie.ID,
+			&movie.UUID,
+			&movie.CreatedAt,
+			&movie.UpdatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Summary,
+			&movie.IMDbID,
+			&movie.DuplicateAllowed,
+			&movie.ViewCount,
+			&movie.RatingAverage,
+			&movie.RatingCount,
+			&movie.CreatedBy,
+			&movie.Version)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&movie)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
 type Movie struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"-"`
-	Title     string    `json:"title"`
-	Year      int32     `json:"year,omitempty"`
-	Runtime   Runtime   `json:"runtime,omitempty"`
-	Genres    []string  `json:"genres,omitempty"`
-	Version   int32     `json:"version"`
-}
-
-func ValidateMovie(v *validator.Validator, movie *Movie) {
-	v.Check(movie.Title != "", "title", "must be provided")
-	v.Check(len(movie.Title) <= 500, "title", "must not be more than 500 bytes long")
-
-	v.Check(movie.Year != 0, "year", "must be provided")
-	v.Check(movie.Year >= 1888, "year", "must be greater than 1888")
-	v.Check(movie.Year <= int32(time.Now().Year()), "year", "must not be in the future")
-
-	v.Check(movie.Runtime != 0, "runtime", "must be provided")
-	v.Check(movie.Runtime > 0, "runtime", "must be a positive integer")
-
-	v.Check(movie.Genres != nil, "genres", "must be provided")
-	v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
-	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
-	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
+	ID               int64     `json:"id" xml:"id"`
+	UUID             string    `json:"-" xml:"-"`
+	CreatedAt        time.Time `json:"-" xml:"-"`
+	UpdatedAt        time.Time `json:"-" xml:"-"`
+	Title            string    `json:"title" xml:"title"`
+	Year             int32     `json:"year,omitempty" xml:"year,omitempty"`
+	Runtime          Runtime   `json:"runtime,omitempty" xml:"runtime,omitempty"`
+	Genres           []string  `json:"genres,omitempty" xml:"genres>genre,omitempty"`
+	Summary          *string   `json:"summary,omitempty" xml:"summary,omitempty"`
+	IMDbID           *string   `json:"imdb_id,omitempty" xml:"imdb_id,omitempty"`
+	DuplicateAllowed bool      `json:"-" xml:"-"`
+	ViewCount        int64     `json:"view_count" xml:"view_count"`
+	RatingAverage    *float64  `json:"rating_average,omitempty" xml:"rating_average,omitempty"`
+	RatingCount      int64     `json:"rating_count" xml:"rating_count"`
+	CreatedBy        *int64    `json:"created_by,omitempty" xml:"created_by,omitempty"`
+	Version          int32     `json:"version" xml:"version"`
+}
+
+// imdbIDRX matches IMDb title IDs, which are "tt" and at least seven digits.
+var imdbIDRX = regexp.MustCompile(`^tt[0-9]{7,}$`)
+
+// ValidIMDbID reports whether id is a well-formed IMDb title ID.
+func ValidIMDbID(id string) bool {
+	return imdbIDRX.MatchString(id)
+}
+
+// MovieRules holds the configurable limits applied to movies.
+type MovieRules struct {
+	FutureYears int // how many years after the current one a movie's year may be
+	MinGenres   int
+	MaxGenres   int
+}
+
+// NormalizeGenres trims the genres and drops any that repeat an earlier one
+// ignoring case, keeping the first spelling.
+func NormalizeGenres(genres []string) []string {
+	if genres == nil {
+		return nil
+	}
+
+	normalized := make([]string, 0, len(genres))
+	seen := make(map[string]bool, len(genres))
+	for _, genre := range genres {
+		genre = strings.TrimSpace(genre)
+		key := strings.ToLower(genre)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		normalized = append(normalized, genre)
+	}
+	return normalized
+}
+
+// ValidateMovie checks the movie against the rules, relative to the year of
+// now.
+func ValidateMovie(v *validator.Validator, movie *Movie, now time.Time, rules MovieRules) {
+	v.Check(validator.NotBlank(movie.Title), "title", validator.CodeRequired, "must be provided")
+	v.Check(validator.MaxRunes(movie.Title, 500), "title", validator.CodeTooLong, "must not be more than 500 characters long")
+
+	v.Check(movie.Year != 0, "year", validator.CodeRequired, "must be provided")
+	v.Check(movie.Year >= 1888, "year", validator.CodeTooSmall, "must be greater than 1888")
+	if rules.FutureYears == 0 {
+		v.Check(movie.Year <= int32(now.Year()), "year", validator.CodeTooLarge, "must not be in the future")
+	} else {
+		v.Checkf(movie.Year <= int32(now.Year()+rules.FutureYears), "year", validator.CodeTooLarge, "must not be more than %d years in the future", rules.FutureYears)
+	}
+
+	v.Check(movie.Runtime != 0, "runtime", validator.CodeRequired, "must be provided")
+	v.Check(movie.Runtime > 0, "runtime", validator.CodeTooSmall, "must be a positive integer")
+
+	v.Check(movie.Genres != nil, "genres", validator.CodeRequired, "must be provided")
+	if rules.MinGenres == 1 {
+		v.Check(len(movie.Genres) >= 1, "genres", validator.CodeTooFew, "must contain at least 1 genre")
+	} else {
+		v.Checkf(len(movie.Genres) >= rules.MinGenres, "genres", validator.CodeTooFew, "must contain at least %d genres", rules.MinGenres)
+	}
+	v.Checkf(len(movie.Genres) <= rules.MaxGenres, "genres", validator.CodeTooMany, "must not contain more than %d genres", rules.MaxGenres)
+	v.Check(len(NormalizeGenres(movie.Genres)) == len(movie.Genres), "genres", validator.CodeNotUnique, "must not contain duplicate values")
+
+	if movie.Summary != nil {
+		v.Check(validator.MaxRunes(*movie.Summary, 1000), "summary", validator.CodeTooLong, "must not be more than 1000 characters long")
+	}
+
+	if movie.IMDbID != nil {
+		v.Check(ValidIMDbID(*movie.IMDbID), "imdb_id", validator.CodeInvalidFormat, "must be an IMDb title ID such as tt0111161")
+	}
 }
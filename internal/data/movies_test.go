@@ -0,0 +1,307 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mathiasb/greenlight/internal/validator"
+)
+
+func TestMovieConstraintError(t *testing.T) {
+	other := errors.New("connection refused")
+
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"title and year", &pq.Error{Code: "23505", Constraint: "movies_title_year_key"}, ErrDuplicateMovie},
+		{"IMDb ID", &pq.Error{Code: "23505", Constraint: "movies_imdb_id_key"}, ErrDuplicateIMDbID},
+		{"other unique constraint", &pq.Error{Code: "23505", Constraint: "movies_pkey"}, nil},
+		{"other code on the constraint", &pq.Error{Code: "23514", Constraint: "movies_title_year_key"}, nil},
+		{"not a pq error", other, other},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := movieConstraintError(tt.err)
+
+			want := tt.want
+			if want == nil {
+				want = tt.err
+			}
+			if !errors.Is(got, want) {
+				t.Errorf("got %v; want %v", got, want)
+			}
+		})
+	}
+}
+
+// fieldCodes returns the code of the first error for each field, as
+// failedValidationResponse reports them.
+func fieldCodes(v *validator.Validator) map[string]string {
+	codes := make(map[string]string)
+	for _, e := range v.Errors {
+		if _, ok := codes[e.Field]; !ok {
+			codes[e.Field] = e.Code
+		}
+	}
+	return codes
+}
+
+func TestValidateMovieCodes(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	rules := MovieRules{MinGenres: 1, MaxGenres: 5}
+	summary := func(n int) *string {
+		s := string(make([]rune, n))
+		return &s
+	}
+	imdbID := func(s string) *string { return &s }
+
+	valid := func() *Movie {
+		return &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*Movie)
+		want   map[string]string
+	}{
+		{"valid", func(*Movie) {}, map[string]string{}},
+		{"no title", func(m *Movie) { m.Title = "  " }, map[string]string{"title": validator.CodeRequired}},
+		{"long title", func(m *Movie) { m.Title = *summary(501) }, map[string]string{"title": validator.CodeTooLong}},
+		{"no year", func(m *Movie) { m.Year = 0 }, map[string]string{"year": validator.CodeRequired}},
+		{"early year", func(m *Movie) { m.Year = 1887 }, map[string]string{"year": validator.CodeTooSmall}},
+		{"future year", func(m *Movie) { m.Year = 2025 }, map[string]string{"year": validator.CodeTooLarge}},
+		{"no runtime", func(m *Movie) { m.Runtime = 0 }, map[string]string{"runtime": validator.CodeRequired}},
+		{"negative runtime", func(m *Movie) { m.Runtime = -1 }, map[string]string{"runtime": validator.CodeTooSmall}},
+		{"no genres", func(m *Movie) { m.Genres = nil }, map[string]string{"genres": validator.CodeRequired}},
+		{"empty genres", func(m *Movie) { m.Genres = []string{} }, map[string]string{"genres": validator.CodeTooFew}},
+		{"too many genres", func(m *Movie) { m.Genres = []string{"a", "b", "c", "d", "e", "f"} }, map[string]string{"genres": validator.CodeTooMany}},
+		{"duplicate genres", func(m *Movie) { m.Genres = []string{"drama", "Drama"} }, map[string]string{"genres": validator.CodeNotUnique}},
+		{"long summary", func(m *Movie) { m.Summary = summary(1001) }, map[string]string{"summary": validator.CodeTooLong}},
+		{"bad IMDb ID", func(m *Movie) { m.IMDbID = imdbID("nm0000001") }, map[string]string{"imdb_id": validator.CodeInvalidFormat}},
+		{
+			"several fields",
+			func(m *Movie) { m.Title, m.Runtime = "", -5 },
+			map[string]string{"title": validator.CodeRequired, "runtime": validator.CodeTooSmall},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movie := valid()
+			tt.modify(movie)
+
+			v := validator.New()
+			ValidateMovie(v, movie, now, rules)
+
+			if got := fieldCodes(v); !maps.Equal(got, tt.want) {
+				t.Errorf("got codes %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fixedClock is a Clock stopped at a given time.
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+func TestValidateMovieYear(t *testing.T) {
+	rules := MovieRules{MinGenres: 1, MaxGenres: 5}
+	futureRules := MovieRules{FutureYears: 2, MinGenres: 1, MaxGenres: 5}
+
+	tests := []struct {
+		name  string
+		clock Clock
+		rules MovieRules
+		year  int32
+		valid bool
+	}{
+		{"first film", fixedClock(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)), rules, 1888, true},
+		{"before the first film", fixedClock(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)), rules, 1887, false},
+		{"current year", fixedClock(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)), rules, 2024, true},
+		{"next year", fixedClock(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)), rules, 2025, false},
+		{"next year on new year's eve", fixedClock(time.Date(2024, 12, 31, 23, 59, 59, 0, time.UTC)), rules, 2025, false},
+		{"new year on new year's day", fixedClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)), rules, 2025, true},
+		{"last allowed future year", fixedClock(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)), futureRules, 2026, true},
+		{"past the future years", fixedClock(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)), futureRules, 2027, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movie := &Movie{Title: "Moana", Year: tt.year, Runtime: 107, Genres: []string{"animation"}}
+
+			v := validator.New()
+			ValidateMovie(v, movie, tt.clock.Now(), tt.rules)
+
+			if _, invalid := v.FieldErrors["year"]; invalid == tt.valid {
+				t.Errorf("got year error %q; want valid %t", v.FieldErrors["year"], tt.valid)
+			}
+		})
+	}
+}
+
+func TestValidateMovieFutureYearsMessage(t *testing.T) {
+	now := fixedClock(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)).Now()
+
+	tests := []struct {
+		futureYears int
+		want        string
+	}{
+		{0, "must not be in the future"},
+		{2, "must not be more than 2 years in the future"},
+	}
+
+	for _, tt := range tests {
+		movie := &Movie{Title: "Moana", Year: 2100, Runtime: 107, Genres: []string{"animation"}}
+
+		v := validator.New()
+		ValidateMovie(v, movie, now, MovieRules{FutureYears: tt.futureYears, MinGenres: 1, MaxGenres: 5})
+
+		if got := v.FieldErrors["year"]; got != tt.want {
+			t.Errorf("FutureYears %d: got %q; want %q", tt.futureYears, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeGenres(t *testing.T) {
+	tests := []struct {
+		name   string
+		genres []string
+		want   []string
+	}{
+		{"nil", nil, nil},
+		{"empty", []string{}, []string{}},
+		{"unchanged", []string{"drama", "romance"}, []string{"drama", "romance"}},
+		{"trimmed", []string{" drama ", "\tromance"}, []string{"drama", "romance"}},
+		{"repeats dropped", []string{"drama", "romance", "drama"}, []string{"drama", "romance"}},
+		{"first spelling kept", []string{"Sci-Fi", "sci-fi", "SCI-FI "}, []string{"Sci-Fi"}},
+		{"order kept", []string{"western", "Drama", "action", "drama"}, []string{"western", "Drama", "action"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NormalizeGenres(tt.genres)
+			if (got == nil) != (tt.want == nil) || !slices.Equal(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateMovieGenreBounds(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		rules       MovieRules
+		genres      []string
+		wantCode    string
+		wantMessage string
+	}{
+		{"at the minimum", MovieRules{MinGenres: 2, MaxGenres: 3}, []string{"a", "b"}, "", ""},
+		{"at the maximum", MovieRules{MinGenres: 2, MaxGenres: 3}, []string{"a", "b", "c"}, "", ""},
+		{"below a minimum of 1", MovieRules{MinGenres: 1, MaxGenres: 3}, []string{}, validator.CodeTooFew, "must contain at least 1 genre"},
+		{"below a larger minimum", MovieRules{MinGenres: 2, MaxGenres: 3}, []string{"a"}, validator.CodeTooFew, "must contain at least 2 genres"},
+		{"above the maximum", MovieRules{MinGenres: 1, MaxGenres: 3}, []string{"a", "b", "c", "d"}, validator.CodeTooMany, "must not contain more than 3 genres"},
+		{"a raised maximum", MovieRules{MinGenres: 1, MaxGenres: 10}, []string{"a", "b", "c", "d", "e", "f"}, "", ""},
+		{"repeat ignoring case", MovieRules{MinGenres: 1, MaxGenres: 3}, []string{"Drama", "drama"}, validator.CodeNotUnique, "must not contain duplicate values"},
+		{"repeat ignoring spaces", MovieRules{MinGenres: 1, MaxGenres: 3}, []string{"drama", " drama"}, validator.CodeNotUnique, "must not contain duplicate values"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: tt.genres}
+
+			v := validator.New()
+			ValidateMovie(v, movie, now, tt.rules)
+
+			if got := fieldCodes(v)["genres"]; got != tt.wantCode {
+				t.Errorf("got code %q; want %q", got, tt.wantCode)
+			}
+			if got := v.FieldErrors["genres"]; got != tt.wantMessage {
+				t.Errorf("got message %q; want %q", got, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestMovieListMaxYear(t *testing.T) {
+	models := newTestModels(t)
+	ctx := context.Background()
+
+	// The title filter keeps other movies in the database out of the results.
+	word := fmt.Sprintf("asof%d", time.Now().UnixNano())
+
+	var movies []*Movie
+	for _, year := range []int32{2024, 2025} {
+		movie := &Movie{Title: fmt.Sprintf("%s %d", word, year), Year: year, Runtime: 90, Genres: []string{"drama"}}
+		if err := models.Movies.Insert(movie); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if _, err := models.Movies.Delete(movie.ID); err != nil {
+				t.Error(err)
+			}
+		})
+		movies = append(movies, movie)
+	}
+
+	filters := Filters{Page: 1, PageSize: 20, Sort: "id", SortSafeList: []string{"id"}}
+
+	tests := []struct {
+		name    string
+		maxYear int32
+		want    []*Movie
+	}{
+		{"any year", 0, movies},
+		{"earlier year", 2024, movies[:1]},
+		{"before all", 2023, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, metadata, err := models.Movies.GetAll(ctx, word, []string{}, 0, tt.maxYear, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids, wantIDs []int64
+			for _, movie := range got {
+				ids = append(ids, movie.ID)
+			}
+			for _, movie := range tt.want {
+				wantIDs = append(wantIDs, movie.ID)
+			}
+			if !slices.Equal(ids, wantIDs) || metadata.TotalRecords != len(tt.want) {
+				t.Errorf("got movies %v of %d; want %v", ids, metadata.TotalRecords, wantIDs)
+			}
+
+			count, err := models.Movies.Count(ctx, word, []string{}, 0, tt.maxYear)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != len(tt.want) {
+				t.Errorf("got count %d; want %d", count, len(tt.want))
+			}
+
+			// Movies left out by the year filter mustn't move Last-Modified.
+			lastModified, err := models.Movies.LastModified(ctx, word, []string{}, 0, tt.maxYear)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.want) > 0 && !lastModified.Equal(tt.want[len(tt.want)-1].UpdatedAt) {
+				t.Errorf("got Last-Modified %v; want %v", lastModified, tt.want[len(tt.want)-1].UpdatedAt)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package data
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/mathiasb/greenlight/internal/validator"
+	"github.com/nbutton23/zxcvbn-go"
+)
+
+// PasswordChecker is implemented by sources of known-bad passwords, such as a
+// local blocklist or a breach database.
+type PasswordChecker interface {
+	Compromised(plaintextPassword string) bool
+}
+
+// PasswordPolicy holds the rules applied to new passwords on top of the basic
+// length checks in ValidatePasswordPlaintext. The zero value only enforces
+// those basic checks.
+type PasswordPolicy struct {
+	MinLength        int  `json:"min_length"`
+	RequireMixedCase bool `json:"require_mixed_case"`
+	RequireDigit     bool `json:"require_digit"`
+	RequireSymbol    bool `json:"require_symbol"`
+	// MinStrength is the minimum zxcvbn score, from 0 to 4. Zero disables the
+	// check.
+	MinStrength int `json:"min_strength"`
+	// Checker rejects known-bad passwords. It's disabled when nil.
+	Checker PasswordChecker `json:"-"`
+}
+
+// ValidatePasswordPolicy checks a new password against the policy. Any
+// userInputs, such as the user's name and email, count against the password's
+// strength if it contains them.
+func ValidatePasswordPolicy(v *validator.Validator, password string, policy PasswordPolicy, userInputs ...string) {
+	// Passwords that already failed the basic checks aren't checked again, and
+	// the expensive checks only run once the cheap ones pass.
+	failed := func() bool {
+		_, exists := v.FieldErrors["password"]
+		return exists
+	}
+	if failed() {
+		return
+	}
+
+	var hasLower, hasUpper, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+
+	v.Checkf(validator.MinRunes(password, policy.MinLength), "password", validator.CodeTooShort, "must be at least %d characters long", policy.MinLength)
+
+	if policy.RequireMixedCase {
+		v.Check(hasLower && hasUpper, "password", validator.CodeTooWeak, "must contain both upper and lower case letters")
+	}
+	if policy.RequireDigit {
+		v.Check(hasDigit, "password", validator.CodeTooWeak, "must contain a digit")
+	}
+	if policy.RequireSymbol {
+		v.Check(hasSymbol, "password", validator.CodeTooWeak, "must contain a symbol")
+	}
+
+	if policy.MinStrength > 0 && !failed() {
+		strength := zxcvbn.PasswordStrength(password, userInputs)
+		v.Check(strength.Score >= policy.MinStrength, "password", validator.CodeTooWeak, "is too easy to guess")
+	}
+	if policy.Checker != nil && !failed() {
+		v.Check(!policy.Checker.Compromised(password), "password", validator.CodeCompromised, "is too common or has appeared in a data breach, please choose a different one")
+	}
+}
+
+// PasswordBlocklist is a set of passwords that may not be used.
+type PasswordBlocklist map[string]struct{}
+
+// LoadPasswordBlocklist reads a blocklist file with one password per line.
+// Blank lines are skipped.
+func LoadPasswordBlocklist(path string) (PasswordBlocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	blocklist := make(PasswordBlocklist)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		password := strings.TrimRight(scanner.Text(), "\r")
+		if password != "" {
+			blocklist[password] = struct{}{}
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return blocklist, nil
+}
+
+func (b PasswordBlocklist) Compromised(plaintextPassword string) bool {
+	_, found := b[plaintextPassword]
+	return found
+}
@@ -0,0 +1,262 @@
+package data
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrUnknownPasswordScheme = errors.New("unknown password hash scheme")
+	ErrInvalidPasswordHash   = errors.New("invalid password hash")
+	ErrPasswordTooLong       = errors.New("password too long for hash scheme")
+)
+
+// PasswordHasher is implemented by each supported password hashing scheme.
+// Every scheme encodes its own identifier in the hash it produces, so hashes
+// from different schemes can be stored side by side.
+type PasswordHasher interface {
+	Hash(plaintextPassword string) ([]byte, error)
+	Matches(hash []byte, plaintextPassword string) (bool, error)
+	// Handles reports whether the hash was produced by this scheme.
+	Handles(hash []byte) bool
+	// NeedsRehash reports whether the hash wasn't produced by this scheme
+	// with the hasher's current parameters.
+	NeedsRehash(hash []byte) bool
+	// MaxPasswordBytes is the longest password the scheme can hash, or zero
+	// if there's no limit.
+	MaxPasswordBytes() int
+}
+
+// passwordHashers lists the schemes used to verify stored hashes, regardless
+// of which one is currently used for hashing new passwords.
+var passwordHashers = []PasswordHasher{
+	BcryptHasher{},
+	Argon2idHasher{},
+}
+
+// dummyPasswordHashes holds a hash of dummyPassword for each hasher that
+// MatchesDummyPassword has been used with, keyed by the hasher itself so that
+// a change of parameters gets a new hash.
+var dummyPasswordHashes sync.Map
+
+// dummyPassword is never a user's password, as it's shorter than the minimum.
+const dummyPassword = "dummy"
+
+// dummyPasswordHash returns the hasher's dummy hash, making it on first use.
+func dummyPasswordHash(hasher PasswordHasher) ([]byte, error) {
+	if hash, ok := dummyPasswordHashes.Load(hasher); ok {
+		return hash.([]byte), nil
+	}
+
+	hash, err := hasher.Hash(dummyPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	actual, _ := dummyPasswordHashes.LoadOrStore(hasher, hash)
+	return actual.([]byte), nil
+}
+
+type password struct {
+	Plaintext *string
+	Hash      []byte
+}
+
+// Set hashes the password with the hasher. A password longer than the hasher
+// allows is kept as the plaintext, for ValidateUser to reject, but returns
+// ErrPasswordTooLong without being hashed.
+func (p *password) Set(plaintextPassword string, hasher PasswordHasher) error {
+	p.Plaintext = &plaintextPassword
+
+	if max := hasher.MaxPasswordBytes(); max > 0 && len(plaintextPassword) > max {
+		return ErrPasswordTooLong
+	}
+
+	hash, err := hasher.Hash(plaintextPassword)
+	if err != nil {
+		return err
+	}
+	p.Hash = hash
+	return nil
+}
+
+func (p *password) Matches(plaintextPassword string) (bool, error) {
+	for _, hasher := range passwordHashers {
+		if hasher.Handles(p.Hash) {
+			return hasher.Matches(p.Hash, plaintextPassword)
+		}
+	}
+	return false, ErrUnknownPasswordScheme
+}
+
+// NeedsRehash reports whether the stored hash was produced by a different
+// scheme than the given hasher, or with different parameters, such as an
+// older bcrypt cost.
+func (p *password) NeedsRehash(hasher PasswordHasher) bool {
+	return hasher.NeedsRehash(p.Hash)
+}
+
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(plaintextPassword string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(plaintextPassword), h.cost())
+}
+
+// cost is the cost hashes are made with, which like bcrypt itself falls back
+// to bcrypt.DefaultCost when Cost is too low.
+func (h BcryptHasher) cost() int {
+	if h.Cost < bcrypt.MinCost {
+		return bcrypt.DefaultCost
+	}
+	return h.Cost
+}
+
+func (h BcryptHasher) Matches(hash []byte, plaintextPassword string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword(hash, []byte(plaintextPassword))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (h BcryptHasher) Handles(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$2a$")) ||
+		bytes.HasPrefix(hash, []byte("$2b$")) ||
+		bytes.HasPrefix(hash, []byte("$2y$"))
+}
+
+func (h BcryptHasher) NeedsRehash(hash []byte) bool {
+	if !h.Handles(hash) {
+		return true
+	}
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != h.cost()
+}
+
+// MaxPasswordBytes is 72, as bcrypt ignores anything after that.
+func (h BcryptHasher) MaxPasswordBytes() int {
+	return 72
+}
+
+// Argon2idHasher produces hashes in the PHC string format, e.g.
+// $argon2id$v=19$m=65536,t=1,p=4$<salt>$<key>, so the parameters used for a
+// hash can change without invalidating older ones.
+type Argon2idHasher struct {
+	Time       uint32
+	Memory     uint32
+	Threads    uint8
+	SaltLength uint32
+	KeyLength  uint32
+}
+
+func DefaultArgon2idHasher() Argon2idHasher {
+	return Argon2idHasher{
+		Time:       1,
+		Memory:     64 * 1024,
+		Threads:    4,
+		SaltLength: 16,
+		KeyLength:  32,
+	}
+}
+
+func (h Argon2idHasher) Hash(plaintextPassword string) ([]byte, error) {
+	salt := make([]byte, h.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(plaintextPassword), salt, h.Time, h.Memory, h.Threads, h.KeyLength)
+
+	encoded := fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.Memory,
+		h.Time,
+		h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+	return []byte(encoded), nil
+}
+
+func (h Argon2idHasher) Matches(hash []byte, plaintextPassword string) (bool, error) {
+	params, salt, key, err := parseArgon2idHash(hash)
+	if err != nil {
+		return false, err
+	}
+
+	otherKey := argon2.IDKey([]byte(plaintextPassword), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
+
+func (h Argon2idHasher) Handles(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$argon2id$"))
+}
+
+func (h Argon2idHasher) NeedsRehash(hash []byte) bool {
+	if !h.Handles(hash) {
+		return true
+	}
+	params, salt, key, err := parseArgon2idHash(hash)
+	return err != nil ||
+		params.Memory != h.Memory ||
+		params.Time != h.Time ||
+		params.Threads != h.Threads ||
+		len(salt) != int(h.SaltLength) ||
+		len(key) != int(h.KeyLength)
+}
+
+// MaxPasswordBytes is zero, as argon2id hashes passwords of any length.
+func (h Argon2idHasher) MaxPasswordBytes() int {
+	return 0
+}
+
+// parseArgon2idHash splits a PHC string into the parameters, salt and key it
+// holds.
+func parseArgon2idHash(hash []byte) (params Argon2idHasher, salt, key []byte, err error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	return params, salt, key, nil
+}
@@ -0,0 +1,165 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mathiasb/greenlight/internal/validator"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testArgon2idHasher() Argon2idHasher {
+	return Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, SaltLength: 16, KeyLength: 32}
+}
+
+func TestPasswordSetMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		hasher PasswordHasher
+	}{
+		{"bcrypt minimum cost", BcryptHasher{Cost: bcrypt.MinCost}},
+		{"bcrypt higher cost", BcryptHasher{Cost: bcrypt.MinCost + 1}},
+		{"argon2id", testArgon2idHasher()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p password
+			if err := p.Set("pa55word123", tt.hasher); err != nil {
+				t.Fatal(err)
+			}
+
+			// Matches picks the scheme from the hash, not the hasher that
+			// made it, so any cost or parameters verify.
+			for plaintext, want := range map[string]bool{"pa55word123": true, "pa55word124": false, "": false} {
+				got, err := p.Matches(plaintext)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Errorf("Matches(%q) = %t; want %t", plaintext, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDummyPasswordHash(t *testing.T) {
+	tests := []struct {
+		name   string
+		hasher PasswordHasher
+	}{
+		{"bcrypt", BcryptHasher{Cost: bcrypt.MinCost}},
+		{"argon2id", testArgon2idHasher()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, err := dummyPasswordHash(tt.hasher)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.hasher.Handles(first) {
+				t.Fatalf("dummy hash %q wasn't made by the hasher", first)
+			}
+
+			second, err := dummyPasswordHash(tt.hasher)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(first, second) {
+				t.Error("dummy hash was made again rather than reused")
+			}
+		})
+	}
+}
+
+func TestPasswordNeedsRehash(t *testing.T) {
+	bcryptHasher := BcryptHasher{Cost: bcrypt.MinCost}
+	argon2idHasher := testArgon2idHasher()
+
+	hash := func(hasher PasswordHasher) []byte {
+		var p password
+		if err := p.Set("pa55word123", hasher); err != nil {
+			t.Fatal(err)
+		}
+		return p.Hash
+	}
+
+	moreMemory := argon2idHasher
+	moreMemory.Memory *= 2
+	longerKey := argon2idHasher
+	longerKey.KeyLength *= 2
+
+	tests := []struct {
+		name   string
+		hash   []byte
+		hasher PasswordHasher
+		want   bool
+	}{
+		{"same bcrypt cost", hash(bcryptHasher), bcryptHasher, false},
+		{"higher bcrypt cost", hash(bcryptHasher), BcryptHasher{Cost: bcrypt.MinCost + 1}, true},
+		{"bcrypt to argon2id", hash(bcryptHasher), argon2idHasher, true},
+		{"same argon2id parameters", hash(argon2idHasher), argon2idHasher, false},
+		{"more argon2id memory", hash(argon2idHasher), moreMemory, true},
+		{"longer argon2id key", hash(argon2idHasher), longerKey, true},
+		{"argon2id to bcrypt", hash(argon2idHasher), bcryptHasher, true},
+		{"malformed argon2id", []byte("$argon2id$v=19$garbage"), argon2idHasher, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := password{Hash: tt.hash}
+			if got := p.NeedsRehash(tt.hasher); got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePasswordPlaintextMaxBytes(t *testing.T) {
+	long := strings.Repeat("a", 73)
+
+	tests := []struct {
+		name     string
+		password string
+		hasher   PasswordHasher
+		valid    bool
+	}{
+		{"bcrypt at limit", long[:72], BcryptHasher{}, true},
+		{"bcrypt over limit", long, BcryptHasher{}, false},
+		{"bcrypt over limit in multi-byte runes", strings.Repeat("é", 37), BcryptHasher{}, false},
+		{"argon2id has no limit", strings.Repeat(long, 10), testArgon2idHasher(), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidatePasswordPlaintext(v, tt.password, tt.hasher)
+			if v.Valid() != tt.valid {
+				t.Errorf("got valid %t; want %t (%v)", v.Valid(), tt.valid, v.FieldErrors)
+			}
+		})
+	}
+}
+
+func TestPasswordSetTooLong(t *testing.T) {
+	var p password
+	err := p.Set(strings.Repeat("a", 73), BcryptHasher{Cost: bcrypt.MinCost})
+	if !errors.Is(err, ErrPasswordTooLong) {
+		t.Fatalf("got error %v; want %v", err, ErrPasswordTooLong)
+	}
+	if p.Plaintext == nil || p.Hash != nil {
+		t.Error("want the plaintext kept and no hash")
+	}
+
+	// ValidateUser reports the length rather than panicking on the missing
+	// hash.
+	v := validator.New()
+	ValidateUser(v, &User{Name: "Alice", Email: "alice@example.com", Password: p}, BcryptHasher{}, PasswordPolicy{})
+	if _, ok := v.FieldErrors["password"]; !ok {
+		t.Errorf("want a password error; got %v", v.FieldErrors)
+	}
+}
@@ -2,40 +2,90 @@ package data
 
 import (
 	"context"
-	"database/sql"
+	"database/sql/driver"
 	"slices"
-	"time"
 
 	"github.com/lib/pq"
 )
 
 type Permissions []string
 
+// Scan reads a PostgreSQL text[] into p, leaving it nil for NULL. pq.Array
+// doesn't recognise named slice types, so it can't be used for this.
+func (p *Permissions) Scan(src any) error {
+	return (*pq.StringArray)(p).Scan(src)
+}
+
+// Value writes p as a PostgreSQL text[], or NULL if p is nil.
+func (p Permissions) Value() (driver.Value, error) {
+	return pq.StringArray(p).Value()
+}
+
 func (p Permissions) Include(code string) bool {
 	return slices.Contains(p, code)
 }
 
+// Scoped returns the permissions in p that are also in scope, or all of p if
+// scope is nil.
+func (p Permissions) Scoped(scope Permissions) Permissions {
+	if scope == nil {
+		return p
+	}
+
+	var scoped Permissions
+	for _, code := range p {
+		if scope.Include(code) {
+			scoped = append(scoped, code)
+		}
+	}
+	return scoped
+}
+
 const (
-	PermissionRead  = "movies:read"
-	PermissionWrite = "movies:write"
+	PermissionRead             = "movies:read"
+	PermissionWrite            = "movies:write"
+	PermissionAdminMaintenance = "admin:maintenance"
+	PermissionAdminAudit       = "admin:audit"
+	PermissionMetricsRead      = "metrics:read"
+	PermissionAdminExport      = "admin:export"
+	PermissionAdminImport      = "admin:import"
+	PermissionAdminInvite      = "admin:invite"
+	PermissionAdminUsers       = "admin:users"
+	PermissionAdminDebug       = "admin:debug"
+	PermissionAdminMovies      = "admin:movies"
 )
 
+// AllPermissions lists every permission code.
+var AllPermissions = Permissions{
+	PermissionRead,
+	PermissionWrite,
+	PermissionAdminMaintenance,
+	PermissionAdminAudit,
+	PermissionMetricsRead,
+	PermissionAdminExport,
+	PermissionAdminImport,
+	PermissionAdminInvite,
+	PermissionAdminUsers,
+	PermissionAdminDebug,
+	PermissionAdminMovies,
+}
+
 type PermissionModel struct {
-	DB *sql.DB
+	DB *DB
 }
 
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
-	query := `
+const getPermissionsForUserQuery = `
 	SELECT permissions.code
 	FROM permissions
 	INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
 	INNER JOIN users ON users_permissions.user_id = users.id
 	WHERE users.id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query, userID)
+	rows, err := m.DB.QueryContext(ctx, getPermissionsForUserQuery, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -57,13 +107,18 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 }
 
 func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+	return m.AddForUserTx(m.DB, userID, codes...)
+}
+
+// AddForUserTx is AddForUser run with q, usually a transaction.
+func (m PermissionModel) AddForUserTx(q Querier, userID int64, codes ...string) error {
 	query := `
 	INSERT INTO users_permissions
 	SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	_, err := q.ExecContext(ctx, query, userID, pq.Array(codes))
 	return err
 }
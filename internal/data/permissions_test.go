@@ -0,0 +1,56 @@
+package data
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPermissionsScan(t *testing.T) {
+	tests := []struct {
+		name string
+		src  any
+		want Permissions
+	}{
+		{"array", []byte("{movies:read,admin:export}"), Permissions{PermissionRead, PermissionAdminExport}},
+		{"empty array", []byte("{}"), Permissions{}},
+		{"null", nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Permissions{PermissionWrite}
+			if err := p.Scan(tt.src); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(p, tt.want) || (p == nil) != (tt.want == nil) {
+				t.Errorf("got %#v; want %#v", p, tt.want)
+			}
+		})
+	}
+}
+
+func TestPermissionsValue(t *testing.T) {
+	tests := []struct {
+		name string
+		p    Permissions
+		want any
+	}{
+		{"permissions", Permissions{PermissionRead, PermissionAdminExport}, "{\"movies:read\",\"admin:export\"}"},
+		{"empty", Permissions{}, "{}"},
+		// A nil scope on a token grants all of the user's permissions, so it
+		// must stay distinct from an empty one.
+		{"nil", nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.p.Value()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %#v; want %#v", got, tt.want)
+			}
+		})
+	}
+}
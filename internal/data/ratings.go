@@ -0,0 +1,220 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mathiasb/greenlight/internal/validator"
+)
+
+// Rating is one user's 1-5 rating of a movie.
+type Rating struct {
+	MovieID int64 `json:"-"`
+	// MovieUUID is only set by EachForUser.
+	MovieUUID string    `json:"-"`
+	UserID    int64     `json:"-"`
+	Rating    int32     `json:"rating"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// RatingAggregate is the average and number of a movie's ratings, as stored on
+// the movie. The average is nil until the movie is first rated.
+type RatingAggregate struct {
+	Average *float64 `json:"average"`
+	Count   int64    `json:"count"`
+}
+
+func ValidateRating(v *validator.Validator, rating *Rating) {
+	v.Check(rating.Rating != 0, "rating", validator.CodeRequired, "must be provided")
+	v.Check(validator.Between(rating.Rating, 1, 5), "rating", validator.CodeOutOfRange, "must be between 1 and 5")
+}
+
+type RatingModel struct {
+	DB *DB
+}
+
+// Upsert records the user's rating of the movie, replacing any earlier one,
+// and returns the movie's new aggregate. The movie row is locked first so
+// that concurrent ratings of the same movie recompute the aggregate one after
+// the other, each seeing the ratings committed before it. The movie's
+// updated_at is bumped, as its representation changes, but not its version.
+func (m RatingModel) Upsert(ctx context.Context, rating *Rating) (RatingAggregate, error) {
+	ctx, cancel := m.DB.withQueryTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return RatingAggregate{}, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRowContext(ctx, `SELECT id FROM movies WHERE id = $1 FOR UPDATE`, rating.MovieID).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return RatingAggregate{}, ErrRecordNotFound
+		default:
+			return RatingAggregate{}, err
+		}
+	}
+
+	query := `
+	INSERT INTO movie_ratings (movie_id, user_id, rating)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (movie_id, user_id) DO UPDATE
+	SET rating = EXCLUDED.rating, updated_at = NOW()
+	RETURNING created_at, updated_at`
+
+	err = tx.QueryRowContext(ctx, query, rating.MovieID, rating.UserID, rating.Rating).Scan(&rating.CreatedAt, &rating.UpdatedAt)
+	if err != nil {
+		return RatingAggregate{}, err
+	}
+
+	query = `
+	UPDATE movies
+	SET rating_average = ratings.average, rating_count = ratings.count, updated_at = NOW()
+	FROM (SELECT round(avg(rating), 2) AS average, count(*) AS count FROM movie_ratings WHERE movie_id = $1) AS ratings
+	WHERE movies.id = $1
+	RETURNING movies.rating_average, movies.rating_count`
+
+	var aggregate RatingAggregate
+	err = tx.QueryRowContext(ctx, query, rating.MovieID).Scan(&aggregate.Average, &aggregate.Count)
+	if err != nil {
+		return RatingAggregate{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return RatingAggregate{}, err
+	}
+	return aggregate, nil
+}
+
+// Get returns the user's rating of the movie.
+func (m RatingModel) Get(ctx context.Context, movieID, userID int64) (*Rating, error) {
+	query := `
+	SELECT movie_id, user_id, rating, created_at, updated_at
+	FROM movie_ratings
+	WHERE movie_id = $1 AND user_id = $2`
+
+	ctx, cancel := m.DB.withQueryTimeout(ctx)
+	defer cancel()
+
+	var rating Rating
+	err := m.DB.QueryRowContext(ctx, query, movieID, userID).Scan(
+		&rating.MovieID,
+		&rating.UserID,
+		&rating.Rating,
+		&rating.CreatedAt,
+		&rating.UpdatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &rating, nil
+}
+
+// EachForUser calls fn for every rating the user has made, oldest first, as
+// the rows are read from the database. Iteration stops at the first error
+// returned by fn, or when ctx is cancelled.
+func (m RatingModel) EachForUser(ctx context.Context, userID int64, fn func(*Rating) error) error {
+	query := `
+	SELECT movie_ratings.movie_id, movies.uuid, movie_ratings.user_id, movie_ratings.rating,
+		movie_ratings.created_at, movie_ratings.updated_at
+	FROM movie_ratings
+	INNER JOIN movies ON movies.id = movie_ratings.movie_id
+	WHERE movie_ratings.user_id = $1
+	ORDER BY movie_ratings.created_at ASC, movie_ratings.movie_id ASC`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rating Rating
+
+		err = rows.Scan(
+			&rating.MovieID,
+			&rating.MovieUUID,
+			&rating.UserID,
+			&rating.Rating,
+			&rating.CreatedAt,
+			&rating.UpdatedAt)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&rating)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// DeleteAllForUserTx deletes the user's ratings, run with q, usually a
+// transaction, and recomputes the aggregates of the movies they rated. It
+// returns the IDs of those movies. As in Upsert, the movies are locked first,
+// in ID order so that concurrent deletions can't deadlock, and their
+// updated_at is bumped.
+func (m RatingModel) DeleteAllForUserTx(q Querier, userID int64) ([]int64, error) {
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
+	defer cancel()
+
+	query := `
+	SELECT id FROM movies
+	WHERE id IN (SELECT movie_id FROM movie_ratings WHERE user_id = $1)
+	ORDER BY id
+	FOR UPDATE`
+
+	rows, err := q.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = q.ExecContext(ctx, `DELETE FROM movie_ratings WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+	UPDATE movies
+	SET rating_average = (SELECT round(avg(rating), 2) FROM movie_ratings WHERE movie_id = movies.id),
+		rating_count = (SELECT count(*) FROM movie_ratings WHERE movie_id = movies.id),
+		updated_at = NOW()
+	WHERE id = ANY($1)`
+
+	_, err = q.ExecContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
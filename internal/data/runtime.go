@@ -16,6 +16,11 @@ func (r Runtime) MarshalJSON() ([]byte, error) {
 	return []byte(quotedJson), nil
 }
 
+// MarshalText gives the same "<n> mins" form for XML.
+func (r Runtime) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d mins", r)), nil
+}
+
 func (r *Runtime) UnmarshalJSON(jsonValue []byte) error {
 	unquotedJSONValue, err := strconv.Unquote(string(jsonValue))
 	if err != nil {
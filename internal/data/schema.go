@@ -0,0 +1,31 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// SchemaModel reads the state of the migrations that golang-migrate records in
+// the schema_migrations table.
+type SchemaModel struct {
+	DB *DB
+}
+
+// Version returns the current schema version, and whether the last migration
+// failed part way through. It's version 0 if no migration has been applied.
+func (m SchemaModel) Version(ctx context.Context) (version int, dirty bool, err error) {
+	query := `
+	SELECT version, dirty
+	FROM schema_migrations
+	LIMIT 1`
+
+	ctx, cancel := m.DB.withQueryTimeout(ctx)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query).Scan(&version, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	return version, dirty, err
+}
@@ -0,0 +1,53 @@
+package data
+
+import (
+	"database/sql"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// newTestModels connects to the migrated database named by
+// GREENLIGHT_TEST_DB_DSN, skipping the test if it isn't set.
+func newTestModels(t *testing.T) Models {
+	t.Helper()
+
+	dsn := os.Getenv("GREENLIGHT_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("GREENLIGHT_TEST_DB_DSN not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return NewModels(NewDB(db, logger, time.Second, 5*time.Second), testArgon2idHasher(), PasswordPolicy{})
+}
+
+// insertTestUser adds an activated user with a unique email, deleting it
+// along with its tokens and permissions when the test ends.
+func insertTestUser(t *testing.T, models Models) *User {
+	t.Helper()
+
+	user := &User{Name: "Test User", Email: t.Name() + "." + time.Now().Format("150405.000000000") + "@example.com", Activated: true}
+	if err := user.Password.Set("pa55word123", models.Users.Hasher); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.Users.Insert(user); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := models.DB.Exec("DELETE FROM users WHERE id = $1", user.ID); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return user
+}
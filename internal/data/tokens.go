@@ -4,8 +4,8 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/base32"
+	"encoding/hex"
 	"time"
 
 	"github.com/mathiasb/greenlight/internal/validator"
@@ -14,18 +14,39 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopeInvite         = "invite"
 )
 
+// SessionHashPrefixLength is the number of hex characters of a token hash
+// used to identify a session to its user.
+const SessionHashPrefixLength = 16
+
 type Token struct {
-	Plaintext string    `json:"token"`
-	Hash      []byte    `json:"-"`
-	UserID    int64     `json:"-"`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	Plaintext   string    `json:"token"`
+	Hash        []byte    `json:"-"`
+	UserID      int64     `json:"-"`
+	Expiry      time.Time `json:"expiry"`
+	Scope       string    `json:"-"`
+	DeviceLabel string    `json:"-"`
+	IP          string    `json:"-"`
+	// Permissions limits a scoped authentication token to these of its
+	// user's permissions. It's nil for a token with all of them.
+	Permissions Permissions `json:"permissions,omitempty"`
+}
+
+// Session describes an active authentication token without exposing the
+// token itself.
+type Session struct {
+	HashPrefix  string      `json:"hash_prefix"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Expiry      time.Time   `json:"expiry"`
+	DeviceLabel string      `json:"device_label"`
+	IP          string      `json:"ip"`
+	Permissions Permissions `json:"permissions,omitempty"`
 }
 
 type TokenModel struct {
-	DB *sql.DB
+	DB *DB
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -49,8 +70,19 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 }
 
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
-	v.Check(tokenPlaintext != "", "token", "must be provided")
-	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
+	v.Check(tokenPlaintext != "", "token", validator.CodeRequired, "must be provided")
+	v.Check(len(tokenPlaintext) == 26, "token", validator.CodeInvalidFormat, "must be 26 bytes long")
+}
+
+// ValidateTokenPermissions checks the permissions requested for a scoped
+// token.
+func ValidateTokenPermissions(v *validator.Validator, permissions Permissions) {
+	v.Check(permissions != nil, "permissions", validator.CodeRequired, "must be provided")
+	v.Check(len(permissions) >= 1, "permissions", validator.CodeTooFew, "must contain at least 1 permission")
+	v.Check(validator.Unique(permissions), "permissions", validator.CodeNotUnique, "must not contain duplicate values")
+	for _, code := range permissions {
+		v.Check(validator.PermittedValue(code, AllPermissions...), "permissions", validator.CodeNotPermitted, "must only contain known permission codes")
+	}
 }
 
 func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -63,14 +95,30 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// NewAuthentication creates an authentication token, recording the device and
+// IP address it was issued to so it can be listed as a session. A non-nil
+// permissions scopes the token to those permissions.
+func (m TokenModel) NewAuthentication(userID int64, ttl time.Duration, deviceLabel, ip string, permissions Permissions) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+	token.DeviceLabel = deviceLabel
+	token.IP = ip
+	token.Permissions = permissions
+
+	err = m.Insert(token)
+	return token, err
+}
+
 func (m TokenModel) Insert(token *Token) error {
 	query := `
-	INSERT INTO tokens (hash, user_id, expiry, scope)
-	VALUES ($1, $2, $3, $4)`
+	INSERT INTO tokens (hash, user_id, expiry, scope, device_label, ip, permissions)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)`
 
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.DeviceLabel, token.IP, token.Permissions}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
@@ -78,13 +126,81 @@ func (m TokenModel) Insert(token *Token) error {
 }
 
 func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+	return m.DeleteAllForUserTx(m.DB, scope, userID)
+}
+
+// DeleteAllForUserTx is DeleteAllForUser run with q, usually a transaction.
+func (m TokenModel) DeleteAllForUserTx(q Querier, scope string, userID int64) error {
 	query := `
 	DELETE FROM tokens
 	WHERE scope = $1 AND user_id = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, scope, userID)
+	_, err := q.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+func (m TokenModel) GetSessionsForUser(userID int64) ([]*Session, error) {
+	query := `
+	SELECT hash, created_at, expiry, device_label, ip, permissions
+	FROM tokens
+	WHERE user_id = $1 AND scope = $2 AND expiry > $3
+	ORDER BY created_at DESC`
+
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, ScopeAuthentication, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var (
+			session Session
+			hash    []byte
+		)
+
+		err := rows.Scan(&hash, &session.CreatedAt, &session.Expiry, &session.DeviceLabel, &session.IP, &session.Permissions)
+		if err != nil {
+			return nil, err
+		}
+
+		session.HashPrefix = hex.EncodeToString(hash)[:SessionHashPrefixLength]
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (m TokenModel) DeleteSessionForUser(userID int64, hashPrefix string) error {
+	query := `
+	DELETE FROM tokens
+	WHERE user_id = $1 AND scope = $2 AND substr(encode(hash, 'hex'), 1, $3) = $4`
+
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, ScopeAuthentication, SessionHashPrefixLength, hashPrefix)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package data
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestScopedAuthenticationToken(t *testing.T) {
+	models := newTestModels(t)
+	user := insertTestUser(t, models)
+
+	tests := []struct {
+		name        string
+		permissions Permissions
+	}{
+		{"scoped", Permissions{PermissionRead}},
+		{"unscoped", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := models.Tokens.NewAuthentication(user.ID, time.Hour, tt.name, "192.0.2.1", tt.permissions)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := models.Users.GetForToken(ScopeAuthentication, token.Plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != user.ID {
+				t.Errorf("got user %d; want %d", got.ID, user.ID)
+			}
+			if !slices.Equal(got.TokenPermissions, tt.permissions) || (got.TokenPermissions == nil) != (tt.permissions == nil) {
+				t.Errorf("got token permissions %#v; want %#v", got.TokenPermissions, tt.permissions)
+			}
+
+			sessions, err := models.Tokens.GetSessionsForUser(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			i := slices.IndexFunc(sessions, func(s *Session) bool { return s.DeviceLabel == tt.name })
+			if i < 0 {
+				t.Fatalf("no session labelled %q", tt.name)
+			}
+			if !slices.Equal(sessions[i].Permissions, tt.permissions) {
+				t.Errorf("got session permissions %#v; want %#v", sessions[i].Permissions, tt.permissions)
+			}
+		})
+	}
+}
@@ -3,12 +3,15 @@ package data
 import (
 	"context"
 	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
 	"errors"
+	"regexp"
 	"time"
 
 	"github.com/mathiasb/greenlight/internal/validator"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
 )
 
 var (
@@ -16,63 +19,111 @@ var (
 )
 
 type User struct {
-	ID        int64    `json:"id"`
-	CreatedAt string   `json:"created_at"`
-	Name      string   `json:"name"`
-	Email     string   `json:"email"`
-	Password  password `json:"-"`
-	Activated bool     `json:"activated"`
-	Version   int      `json:"-"`
-}
-
-type password struct {
-	Plaintext *string
-	Hash      []byte
+	ID          int64      `json:"id"`
+	CreatedAt   string     `json:"created_at"`
+	Name        string     `json:"name"`
+	Email       string     `json:"email"`
+	Password    password   `json:"-"`
+	Activated   bool       `json:"activated"`
+	MFAEnabled  bool       `json:"mfa_enabled"`
+	TOTPSecret  string     `json:"-"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+	LastLoginIP string     `json:"last_login_ip"`
+	Version     int        `json:"-"`
+	// TokenExpiry is when the token the user was looked up by expires, if
+	// they were looked up by one.
+	TokenExpiry time.Time `json:"-"`
+	// TokenPermissions is the scope of that token, or nil if it grants all of
+	// the user's permissions.
+	TokenPermissions Permissions `json:"-"`
 }
 
 type UserModel struct {
-	DB *sql.DB
+	DB             *DB
+	Hasher         PasswordHasher
+	PasswordPolicy PasswordPolicy
 }
 
 var AnonymousUser = &User{}
 
-func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+// MatchesDummyPassword checks the given password against a dummy hash made
+// with the active hasher, and discards the result. It is used when a login
+// email doesn't exist so that the response takes as long as a failed password
+// check, and timing can't be used to discover which email addresses are
+// registered.
+func (m UserModel) MatchesDummyPassword(plaintextPassword string) {
+	hash, err := dummyPasswordHash(m.Hasher)
 	if err != nil {
-		return err
+		m.Hasher.Hash(plaintextPassword)
+		return
 	}
-	p.Plaintext = &plaintextPassword
-	p.Hash = hash
-	return nil
+	m.Hasher.Matches(hash, plaintextPassword)
 }
 
-func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.Hash, []byte(plaintextPassword))
+// GenerateTOTP creates a new TOTP secret for the user and returns the
+// otpauth:// URI that can be loaded into an authenticator app. The secret is
+// only persisted once the caller saves the user.
+func (u *User) GenerateTOTP(issuer string) (string, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: u.Email,
+	})
 	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
+		return "", err
+	}
+	u.TOTPSecret = key.Secret()
+	return key.URL(), nil
+}
+
+// totpPeriod is how many seconds each TOTP code is valid for.
+const totpPeriod = 30
+
+// totpCodeRX matches a six digit TOTP code.
+var totpCodeRX = regexp.MustCompile(`^[0-9]{6}$`)
+
+// totpStep returns the time step that code belongs to, if it's valid for the
+// user's secret at now. Codes from the steps either side of the current one
+// are accepted too, to allow for clock drift.
+func (u *User) totpStep(code string, now time.Time) (int64, bool) {
+	if u.TOTPSecret == "" {
+		return 0, false
+	}
+
+	opts := totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+	current := now.Unix() / totpPeriod
+
+	for _, step := range []int64{current, current - 1, current + 1} {
+		expected, err := totp.GenerateCodeCustom(u.TOTPSecret, time.Unix(step*totpPeriod, 0), opts)
+		if err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
 		}
 	}
-	return true, nil
+	return 0, false
+}
+
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "totp_code", validator.CodeRequired, "must be provided")
+	v.Check(code == "" || totpCodeRX.MatchString(code), "totp_code", validator.CodeInvalidFormat, "must be 6 digits long")
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
-	v.Check(email != "", "email", "must be provided")
-	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
+	v.Check(email != "", "email", validator.CodeRequired, "must be provided")
+	v.Check(validator.Matches(email, validator.EmailRX), "email", validator.CodeInvalidFormat, "must be a valid email address")
 }
 
-func ValidatePasswordPlaintext(v *validator.Validator, password string) {
-	v.Check(password != "", "password", "must be provided")
-	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+// ValidatePasswordPlaintext checks the password's length, including any limit
+// the hasher has on it.
+func ValidatePasswordPlaintext(v *validator.Validator, password string, hasher PasswordHasher) {
+	v.Check(password != "", "password", validator.CodeRequired, "must be provided")
+	v.Check(validator.MinRunes(password, 8), "password", validator.CodeTooShort, "must be at least 8 characters long")
+	if max := hasher.MaxPasswordBytes(); max > 0 {
+		v.Checkf(len(password) <= max, "password", validator.CodeTooLong, "must not be more than %d bytes long", max)
+	}
 }
 
-func ValidateUser(v *validator.Validator, user *User) {
-	v.Check(user.Name != "", "name", "must be provided")
-	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
+func ValidateUser(v *validator.Validator, user *User, hasher PasswordHasher, policy PasswordPolicy) {
+	v.Check(validator.NotBlank(user.Name), "name", validator.CodeRequired, "must be provided")
+	v.Check(validator.MaxRunes(user.Name, 500), "name", validator.CodeTooLong, "must not be more than 500 characters long")
 
 	// Call the standalone ValidateEmail() helper.
 	ValidateEmail(v, user.Email)
@@ -80,20 +131,27 @@ func ValidateUser(v *validator.Validator, user *User) {
 	// If the plaintext password is not nil, call the standalone
 	// ValidatePasswordPlaintext() helper.
 	if user.Password.Plaintext != nil {
-		ValidatePasswordPlaintext(v, *user.Password.Plaintext)
+		ValidatePasswordPlaintext(v, *user.Password.Plaintext, hasher)
+		ValidatePasswordPolicy(v, *user.Password.Plaintext, policy, user.Name, user.Email)
 	}
 
 	// If the password hash is ever nil, this will be due to a logic error in our
 	// codebase (probably because we forgot to set a password for the user). It's a
 	// useful sanity check to include here, but it's not a problem with the data
 	// provided by the client. So rather than adding an error to the validation map we
-	// raise a panic instead.
-	if user.Password.Hash == nil {
+	// raise a panic instead. The exception is a password too long to hash,
+	// which ValidatePasswordPlaintext has already rejected.
+	if _, failed := v.FieldErrors["password"]; user.Password.Hash == nil && !failed {
 		panic("missing password hash for user")
 	}
 }
 
 func (m UserModel) Insert(user *User) error {
+	return m.InsertTx(m.DB, user)
+}
+
+// InsertTx is Insert run with q, usually a transaction.
+func (m UserModel) InsertTx(q Querier, user *User) error {
 	query := `
 	INSERT INTO users (name, email, password_hash, activated)
 	VALUES ($1, $2, $3, $4)
@@ -101,10 +159,10 @@ func (m UserModel) Insert(user *User) error {
 
 	args := []any{user.Name, user.Email, user.Password.Hash, user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+	err := q.QueryRowContext(ctx, query, args...).Scan(
 		&user.ID,
 		&user.CreatedAt,
 		&user.Version)
@@ -119,14 +177,54 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+	SELECT id, created_at, name, email, password_hash, activated, mfa_enabled, totp_secret,
+		last_login_at, last_login_ip, version
+	FROM users
+	WHERE id = $1`
+	var user User
+
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.Hash,
+		&user.Activated,
+		&user.MFAEnabled,
+		&user.TOTPSecret,
+		&user.LastLoginAt,
+		&user.LastLoginIP,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-	SELECT id, created_at, name, email, password_hash, activated, version
+	SELECT id, created_at, name, email, password_hash, activated, mfa_enabled, totp_secret,
+		last_login_at, last_login_ip, version
 	FROM users
 	WHERE email = $1`
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -136,6 +234,10 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.Hash,
 		&user.Activated,
+		&user.MFAEnabled,
+		&user.TOTPSecret,
+		&user.LastLoginAt,
+		&user.LastLoginIP,
 		&user.Version,
 	)
 	if err != nil {
@@ -150,10 +252,16 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 }
 
 func (m UserModel) Update(user *User) error {
+	return m.UpdateTx(m.DB, user)
+}
+
+// UpdateTx is Update run with q, usually a transaction.
+func (m UserModel) UpdateTx(q Querier, user *User) error {
 	query := `
 	UPDATE users
-	SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-	WHERE id = $5 AND version = $6
+	SET name = $1, email = $2, password_hash = $3, activated = $4, mfa_enabled = $5, totp_secret = $6,
+		version = version + 1
+	WHERE id = $7 AND version = $8
 	RETURNING version`
 
 	args := []any{
@@ -161,14 +269,16 @@ func (m UserModel) Update(user *User) error {
 		user.Email,
 		user.Password.Hash,
 		user.Activated,
+		user.MFAEnabled,
+		user.TOTPSecret,
 		user.ID,
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	err := q.QueryRowContext(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -182,11 +292,93 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
-	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+// RecordLogin stores the time and IP address of a successful login. It doesn't
+// bump the version, so it can't cause edit conflicts with other updates.
+func (m UserModel) RecordLogin(user *User, ip string) error {
+	query := `
+	UPDATE users
+	SET last_login_at = NOW(), last_login_ip = $1
+	WHERE id = $2
+	RETURNING last_login_at, last_login_ip`
+
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, ip, user.ID).Scan(&user.LastLoginAt, &user.LastLoginIP)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteTx deletes the user, run with q, usually a transaction. Their tokens,
+// permissions, idempotency keys and ratings go with them; the movies they
+// created and audit log entries are kept with the user removed. Ratings
+// should be deleted first with RatingModel.DeleteAllForUserTx, so that movie
+// aggregates are recomputed.
+func (m UserModel) DeleteTx(q Querier, user *User) error {
+	query := `
+	DELETE FROM users
+	WHERE id = $1 AND version = $2`
+
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
+	defer cancel()
+
+	result, err := q.ExecContext(ctx, query, user.ID, user.Version)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+	return nil
+}
+
+// ConsumeTOTP reports whether code is a valid TOTP code for the user that
+// hasn't been accepted before. The time step of an accepted code is recorded,
+// so that neither it nor an earlier code can be replayed, even by a concurrent
+// request. It doesn't bump the version.
+func (m UserModel) ConsumeTOTP(user *User, code string) (bool, error) {
+	step, ok := user.totpStep(code, time.Now())
+	if !ok {
+		return false, nil
+	}
 
 	query := `
-	SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+	UPDATE users
+	SET totp_last_step = $1
+	WHERE id = $2 AND totp_last_step < $1`
+
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, step, user.ID)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+const getUserForTokenQuery = `
+	SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated,
+		users.mfa_enabled, users.totp_secret, users.last_login_at, users.last_login_ip, users.version,
+		tokens.expiry, tokens.permissions
 	FROM users
 	INNER JOIN tokens
 	ON users.id = tokens.user_id
@@ -194,21 +386,35 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	AND tokens.scope = $2
 	AND tokens.expiry > $3`
 
-	args := []any{tokenHash[:], tokenScope, time.Now()}
+func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	return m.GetForTokenHash(tokenScope, tokenHash[:])
+}
+
+// GetForTokenHash is GetForToken for callers that only know the token's
+// SHA-256 hash, such as a JWT whose ID claim references a stored token.
+func (m UserModel) GetForTokenHash(tokenScope string, tokenHash []byte) (*User, error) {
+	args := []any{tokenHash, tokenScope, time.Now()}
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.DB.withQueryTimeout(context.Background())
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+	err := m.DB.QueryRowContext(ctx, getUserForTokenQuery, args...).Scan(
 		&user.ID,
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
 		&user.Password.Hash,
 		&user.Activated,
+		&user.MFAEnabled,
+		&user.TOTPSecret,
+		&user.LastLoginAt,
+		&user.LastLoginIP,
 		&user.Version,
+		&user.TokenExpiry,
+		&user.TokenPermissions,
 	)
 	if err != nil {
 		switch {
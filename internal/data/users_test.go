@@ -0,0 +1,115 @@
+package data
+
+import (
+	"maps"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mathiasb/greenlight/internal/validator"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+func TestValidateTOTPCode(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  string
+		valid bool
+	}{
+		{"valid", "123456", true},
+		{"empty", "", false},
+		{"too short", "12345", false},
+		{"too long", "1234567", false},
+		{"letters", "12a456", false},
+		{"spaces", "123 56", false},
+		{"multi-byte digits", "１２３４５６", false},
+		{"trailing newline", "123456\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateTOTPCode(v, tt.code)
+
+			if v.Valid() != tt.valid {
+				t.Errorf("got valid %t; want %t (%v)", v.Valid(), tt.valid, v.FieldErrors)
+			}
+		})
+	}
+}
+
+func TestUserTOTPStep(t *testing.T) {
+	const secret = "JBSWY3DPEHPK3PXP"
+
+	now := time.Unix(1_700_000_000, 0)
+	current := now.Unix() / totpPeriod
+
+	codeAt := func(step int64) string {
+		code, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", secret, codeAt(current), current, true},
+		{"previous step", secret, codeAt(current - 1), current - 1, true},
+		{"next step", secret, codeAt(current + 1), current + 1, true},
+		{"two steps ago", secret, codeAt(current - 2), 0, false},
+		{"wrong code", secret, "000000", 0, false},
+		{"no secret", "", codeAt(current), 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &User{TOTPSecret: tt.secret}
+
+			step, ok := user.totpStep(tt.code, now)
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Errorf("got (%d, %t); want (%d, %t)", step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestValidateCredentialCodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		hasher   PasswordHasher
+		want     map[string]string
+	}{
+		{"valid", "alice@example.com", "pa55word", BcryptHasher{}, map[string]string{}},
+		{"no email", "", "pa55word", BcryptHasher{}, map[string]string{"email": validator.CodeRequired}},
+		{"bad email", "alice", "pa55word", BcryptHasher{}, map[string]string{"email": validator.CodeInvalidFormat}},
+		{"no password", "alice@example.com", "", BcryptHasher{}, map[string]string{"password": validator.CodeRequired}},
+		{"short password", "alice@example.com", "pa55", BcryptHasher{}, map[string]string{"password": validator.CodeTooShort}},
+		{"long password for bcrypt", "alice@example.com", strings.Repeat("a", 73), BcryptHasher{}, map[string]string{"password": validator.CodeTooLong}},
+		{"long password for argon2id", "alice@example.com", strings.Repeat("a", 73), Argon2idHasher{}, map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateEmail(v, tt.email)
+			ValidatePasswordPlaintext(v, tt.password, tt.hasher)
+
+			if got := fieldCodes(v); !maps.Equal(got, tt.want) {
+				t.Errorf("got codes %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package hibp
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const rangeURL = "https://api.pwnedpasswords.com/range/"
+
+// Checker looks passwords up in the Have I Been Pwned Pwned Passwords API.
+// Only the first five characters of the password's SHA-1 hash are sent, and
+// the match is done locally against the returned suffixes (k-anonymity).
+type Checker struct {
+	client *http.Client
+	// onError is called when the API can't be reached. The password is then
+	// treated as not compromised, so an outage doesn't block sign-ups.
+	onError func(error)
+}
+
+func New(onError func(error)) Checker {
+	return Checker{
+		client:  &http.Client{Timeout: 5 * time.Second},
+		onError: onError,
+	}
+}
+
+func (c Checker) Compromised(plaintextPassword string) bool {
+	compromised, err := c.lookup(plaintextPassword)
+	if err != nil {
+		if c.onError != nil {
+			c.onError(err)
+		}
+		return false
+	}
+	return compromised
+}
+
+func (c Checker) lookup(plaintextPassword string) (bool, error) {
+	sum := sha1.Sum([]byte(plaintextPassword))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	req, err := http.NewRequest(http.MethodGet, rangeURL+prefix, nil)
+	if err != nil {
+		return false, err
+	}
+	// Padding hides the number of real matches from anyone watching the
+	// response sizes.
+	req.Header.Set("Add-Padding", "true")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("pwned passwords API responded with status %d", res.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		candidate, count, found := strings.Cut(scanner.Text(), ":")
+		// Padding entries have a count of zero.
+		if found && candidate == suffix && strings.TrimSpace(count) != "0" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
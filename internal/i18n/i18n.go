@@ -0,0 +1,111 @@
+// Package i18n translates the API's error messages. A message is keyed by its
+// English text, a fmt format string, so English needs no catalog and is used
+// whenever a translation is missing.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+//go:embed locales/*.json
+var localesFS embed.FS
+
+var (
+	// supported lists English first, so that it's the fallback when nothing
+	// in an Accept-Language header matches.
+	supported = []language.Tag{language.English}
+	catalogs  = map[language.Tag]map[string]string{}
+	matcher   language.Matcher
+)
+
+func init() {
+	entries, err := fs.ReadDir(localesFS, "locales")
+	if err != nil {
+		panic(err)
+	}
+
+	for _, entry := range entries {
+		b, err := fs.ReadFile(localesFS, path.Join("locales", entry.Name()))
+		if err != nil {
+			panic(err)
+		}
+
+		var catalog map[string]string
+		err = json.Unmarshal(b, &catalog)
+		if err != nil {
+			panic(fmt.Sprintf("locales/%s: %v", entry.Name(), err))
+		}
+
+		tag := language.MustParse(strings.TrimSuffix(entry.Name(), ".json"))
+		supported = append(supported, tag)
+		catalogs[tag] = catalog
+	}
+
+	matcher = language.NewMatcher(supported)
+}
+
+// Negotiate returns the supported language that best matches an
+// Accept-Language header, or English.
+func Negotiate(acceptLanguage string) language.Tag {
+	_, i := language.MatchStrings(matcher, acceptLanguage)
+	return supported[i]
+}
+
+// Translate formats the message key with args in the given language.
+func Translate(tag language.Tag, key string, args ...any) string {
+	format := key
+	if translated, ok := catalogs[tag][key]; ok {
+		format = translated
+	}
+
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// Message is a message key with the arguments to format it with, kept apart
+// until the language of the response is known.
+type Message struct {
+	Key  string
+	Args []any
+}
+
+func NewMessage(key string, args ...any) Message {
+	return Message{Key: key, Args: args}
+}
+
+// String returns the message in English.
+func (m Message) String() string {
+	return Translate(language.English, m.Key, m.Args...)
+}
+
+func (m Message) Translate(tag language.Tag) string {
+	return Translate(tag, m.Key, m.Args...)
+}
+
+// MarshalJSON encodes the message in English.
+func (m Message) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+// Error is an error whose message can be translated.
+type Error struct {
+	Message
+}
+
+// Errorf returns an Error for the message key and args.
+func Errorf(key string, args ...any) error {
+	return &Error{NewMessage(key, args...)}
+}
+
+func (e *Error) Error() string {
+	return e.String()
+}
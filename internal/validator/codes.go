@@ -0,0 +1,22 @@
+package validator
+
+// Codes are machine-readable reasons for a validation error, sent alongside
+// the message so that clients can branch on them. They're part of the API, so
+// existing codes must not change.
+const (
+	CodeRequired      = "REQUIRED"
+	CodeInvalid       = "INVALID"
+	CodeInvalidFormat = "INVALID_FORMAT"
+	CodeTooShort      = "TOO_SHORT"
+	CodeTooLong       = "TOO_LONG"
+	CodeTooSmall      = "TOO_SMALL"
+	CodeTooLarge      = "TOO_LARGE"
+	CodeOutOfRange    = "OUT_OF_RANGE"
+	CodeTooFew        = "TOO_FEW"
+	CodeTooMany       = "TOO_MANY"
+	CodeNotUnique     = "NOT_UNIQUE"
+	CodeNotPermitted  = "NOT_PERMITTED"
+	CodeAlreadyExists = "ALREADY_EXISTS"
+	CodeTooWeak       = "TOO_WEAK"
+	CodeCompromised   = "COMPROMISED"
+)
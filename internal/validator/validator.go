@@ -1,16 +1,35 @@
 package validator
 
 import (
+	"cmp"
+	"net/url"
 	"regexp"
 	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mathiasb/greenlight/internal/i18n"
 )
 
 var (
 	EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 )
 
+// FieldError is a single validation failure. Unlike FieldErrors, the ordered
+// Errors slice can hold several of these for the same field.
+type FieldError struct {
+	Field   string       `json:"field"`
+	Code    string       `json:"code"`
+	Message i18n.Message `json:"message"`
+}
+
+// Validator keeps messages as i18n keys and arguments, so that they can be
+// translated when the response is written. FieldErrors has the first error
+// for each field, in English.
 type Validator struct {
-	FieldErrors map[string]string
+	FieldErrors    map[string]string
+	Errors         []FieldError
+	NonFieldErrors []i18n.Message
 }
 
 func New() *Validator {
@@ -18,18 +37,48 @@ func New() *Validator {
 }
 
 func (v *Validator) Valid() bool {
-	return len(v.FieldErrors) == 0
+	return len(v.FieldErrors) == 0 && len(v.NonFieldErrors) == 0
+}
+
+// AddError adds an error for the field key, with one of the Code constants.
+func (v *Validator) AddError(key, code, message string) {
+	v.AddErrorf(key, code, message)
 }
 
-func (v *Validator) AddError(key, message string) {
+// AddErrorf adds an error whose message is formatted from the i18n key format
+// and args.
+func (v *Validator) AddErrorf(key, code, format string, args ...any) {
+	message := i18n.NewMessage(format, args...)
 	if _, exists := v.FieldErrors[key]; !exists {
-		v.FieldErrors[key] = message
+		v.FieldErrors[key] = message.String()
+	}
+	v.Errors = append(v.Errors, FieldError{Field: key, Code: code, Message: message})
+}
+
+// AddNonFieldError records an error that relates to the input as a whole
+// rather than to one specific field.
+func (v *Validator) AddNonFieldError(message string) {
+	v.NonFieldErrors = append(v.NonFieldErrors, i18n.NewMessage(message))
+}
+
+func (v *Validator) Check(ok bool, key, code, message string) {
+	if !ok {
+		v.AddError(key, code, message)
+	}
+}
+
+// Checkf is Check with a formatted message.
+func (v *Validator) Checkf(ok bool, key, code, format string, args ...any) {
+	if !ok {
+		v.AddErrorf(key, code, format, args...)
 	}
 }
 
-func (v *Validator) Check(ok bool, key, message string) {
+// CheckForm adds a non-field error if ok is false, for rules that span several
+// fields.
+func (v *Validator) CheckForm(ok bool, message string) {
 	if !ok {
-		v.AddError(key, message)
+		v.AddNonFieldError(message)
 	}
 }
 
@@ -50,3 +99,41 @@ func Unique[T comparable](values []T) bool {
 
 	return len(values) == len(uniqueValues)
 }
+
+func NotBlank(value string) bool {
+	return strings.TrimSpace(value) != ""
+}
+
+// MinRunes and MaxRunes count characters rather than bytes, so multi-byte
+// characters aren't penalised.
+func MinRunes(value string, n int) bool {
+	return utf8.RuneCountInString(value) >= n
+}
+
+func MaxRunes(value string, n int) bool {
+	return utf8.RuneCountInString(value) <= n
+}
+
+func Between[T cmp.Ordered](value, min, max T) bool {
+	return value >= min && value <= max
+}
+
+// IsURL reports whether value is an absolute http or https URL with a host.
+func IsURL(value string) bool {
+	u, err := url.Parse(value)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// IsOrigin reports whether value is an origin as browsers send it in the
+// Origin header: an http or https URL with a host, an optional port and
+// nothing else, not even a trailing slash.
+func IsOrigin(value string) bool {
+	if !IsURL(value) {
+		return false
+	}
+	u, _ := url.Parse(value)
+	return u.User == nil && u.Path == "" && u.RawQuery == "" && !u.ForceQuery && u.Fragment == "" && !strings.HasSuffix(value, "#")
+}
@@ -0,0 +1,97 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSend(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		wantErr      bool
+		wantRequests int
+	}{
+		{"delivered", 0, false, 1},
+		{"delivered on retry", 2, false, 3},
+		{"never delivered", attempts, true, attempts},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				requests []*http.Request
+				bodies   [][]byte
+			)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+
+				mu.Lock()
+				defer mu.Unlock()
+				requests = append(requests, r)
+				bodies = append(bodies, body)
+				if len(requests) <= tt.failures {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			}))
+			defer ts.Close()
+
+			n := New(ts.URL, "secret")
+			n.backoff = 50 * time.Millisecond
+
+			start := time.Now()
+			err := n.Send(map[string]string{"action": "movie.created"})
+			elapsed := time.Since(start)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v; want an error: %t", err, tt.wantErr)
+			}
+			if len(requests) != tt.wantRequests {
+				t.Fatalf("got %d requests; want %d", len(requests), tt.wantRequests)
+			}
+
+			// There's a backoff between attempts, but none after the last.
+			var wantBackoff time.Duration
+			for i := 1; i < len(requests); i++ {
+				wantBackoff += time.Duration(i) * n.backoff
+			}
+			if elapsed < wantBackoff || elapsed >= wantBackoff+time.Duration(len(requests))*n.backoff {
+				t.Errorf("took %s; want about %s", elapsed, wantBackoff)
+			}
+
+			id := requests[0].Header.Get("X-Webhook-ID")
+			timestamp := requests[0].Header.Get("X-Webhook-Timestamp")
+			if id == "" || timestamp == "" {
+				t.Fatalf("missing ID %q or timestamp %q", id, timestamp)
+			}
+
+			mac := hmac.New(sha256.New, []byte("secret"))
+			mac.Write([]byte(id + "." + timestamp + "." + string(bodies[0])))
+			want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+			// Retries are the same event, so receivers can deduplicate them.
+			for i, r := range requests {
+				if r.Header.Get("X-Webhook-ID") != id || r.Header.Get("X-Webhook-Timestamp") != timestamp {
+					t.Errorf("request %d has a different ID or timestamp", i)
+				}
+				if got := r.Header.Get("X-Signature"); !hmac.Equal([]byte(got), []byte(want)) {
+					t.Errorf("request %d signature %q; want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSendDisabled(t *testing.T) {
+	if err := New("", "").Send(struct{}{}); err != nil {
+		t.Errorf("got error %v; want none", err)
+	}
+}
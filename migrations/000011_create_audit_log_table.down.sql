@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'admin:audit';
+DROP TABLE IF EXISTS audit_log;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS audit_log (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    action text NOT NULL,
+    resource text NOT NULL,
+    request_id text NOT NULL
+);
+
+INSERT INTO permissions (code)
+VALUES ('admin:audit');
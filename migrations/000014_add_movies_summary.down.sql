@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS movies_title_summary_idx;
+ALTER TABLE movies DROP CONSTRAINT IF EXISTS movies_summary_length_check;
+ALTER TABLE movies DROP COLUMN IF EXISTS summary;
@@ -0,0 +1,3 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS summary text;
+ALTER TABLE movies ADD CONSTRAINT movies_summary_length_check CHECK (char_length(summary) <= 1000);
+CREATE INDEX IF NOT EXISTS movies_title_summary_idx ON movies USING GIN (to_tsvector('simple', title || ' ' || coalesce(summary, '')));
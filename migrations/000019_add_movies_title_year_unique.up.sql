@@ -0,0 +1,4 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS duplicate_allowed boolean NOT NULL DEFAULT false;
+UPDATE movies SET duplicate_allowed = true
+WHERE id NOT IN (SELECT min(id) FROM movies GROUP BY lower(title), year);
+CREATE UNIQUE INDEX IF NOT EXISTS movies_title_year_key ON movies (lower(title), year) WHERE NOT duplicate_allowed;
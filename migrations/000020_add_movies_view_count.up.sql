@@ -0,0 +1 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS view_count bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS invites (
+    hash bytea PRIMARY KEY REFERENCES tokens ON DELETE CASCADE,
+    email citext NOT NULL DEFAULT '',
+    permissions text[] NOT NULL DEFAULT '{}'
+);
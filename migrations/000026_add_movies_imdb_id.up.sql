@@ -0,0 +1 @@
+ALTER TABLE movies ADD COLUMN imdb_id text UNIQUE;
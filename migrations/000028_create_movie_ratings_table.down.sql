@@ -0,0 +1,4 @@
+ALTER TABLE movies DROP COLUMN IF EXISTS rating_count;
+ALTER TABLE movies DROP COLUMN IF EXISTS rating_average;
+
+DROP TABLE IF EXISTS movie_ratings;
@@ -0,0 +1 @@
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS request_hash bytea NOT NULL DEFAULT '';
@@ -0,0 +1,9 @@
+-- A single row holding when a movie was last deleted, which MovieModel.Delete
+-- and DeleteMany update. It's counted in MovieModel.LastModified, since a
+-- deletion leaves no updated_at behind. Deletions before this migration are
+-- unknown, so it starts at the time it runs.
+CREATE TABLE IF NOT EXISTS movie_deletions (
+    last_deleted_at timestamp(0) with time zone NOT NULL
+);
+INSERT INTO movie_deletions (last_deleted_at)
+SELECT NOW() WHERE NOT EXISTS (SELECT 1 FROM movie_deletions);
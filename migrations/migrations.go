@@ -0,0 +1,28 @@
+// Package migrations embeds the SQL migrations so that the api binary knows
+// which schema version it expects.
+package migrations
+
+import (
+	"embed"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+//go:embed *.sql
+var FS embed.FS
+
+// Latest returns the version of the newest embedded migration.
+func Latest() int {
+	entries, _ := fs.ReadDir(FS, ".")
+
+	latest := 0
+	for _, entry := range entries {
+		prefix, _, _ := strings.Cut(entry.Name(), "_")
+		version, err := strconv.Atoi(prefix)
+		if err == nil && version > latest {
+			latest = version
+		}
+	}
+	return latest
+}